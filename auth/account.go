@@ -0,0 +1,102 @@
+package auth
+
+import (
+	"BlockChain/database"
+	"context"
+	"errors"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/crypto/bcrypt"
+	"time"
+)
+
+var (
+	ErrAccountExists      = errors.New("auth: account already exists")
+	ErrInvalidCredentials = errors.New("auth: invalid userid or password")
+	ErrWeakPassword       = errors.New("auth: password is too short")
+)
+
+// minPasswordLen 是密码的最短长度
+const minPasswordLen = 6
+
+// Account 是一个登录账号，密码只保存 bcrypt 哈希
+type Account struct {
+	UserID       string `bson:"userid"`
+	PasswordHash []byte `bson:"passwordHash"`
+	Role         string `bson:"role"`
+	Created      int64  `bson:"created"` // Unix 秒
+}
+
+func accounts() *mongo.Collection {
+	return database.Mgo.Db.Collection("Account")
+}
+
+// EnsureIndexes 创建 userid 上的唯一索引，同一个用户只能注册一次
+func EnsureIndexes() error {
+	_, err := accounts().Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.D{{"userid", 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	return err
+}
+
+// CreateAccount 用 bcrypt 哈希密码并保存新账号，ADMIN_USERS 中的用户注册为管理员
+func CreateAccount(userid, password string) (Account, error) {
+	if len(password) < minPasswordLen {
+		return Account{}, ErrWeakPassword
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return Account{}, err
+	}
+	account := Account{userid, hash, RoleUser, time.Now().Unix()}
+	if admins[userid] {
+		account.Role = RoleAdmin
+	}
+	_, err = accounts().InsertOne(context.Background(), account)
+	if mongo.IsDuplicateKeyError(err) {
+		return Account{}, ErrAccountExists
+	}
+	if err != nil {
+		logrus.Error("MgoDB: Insert Account data error: ", err)
+		return Account{}, err
+	}
+	logrus.Info("MgoDB: Insert Account data success")
+	return account, nil
+}
+
+// FindAccount 返回 userid 的账号，不存在时返回 mongo.ErrNoDocuments
+func FindAccount(userid string) (Account, error) {
+	result := Account{}
+	err := accounts().FindOne(context.Background(), bson.D{{"userid", userid}}).Decode(&result)
+	return result, err
+}
+
+// Login 检查用户名和密码，成功时返回账号
+func Login(userid, password string) (Account, error) {
+	account, err := FindAccount(userid)
+	if err == mongo.ErrNoDocuments {
+		return Account{}, ErrInvalidCredentials
+	}
+	if err != nil {
+		logrus.Error("MgoDB: Query Account data error: ", err)
+		return Account{}, err
+	}
+	if bcrypt.CompareHashAndPassword(account.PasswordHash, []byte(password)) != nil {
+		return Account{}, ErrInvalidCredentials
+	}
+	return account, nil
+}
+
+// RoleOf 返回账号的角色，ADMIN_USERS 中的用户总是管理员
+func RoleOf(account Account) string {
+	if admins[account.UserID] {
+		return RoleAdmin
+	}
+	if account.Role == "" {
+		return RoleUser
+	}
+	return account.Role
+}
@@ -0,0 +1,88 @@
+package auth
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strings"
+)
+
+// gin.Context 中保存当前用户的键
+const (
+	userKey = "auth.userid"
+	roleKey = "auth.role"
+)
+
+// Authenticate 从请求中取出令牌并把用户绑定到请求上，没有令牌的请求作为匿名请求继续处理。
+// 令牌放在 Authorization: Bearer 头中；浏览器的 EventSource 不能设置请求头，
+// queryPaths 中的接口也可以用查询参数 token，其他接口忽略查询参数，避免令牌出现在 URL 里
+func Authenticate(queryPaths ...string) gin.HandlerFunc {
+	allowed := make(map[string]bool, len(queryPaths))
+	for _, p := range queryPaths {
+		allowed[p] = true
+	}
+	return func(c *gin.Context) {
+		var token string
+		if allowed[c.Request.URL.Path] {
+			token = c.Query("token")
+		}
+		if h := c.GetHeader("Authorization"); strings.HasPrefix(h, "Bearer ") {
+			token = strings.TrimPrefix(h, "Bearer ")
+		}
+		if token == "" {
+			c.Next()
+			return
+		}
+		claims, err := ParseToken(token)
+		if err == ErrExpiredToken {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Token expired"})
+			return
+		} else if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+			return
+		}
+		c.Set(userKey, claims.Subject)
+		c.Set(roleKey, claims.Role)
+		c.Next()
+	}
+}
+
+// Required 拒绝没有登录的请求
+func Required() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if UserID(c) == "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Login required"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// Admin 只允许管理员访问
+func Admin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if UserID(c) == "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Login required"})
+			return
+		}
+		if !IsAdmin(c) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Admin role required"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// UserID 返回请求的登录用户，匿名请求返回空字符串
+func UserID(c *gin.Context) string {
+	return c.GetString(userKey)
+}
+
+// IsAdmin 判断请求的登录用户是否为管理员
+func IsAdmin(c *gin.Context) bool {
+	return c.GetString(roleKey) == RoleAdmin
+}
+
+// Allowed 判断登录用户能否以 userid 的身份操作: 只能操作自己，管理员可以操作任何用户
+func Allowed(c *gin.Context, userid string) bool {
+	return userid != "" && (UserID(c) == userid || IsAdmin(c))
+}
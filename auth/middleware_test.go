@@ -0,0 +1,47 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestAuthenticateQueryToken(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	Init("testsecret", time.Hour, nil)
+	token, _, err := IssueToken("alice", RoleUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := gin.New()
+	r.Use(Authenticate("/api/events"))
+	whoami := func(c *gin.Context) { c.String(http.StatusOK, UserID(c)) }
+	r.GET("/api/events", whoami)
+	r.GET("/api/profile", whoami)
+
+	tests := []struct {
+		path   string
+		header string
+		want   string
+	}{
+		{"/api/events?token=" + token, "", "alice"},
+		{"/api/events", "Bearer " + token, "alice"},
+		// 其他接口忽略查询参数中的令牌
+		{"/api/profile?token=" + token, "", ""},
+		{"/api/profile", "Bearer " + token, "alice"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", tt.path, nil)
+		if tt.header != "" {
+			req.Header.Set("Authorization", tt.header)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != http.StatusOK || w.Body.String() != tt.want {
+			t.Errorf("GET %s (%q): %d %q, want user %q", tt.path, tt.header, w.Code, w.Body.String(), tt.want)
+		}
+	}
+}
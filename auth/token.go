@@ -0,0 +1,99 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+// 用户角色
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+var (
+	ErrInvalidToken = errors.New("auth: invalid token")
+	ErrExpiredToken = errors.New("auth: token expired")
+)
+
+// Claims 是令牌中的声明，令牌是 HS256 签名的 JWT
+type Claims struct {
+	Subject   string `json:"sub"`
+	Role      string `json:"role"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+var (
+	secret   []byte
+	tokenTTL = 24 * time.Hour
+	admins   = make(map[string]bool)
+)
+
+// jwtHeader 是固定的 JWT 头部 {"alg":"HS256","typ":"JWT"}
+var jwtHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// Init 设置签名密钥、令牌有效期和管理员用户。
+// key 为空时使用随机密钥，节点重启后之前签发的令牌全部失效，多个实例之间令牌也不通用。
+func Init(key string, ttl time.Duration, adminUsers []string) {
+	if key == "" {
+		secret = make([]byte, 32)
+		rand.Read(secret)
+	} else {
+		secret = []byte(key)
+	}
+	if ttl > 0 {
+		tokenTTL = ttl
+	}
+	admins = make(map[string]bool)
+	for _, userid := range adminUsers {
+		admins[userid] = true
+	}
+}
+
+// IssueToken 为 userid 签发令牌，返回令牌和过期时间
+func IssueToken(userid, role string) (string, time.Time, error) {
+	now := time.Now()
+	expires := now.Add(tokenTTL)
+	payload, err := json.Marshal(Claims{userid, role, now.Unix(), expires.Unix()})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	unsigned := jwtHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return unsigned + "." + sign(unsigned), expires, nil
+}
+
+// ParseToken 检查令牌的签名和有效期，返回令牌中的声明
+func ParseToken(token string) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != jwtHeader {
+		return Claims{}, ErrInvalidToken
+	}
+	if !hmac.Equal([]byte(sign(parts[0]+"."+parts[1])), []byte(parts[2])) {
+		return Claims{}, ErrInvalidToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return Claims{}, ErrInvalidToken
+	}
+	var claims Claims
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Subject == "" {
+		return Claims{}, ErrInvalidToken
+	}
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return Claims{}, ErrExpiredToken
+	}
+	return claims, nil
+}
+
+func sign(unsigned string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(unsigned))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,314 @@
+package block
+
+import (
+	"BlockChain/wallet"
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrInsufficientFunds  = errors.New("block: not enough funds")
+	ErrInsufficientAssets = errors.New("block: not enough items")
+	ErrNoIssuer           = errors.New("block: this node does not own the issuer wallet")
+)
+
+// IssueVout 是发行输入的 Vout。发行输入的 Txid 为空，由 Consensus.Issuer 的钱包签名，
+// 带有发行输入的交易可以产生新的物品输出，每笔交易最多一个发行输入
+const IssueVout = -2
+
+// IsIssue 判断输入是否为发行输入
+func (in TXInput) IsIssue() bool {
+	return in.Txid == "" && in.Vout == IssueVout
+}
+
+// issuerOutput 是发行输入"引用"的输出，验证签名时要求发行输入由发行人签名
+func issuerOutput() TXOutput {
+	return TXOutput{ScriptPubKey: Consensus.Issuer}
+}
+
+// checkOutputs 检查非 coinbase 交易的输入和输出:
+// 币的输出 Value 为正，物品输出 Quantity 为正且 Value 为 0，最多一个发行输入，同一个输出不能被引用两次
+func checkOutputs(tx Transaction) error {
+	seen := make(map[string]bool, len(tx.Vin))
+	for _, vin := range tx.Vin {
+		key := outpoint(vin.Txid, vin.Vout)
+		if seen[key] && vin.IsIssue() {
+			return fmt.Errorf("more than one issue input")
+		}
+		if seen[key] {
+			return fmt.Errorf("input %s is spent twice", key)
+		}
+		seen[key] = true
+	}
+	for _, out := range tx.Vout {
+		if out.Asset == "" && (out.Value <= 0 || out.Quantity != 0) {
+			return fmt.Errorf("coin output must have a positive value")
+		}
+		if out.Asset != "" && (out.Value != 0 || out.Quantity <= 0) {
+			return fmt.Errorf("item output %s must have a positive quantity and no value", out.Asset)
+		}
+	}
+	return nil
+}
+
+// checkAmounts 检查交易的输出没有超过输入: 币的输出不能多于输入，
+// 每种物品的输出必须等于输入，只有带发行输入的交易可以产生新的物品。返回交易的手续费，即币的输入减去输出
+func checkAmounts(tx Transaction, prevOutputs map[string]TXOutput) (int, error) {
+	coins := 0
+	assets := make(map[string]int)
+	issue := false
+	for _, vin := range tx.Vin {
+		if vin.IsIssue() {
+			issue = true
+			continue
+		}
+		out := prevOutputs[outpoint(vin.Txid, vin.Vout)]
+		coins += out.Value
+		if out.Asset != "" {
+			assets[out.Asset] += out.Quantity
+		}
+	}
+	for _, out := range tx.Vout {
+		coins -= out.Value
+		if out.Asset != "" {
+			assets[out.Asset] -= out.Quantity
+		}
+	}
+	if coins < 0 {
+		return 0, fmt.Errorf("outputs exceed inputs by %d", -coins)
+	}
+	if !issue {
+		for asset, n := range assets {
+			if n != 0 {
+				return 0, fmt.Errorf("item %s: inputs and outputs differ by %d", asset, n)
+			}
+		}
+	}
+	return coins, nil
+}
+
+// Assets 返回 userid 钱包中的物品数量，以物品 id 为键。
+// 和 GetBalance 不同，这里包括交易池中还没有打包的交易，也就是现在可以使用的数量
+func Assets(userid string) (map[string]int, error) {
+	items := make(map[string]int)
+	w, ok := wallet.Find(userid)
+	if !ok {
+		return items, nil
+	}
+	address := w.GetAddress()
+
+	chainMu.RLock()
+	defer chainMu.RUnlock()
+	utxos, err := findUTXOs(address)
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range append(utxos, pool.pendingOutputs(address)...) {
+		if u.Asset != "" && !pool.isSpent(u.Key()) {
+			items[u.Asset] += u.Quantity
+		}
+	}
+	return items, nil
+}
+
+// TxBuilder 组装一笔可以有多个付款人的交易，币和物品可以在同一笔交易中交换，
+// 例如买家付币给卖家、卖家把物品转给买家，两边要么一起生效，要么都不生效
+type TxBuilder struct {
+	inputs      []TXInput
+	outputs     []TXOutput
+	prevOutputs map[string]TXOutput
+	signers     map[string]*wallet.Wallet
+	records     []Record
+	payer       string // 第一个付币的用户，交易的手续费不够 MinFee 时由他补上
+	fee         int
+}
+
+func NewTxBuilder() *TxBuilder {
+	return &TxBuilder{
+		prevOutputs: make(map[string]TXOutput),
+		signers:     make(map[string]*wallet.Wallet),
+	}
+}
+
+// Pay 从 from 的币中付 amount 给 to，找零回到 from
+func (b *TxBuilder) Pay(from, to string, amount int) error {
+	if err := b.spend(from, to, "", amount); err != nil {
+		return err
+	}
+	b.records = append(b.records, Record{From: from, To: to, Amount: amount})
+	if b.payer == "" {
+		b.payer = from
+	}
+	return nil
+}
+
+// Fee 由 from 付 amount 个币的手续费，手续费没有输出。
+// 先从 from 已有的找零中扣除，找零不够时再选出 from 的其他输出
+func (b *TxBuilder) Fee(from string, amount int) error {
+	if amount <= 0 {
+		return ErrInvalidTransaction
+	}
+	if w, ok := wallet.Find(from); ok {
+		address := w.GetAddress()
+		for i, out := range b.outputs {
+			if out.Asset == "" && out.ScriptPubKey == address && out.Value >= amount {
+				if out.Value == amount {
+					b.outputs = append(b.outputs[:i], b.outputs[i+1:]...)
+				} else {
+					b.outputs[i].Value -= amount
+				}
+				b.fee += amount
+				return nil
+			}
+		}
+	}
+	if err := b.spend(from, "", "", amount); err != nil {
+		return err
+	}
+	b.fee += amount
+	return nil
+}
+
+// Send 把 from 的 quantity 个物品 asset 转给 to，多余的部分回到 from
+func (b *TxBuilder) Send(from, to, asset string, quantity int) error {
+	if asset == "" {
+		return ErrInvalidTransaction
+	}
+	return b.spend(from, to, asset, quantity)
+}
+
+// Issue 发行 quantity 个物品 asset 给 to，本节点必须有 Consensus.Issuer 的钱包
+func (b *TxBuilder) Issue(to, asset string, quantity int) error {
+	if asset == "" || quantity <= 0 {
+		return ErrInvalidTransaction
+	}
+	issuer, ok := wallet.Owner(Consensus.Issuer)
+	if !ok {
+		return ErrNoIssuer
+	}
+	w, _ := wallet.Find(issuer)
+	toAddress, err := wallet.Address(to)
+	if err != nil {
+		return err
+	}
+	key := outpoint("", IssueVout)
+	if _, ok := b.prevOutputs[key]; !ok {
+		b.inputs = append(b.inputs, TXInput{"", IssueVout, nil, w.PublicKey})
+		b.prevOutputs[key] = issuerOutput()
+		b.signers[Consensus.Issuer] = w
+	}
+	b.outputs = append(b.outputs, TXOutput{ScriptPubKey: toAddress, Asset: asset, Quantity: quantity})
+	return nil
+}
+
+// spend 选出 from 足够的币（asset 为空）或物品，加入输入，并加上给 to 的输出和找零
+func (b *TxBuilder) spend(from, to, asset string, amount int) error {
+	if amount <= 0 {
+		return ErrInvalidTransaction
+	}
+	insufficient := ErrInsufficientFunds
+	if asset != "" {
+		insufficient = ErrInsufficientAssets
+	}
+	fromWallet, ok := wallet.Find(from)
+	if !ok {
+		return insufficient
+	}
+	// to 为空时是手续费，只有找零没有输出
+	var toAddress string
+	if to != "" {
+		var err error
+		if toAddress, err = wallet.Address(to); err != nil {
+			return err
+		}
+	}
+	fromAddress := fromWallet.GetAddress()
+	selected, acc, err := b.selectOutputs(fromAddress, asset, amount)
+	if err != nil {
+		return err
+	}
+	if acc < amount {
+		return insufficient
+	}
+	for _, u := range selected {
+		b.inputs = append(b.inputs, TXInput{u.Txid, u.Vout, nil, fromWallet.PublicKey})
+		b.prevOutputs[u.Key()] = u.Output()
+	}
+	b.signers[fromAddress] = fromWallet
+	if asset == "" {
+		if toAddress != "" {
+			b.outputs = append(b.outputs, TXOutput{Value: amount, ScriptPubKey: toAddress})
+		}
+		if acc > amount {
+			b.outputs = append(b.outputs, TXOutput{Value: acc - amount, ScriptPubKey: fromAddress})
+		}
+	} else {
+		b.outputs = append(b.outputs, TXOutput{ScriptPubKey: toAddress, Asset: asset, Quantity: amount})
+		if acc > amount {
+			b.outputs = append(b.outputs, TXOutput{ScriptPubKey: fromAddress, Asset: asset, Quantity: acc - amount})
+		}
+	}
+	return nil
+}
+
+// selectOutputs 在 UTXO 集合和交易池中为 address 选出足够 amount 的币或物品 asset，
+// 已经被交易池或这笔交易使用的输出不会被选中
+func (b *TxBuilder) selectOutputs(address, asset string, amount int) ([]UTXO, int, error) {
+	chainMu.RLock()
+	defer chainMu.RUnlock()
+
+	utxos, err := findUTXOs(address)
+	if err != nil {
+		return nil, 0, err
+	}
+	var selected []UTXO
+	accumulated := 0
+	for _, u := range append(utxos, pool.pendingOutputs(address)...) {
+		if accumulated >= amount {
+			break
+		}
+		if u.Asset != asset || pool.isSpent(u.Key()) {
+			continue
+		}
+		if _, used := b.prevOutputs[u.Key()]; used {
+			continue
+		}
+		selected = append(selected, u)
+		if asset == "" {
+			accumulated += u.Value
+		} else {
+			accumulated += u.Quantity
+		}
+	}
+	return selected, accumulated, nil
+}
+
+// Build 由每个付款人对自己的输入签名，返回组装好的交易。
+// 交易花费了币并且手续费不够 MinFee 时，由第一个付币的用户补上
+func (b *TxBuilder) Build() (Transaction, error) {
+	if len(b.inputs) == 0 || len(b.outputs) == 0 {
+		return Transaction{}, ErrInvalidTransaction
+	}
+	if b.payer != "" && b.fee < MinFee {
+		if err := b.Fee(b.payer, MinFee-b.fee); err != nil {
+			return Transaction{}, err
+		}
+	}
+	tx := Transaction{"", b.inputs, b.outputs}
+	for _, w := range b.signers {
+		if err := tx.Sign(w.PrivateKey, b.prevOutputs); err != nil {
+			return Transaction{}, err
+		}
+	}
+	tx.SetID()
+	return tx, nil
+}
+
+// Submit 组装交易并放进交易池，其中的币转账在交易被打包时写入交易记录
+func (b *TxBuilder) Submit() (Transaction, error) {
+	tx, err := b.Build()
+	if err != nil {
+		return tx, err
+	}
+	return tx, SubmitTransaction(tx, b.records...)
+}
@@ -1,110 +1,267 @@
 package block
 
 import (
-	"BlockChain/database"
-	"context"
+	"BlockChain/wallet"
 	"crypto/sha256"
 	"encoding/hex"
-	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/sirupsen/logrus"
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo"
 	"strconv"
-	"strings"
-	"sync"
 	"time"
 )
 
 // Block represents each 'item' in the blockchain
 type Block struct {
-	Index        int         `bson:"index"`
-	Timestamp    string      `bson:"timestamp"`
-	Hash         string      `bson:"hash"`
-	PrevHash     string      `bson:"prevHash"`
-	Nonce        int         `bson:"nonce"`
-	Transactions Transaction `bson:"transaction"`
+	Index        int           `bson:"index"`
+	Timestamp    int64         `bson:"timestamp"` // Unix 秒
+	Hash         string        `bson:"hash"`
+	PrevHash     string        `bson:"prevHash"`
+	Nonce        int           `bson:"nonce"`
+	Bits         int           `bson:"bits"`       // 难度: 区块哈希前导 0 的位数
+	MerkleRoot   string        `bson:"merkleRoot"` // 区块中全部交易 ID 的 Merkle 根
+	Transactions []Transaction `bson:"transactions"`
 }
 
-func Init() {
-	mutex.Lock()
-	defer mutex.Unlock()
+var (
+	ErrKnownBlock  = errors.New("block: block already in chain")
+	ErrOrphanBlock = errors.New("block: previous block not in chain")
+	// ErrInvalidBlock 表示区块没有通过检查，appendBlock 返回的错误包装了具体原因
+	ErrInvalidBlock = errors.New("block: invalid block")
+)
+
+// store 是当前使用的存储后端，由 Init 设置
+var store ChainStore
+
+// Init 设置存储后端，存储里还没有区块时写入创世区块
+func Init(s ChainStore) error {
+	chainMu.Lock()
+	defer chainMu.Unlock()
 
+	store = s
 	// 如果必要的话初始化区块链
-	client := database.Mgo.Client
-	collection := client.Database("BlockChain").Collection("Block")
-	result := Block{}
-	err := collection.FindOne(context.TODO(), bson.M{}).Decode(&result)
-	if err != nil {
-		if err == mongo.ErrNoDocuments {
-			// This error means your query did not match any documents.
-			initBlockChain()
-		} else {
-			logrus.Error("MgoDB: Query BlockChain data error: ", err)
-		}
+	_, err := store.LastBlock()
+	if err == ErrNotFound {
+		// 存储里还没有任何区块
+		return initBlockChain()
 	}
+	return err
+}
 
+// findLastBlock 返回链尾区块的哈希和 index，链为空时返回 "", -1
+func findLastBlock() (string, int, error) {
+	result, err := store.LastBlock()
+	if err == ErrNotFound {
+		return "", -1, nil
+	}
+	if err != nil {
+		return "", -1, err
+	}
+	return result.Hash, result.Index, nil
 }
 
-func findLastBlock() (string, int) {
+// maxAppendRetries 是写入区块遇到 ErrConflict 时重新出块的最多次数
+const maxAppendRetries = 5
 
-	client := database.Mgo.Client
-	collection := client.Database("BlockChain").Collection("Block")
-	filter := bson.D{{}}
-	count, err := collection.CountDocuments(context.TODO(), filter)
+// appendBlock 检查区块能否接在链尾，然后在同一个事务中写入区块、更新 UTXO 集合，
+// 并保存 records 和区块中交易池里的交易的转账记录，区块写入后不再修改。调用方需要持有 chainMu 的写锁。
+func appendBlock(newBlock Block, records []Record) error {
+	if err := checkNewBlock(newBlock); err != nil {
+		logrus.Error("ChainStore: Reject block ", newBlock.Index, ": ", err)
+		return fmt.Errorf("%w: %v", ErrInvalidBlock, err)
+	}
+	records = append(records, pool.blockRecords(newBlock)...)
+	err := store.AppendBlock(newBlock, records)
+	if err == ErrConflict {
+		logrus.Info("ChainStore: Block ", newBlock.Index, " was appended by another writer")
+		return err
+	}
 	if err != nil {
-		logrus.Error("MgoDB: Count BlockChain data error: ", err)
+		logrus.Error("ChainStore: Insert BlockChain data error: ", err)
+		return err
+	}
+	logrus.Info("ChainStore: Insert BlockChain data success")
+	notifyBlock(newBlock)
+	return nil
+}
+
+// produce 在链尾挖出一个包含 transactions 的区块并写入，写入成功后从交易池去掉已打包的交易。
+// miner 不为空时区块的第一笔交易是给 miner 的 coinbase 交易，奖励是区块奖励加上交易的手续费，
+// 挖矿记录和区块在同一个事务中写入，区块写入失败时不会留下记录。
+// 另一个进程先写入了同一高度的区块时，在新的链尾上重新出块。
+// 只能在 writer 协程中调用，挖矿时不持有锁，写入时才持有 chainMu 的写锁。
+func produce(miner string, transactions []Transaction) (Block, error) {
+	var newBlock Block
+	var err error
+	for i := 0; i < maxAppendRetries; i++ {
+		var records []Record
+		chainMu.RLock()
+		newBlock, err = nextBlock()
+		if err != nil {
+			chainMu.RUnlock()
+			return newBlock, err
+		}
+		newBlock.Transactions = transactions
+		// 奖励已经减半到 0 并且没有手续费时区块没有 coinbase 交易
+		if reward := BlockSubsidy(newBlock.Index) + blockFees(transactions); miner != "" && reward > 0 {
+			var address string
+			address, err = wallet.Address(miner)
+			if err != nil {
+				chainMu.RUnlock()
+				return newBlock, err
+			}
+			coinbase := NewCoinbaseTX(address, reward)
+			newBlock.Transactions = append([]Transaction{coinbase}, transactions...)
+			records = []Record{{0, "genesis", miner, reward, coinbase.ID}}
+		}
+		chainMu.RUnlock()
+		mine(&newBlock)
+		for j := range records {
+			records[j].Timestamp = newBlock.Timestamp
+		}
+
+		chainMu.Lock()
+		err = appendBlock(newBlock, records)
+		if err == nil {
+			pool.revalidate(nil)
+		} else if errors.Is(err, ErrInvalidBlock) {
+			// 交易池中的交易让区块通不过检查，留在交易池里以后每次出块都会失败
+			pool.drop(transactions)
+		}
+		chainMu.Unlock()
+		if err != ErrConflict {
+			break
+		}
+	}
+	return newBlock, err
+}
+
+// ReceiveBlock 处理从其他节点收到的区块。
+// 接在链尾的区块直接写入，并从交易池中去掉已经被区块打包或与之冲突的交易；
+// 接在其他位置的区块作为分叉区块保存，分叉的累计工作量超过主链时进行链重组。
+// 区块已经在主链或分叉上时返回 ErrKnownBlock，区块的前一个区块还没有同步时返回 ErrOrphanBlock。
+func ReceiveBlock(b Block) (err error) {
+	write(func() {
+		chainMu.Lock()
+		defer chainMu.Unlock()
+		err = receiveBlock(b)
+	})
+	return err
+}
+
+func receiveBlock(b Block) error {
+	if _, err := store.BlockByHash(b.Hash); err == nil {
+		return ErrKnownBlock
+	}
+	if _, err := store.SideBlock(b.Hash); err == nil {
+		return ErrKnownBlock
 	}
-	LastIndex := int(count) - 1
-	result := Block{}
-	err = collection.FindOne(context.TODO(), bson.D{{"index", LastIndex}}).Decode(&result)
+	last, err := store.LastBlock()
 	if err != nil {
-		logrus.Error("MgoDB: Query BlockChain data error: ", err)
+		return err
+	}
+	if b.PrevHash != last.Hash {
+		return receiveSideBlock(b, last)
 	}
-	return result.Hash, LastIndex
+	if err := appendBlock(b, nil); err != nil {
+		return err
+	}
+	pool.revalidate(nil)
+	return nil
 }
 
-var mutex = &sync.Mutex{}
+// Height 返回链尾区块的 index，链为空时返回 -1
+func Height() (int, error) {
+	chainMu.RLock()
+	defer chainMu.RUnlock()
+	_, height, err := findLastBlock()
+	return height, err
+}
 
-func AppendBlock(newBlock Block) {
-	client := database.Mgo.Client
-	collection := client.Database("BlockChain").Collection("Block")
-	result := Block{}
-	LastHash, _ := findLastBlock()
-	err := collection.FindOne(context.TODO(), bson.D{{"hash", LastHash}}).Decode(&result)
+// GenesisHash 返回创世区块的哈希，链为空时返回 ErrNotFound
+func GenesisHash() (string, error) {
+	chainMu.RLock()
+	defer chainMu.RUnlock()
+	return genesisHash()
+}
+
+func genesisHash() (string, error) {
+	blocks, err := store.Blocks(0, 1)
 	if err != nil {
-		logrus.Error("MgoDB: Query BlockChain data error: ", err)
+		return "", err
 	}
+	if len(blocks) == 0 {
+		return "", ErrNotFound
+	}
+	return blocks[0].Hash, nil
+}
 
-	_, err = collection.InsertOne(context.TODO(), newBlock)
+// BlocksFrom 按 index 升序返回从 from 开始的最多 limit 个区块
+func BlocksFrom(from, limit int) ([]Block, error) {
+	chainMu.RLock()
+	defer chainMu.RUnlock()
+	return store.Blocks(from, limit)
+}
+
+// inChain 判断交易是否已经在主链上
+func inChain(txid string) bool {
+	_, err := store.BlockByTxid(txid)
+	return err == nil
+}
+
+// checkNewBlock 检查区块和链尾的链接、时间戳、所在高度的难度，以及区块中的交易
+func checkNewBlock(newBlock Block) error {
+	last, err := store.LastBlock()
 	if err != nil {
-		logrus.Error("MgoDB: Insert BlockChain data error: ", err)
-	} else {
-		logrus.Info("MgoDB: Insert BlockChain data success")
+		return err
+	}
+	if err := validateBlock(newBlock, last); err != nil {
+		return err
+	}
+	prev, err := recentBlocks(newBlock.Index)
+	if err != nil {
+		return err
+	}
+	if err := checkTimestamp(newBlock, prev, time.Now()); err != nil {
+		return err
+	}
+	if err := verifyProofOfWork(newBlock, prev); err != nil {
+		return err
 	}
+	return verifyTransactions(newBlock, utxoView(newBlock), inChain)
 }
 
 // make sure block is valid by checking index, and comparing the hash of the previous block
-func isBlockValid(newBlock, oldBlock Block) bool {
+func validateBlock(newBlock, oldBlock Block) error {
 	if oldBlock.Index+1 != newBlock.Index {
-		return false
+		return fmt.Errorf("index %d does not follow previous index %d", newBlock.Index, oldBlock.Index)
 	}
 
 	if oldBlock.Hash != newBlock.PrevHash {
-		return false
+		return fmt.Errorf("prevHash %s does not match previous block hash %s", newBlock.PrevHash, oldBlock.Hash)
 	}
 
-	if calculateBlockHash(newBlock) != newBlock.Hash {
-		return false
+	return validateBlockHash(newBlock)
+}
+
+// validateBlockHash 检查 Merkle 根是否和区块中的交易一致，以及区块哈希是否和区块头一致
+func validateBlockHash(b Block) error {
+	if merkleRoot(b.Transactions) != b.MerkleRoot {
+		return fmt.Errorf("merkleRoot %s does not match block transactions", b.MerkleRoot)
 	}
 
-	return true
+	if calculateBlockHash(b) != b.Hash {
+		return fmt.Errorf("hash %s does not match block content", b.Hash)
+	}
+
+	return nil
 }
 
 // SHA256 hashing
+// 区块哈希只覆盖区块头，交易通过 MerkleRoot 间接包含在哈希里
 func calculateBlockHash(block Block) string {
-	record := strconv.Itoa(block.Index) + block.Timestamp + block.PrevHash
-	t, _ := json.Marshal(block.Transactions)
-	record += strconv.Itoa(block.Nonce) + string(t)
+	record := strconv.Itoa(block.Index) + strconv.FormatInt(block.Timestamp, 10) + block.PrevHash
+	record += strconv.Itoa(block.Nonce) + strconv.Itoa(block.Bits) + block.MerkleRoot
 	h := sha256.New()
 	h.Write([]byte(record))
 	hashed := h.Sum(nil)
@@ -116,109 +273,80 @@ func generateBlock(oldBlock Block) Block {
 
 	var newBlock Block
 	newBlock.Index = oldBlock.Index + 1
-	newBlock.Timestamp = time.Now().String()
+	newBlock.Timestamp = time.Now().Unix()
 	newBlock.PrevHash = oldBlock.Hash
 	newBlock.Hash = calculateBlockHash(newBlock)
 
 	return newBlock
 }
 
-func initBlockChain() {
+func initBlockChain() error {
 
-	client := database.Mgo.Client
-	collection := client.Database("BlockChain").Collection("Block")
-	logrus.Info("MgoDB: No BlockChain data, init BlockChain")
+	logrus.Info("ChainStore: No BlockChain data, init BlockChain")
 
 	// 第一个 coinbase 交易
-	cbAddress := NewCoinbaseTX("genesis coinbaseTX", 50)
+	// 创世区块在所有节点上必须完全相同，所以不使用随机数据和当前时间
+	cbAddress := Transaction{"", []TXInput{{"", -1, nil, []byte("genesis coinbaseTX")}}, []TXOutput{{50, "genesis coinbaseTX", "", 0}}}
+	cbAddress.SetID()
 
-	genesisBlock := Block{}
-	genesisBlock = Block{0, time.Now().String(),
-		calculateBlockHash(genesisBlock), "", 0, cbAddress}
+	genesisBlock := Block{0, Consensus.GenesisTime, "", "", 0, Consensus.InitialBits, "", []Transaction{cbAddress}}
+	mine(&genesisBlock)
 
-	_, err := collection.InsertOne(context.TODO(), genesisBlock)
-	if err != nil {
-		logrus.Error("MgoDB: Init genesis Block error: ", err)
-	} else {
-		logrus.Info("MgoDB: Init genesis Block success")
+	err := store.AppendBlock(genesisBlock, nil)
+	if err == ErrConflict {
+		logrus.Info("ChainStore: Genesis Block was created by another writer")
+		return nil
 	}
-}
-
-func proofOfWork(b Block) (bool, string) {
-	for {
-		h := sha256.New()
-		h.Write([]byte(strconv.Itoa(b.Nonce) + b.PrevHash + b.Timestamp))
-		hashed := h.Sum(nil)
-		hash := hex.EncodeToString(hashed)
-		if strings.HasPrefix(hash, "0000") {
-			return true, hash
-		}
-		b.Nonce++
+	if err != nil {
+		return err
 	}
-
+	logrus.Info("ChainStore: Init genesis Block success")
+	return nil
 }
 
-func MineBlock(Userid string, amount int) Block {
+// nextBlock 在链尾之后创建一个还没有挖矿的区块，难度和时间戳按最近的区块计算
+func nextBlock() (Block, error) {
 	var newBlock Block
-	a, b := findLastBlock()
-	//fmt.Println("LastBlock index: ", b, "LastBlock hash: ", a)
+	a, b, err := findLastBlock()
+	if err != nil {
+		return newBlock, err
+	}
 	newBlock.Index = b + 1
-	newBlock.Timestamp = time.Now().String()
 	newBlock.PrevHash = a
-	newBlock.Nonce = 0
-	flag := false
-	for {
-		newBlock.Hash = calculateBlockHash(newBlock)
-		st := []string{"0"}
-		for _, v := range st {
-			if strings.HasPrefix(newBlock.Hash, v) {
-				flag = true
-				break
-			}
-		}
-		if flag == false {
-			newBlock.Nonce++
-		} else {
-			break
-		}
+	prev, err := recentBlocks(newBlock.Index)
+	if err != nil {
+		return newBlock, err
 	}
-	//fmt.Println("NewBlock index: ", newBlock.Index, "NewBlock hash: ", newBlock.Hash)
-	newBlock.Transactions = NewCoinbaseTX(Userid, amount)
-	InsertRecord(newBlock.Timestamp, "genesis", Userid, amount, newBlock.Transactions.ID)
-	AppendBlock(newBlock)
-	return newBlock
+	newBlock.Timestamp = nextTimestamp(prev, time.Now())
+	newBlock.Bits = nextBits(prev)
+	return newBlock, nil
 }
 
-func TXBlock(timestamp string, transaction Transaction) Block {
-	var newBlock Block
-	a, b := findLastBlock()
-	newBlock.Index = b + 1
-	newBlock.Timestamp = timestamp
-	newBlock.PrevHash = a
-	newBlock.Nonce = 0
-	newBlock.Transactions = transaction
-	newBlock.Hash = calculateBlockHash(newBlock)
-	//spew.Dump(newBlock)
-	AppendBlock(newBlock)
-	return newBlock
+// MineBlock 挖出一个新区块，区块里包含给 Userid 的 coinbase 交易和交易池中等待打包的交易，
+// 奖励由共识的区块奖励和交易的手续费决定
+func MineBlock(Userid string) (newBlock Block, err error) {
+	write(func() {
+		newBlock, err = produce(Userid, pool.Batch(0))
+	})
+	//fmt.Println("NewBlock index: ", newBlock.Index, "NewBlock hash: ", newBlock.Hash)
+	return newBlock, err
 }
 
-func FindAllBlocks() []Block {
-	client := database.Mgo.Client
-	collection := client.Database("BlockChain").Collection("Block")
-	filter := bson.D{{"index", bson.D{{"$gt", 0}}}}
+// FindAllBlocks 返回除创世区块以外的全部区块
+func FindAllBlocks() ([]Block, error) {
+	chainMu.RLock()
+	defer chainMu.RUnlock()
 
-	cursor, err := collection.Find(context.TODO(), filter)
+	blocks, err := store.AllBlocks()
 	if err != nil {
-		logrus.Info("MgoDB: find blocks error: ", err)
+		return nil, err
 	}
 
 	var results []Block
-	if err = cursor.All(context.TODO(), &results); err != nil {
-		logrus.Info("MgoDB: find transactions error: ", err)
-	}
-	for _, result := range results {
-		cursor.Decode(&result)
+	for _, b := range blocks {
+		if b.Index > 0 {
+			results = append(results, b)
+		}
 	}
-	return results
+	return results, nil
 }
@@ -0,0 +1,41 @@
+package block
+
+import "sync"
+
+// 区块和交易事件的订阅者，p2p 等模块通过它们得知本节点新写入的区块和新接受的交易。
+// 订阅函数在持有 chainMu 写锁时被调用，不能阻塞，也不能再调用 block 包中需要 chainMu 的函数。
+var (
+	listenersMu    sync.RWMutex
+	blockListeners []func(Block)
+	txListeners    []func(Transaction)
+)
+
+// OnBlock 注册一个函数，每当有区块写入链尾时调用
+func OnBlock(f func(Block)) {
+	listenersMu.Lock()
+	defer listenersMu.Unlock()
+	blockListeners = append(blockListeners, f)
+}
+
+// OnTransaction 注册一个函数，每当有交易进入交易池时调用
+func OnTransaction(f func(Transaction)) {
+	listenersMu.Lock()
+	defer listenersMu.Unlock()
+	txListeners = append(txListeners, f)
+}
+
+func notifyBlock(b Block) {
+	listenersMu.RLock()
+	defer listenersMu.RUnlock()
+	for _, f := range blockListeners {
+		f(b)
+	}
+}
+
+func notifyTransaction(tx Transaction) {
+	listenersMu.RLock()
+	defer listenersMu.RUnlock()
+	for _, f := range txListeners {
+		f(tx)
+	}
+}
@@ -0,0 +1,78 @@
+package block
+
+// TxInfo 是浏览器中的一笔交易: 已经打包的交易带有所在区块和确认数，
+// 还在交易池中的交易 Pending 为 true，BlockIndex 为 -1
+type TxInfo struct {
+	Transaction   Transaction `json:"transaction"`
+	BlockIndex    int         `json:"blockIndex"`
+	BlockHash     string      `json:"blockHash,omitempty"`
+	Confirmations int         `json:"confirmations"`
+	Pending       bool        `json:"pending"`
+}
+
+// BlockByHeight 返回主链上 index 为 height 的区块，不存在时返回 ErrNotFound
+func BlockByHeight(height int) (Block, error) {
+	if height < 0 {
+		return Block{}, ErrNotFound
+	}
+	chainMu.RLock()
+	defer chainMu.RUnlock()
+	blocks, err := store.Blocks(height, 1)
+	if err != nil {
+		return Block{}, err
+	}
+	if len(blocks) == 0 {
+		return Block{}, ErrNotFound
+	}
+	return blocks[0], nil
+}
+
+// BlockByHash 返回主链上哈希为 hash 的区块，不存在时返回 ErrNotFound
+func BlockByHash(hash string) (Block, error) {
+	chainMu.RLock()
+	defer chainMu.RUnlock()
+	return store.BlockByHash(hash)
+}
+
+// FindTransaction 在主链和交易池中查找交易 txid，都不存在时返回 ErrNotFound
+func FindTransaction(txid string) (TxInfo, error) {
+	chainMu.RLock()
+	defer chainMu.RUnlock()
+
+	b, err := store.BlockByTxid(txid)
+	if err == ErrNotFound {
+		if tx, ok := pool.find(txid); ok {
+			return TxInfo{Transaction: tx, BlockIndex: -1, Pending: true}, nil
+		}
+		return TxInfo{}, ErrNotFound
+	}
+	if err != nil {
+		return TxInfo{}, err
+	}
+	_, height, err := findLastBlock()
+	if err != nil {
+		return TxInfo{}, err
+	}
+	for _, tx := range b.Transactions {
+		if tx.ID == txid {
+			return TxInfo{tx, b.Index, b.Hash, height - b.Index + 1, false}, nil
+		}
+	}
+	return TxInfo{}, ErrNotFound
+}
+
+// UTXOPage 按 txid:vout 排序返回 address 在 key 为 after 的 UTXO 之后的最多 limit 个 UTXO，
+// after 为空时从头开始。next 是下一页的 after，没有下一页时为空。
+func UTXOPage(address, after string, limit int) (utxos []UTXO, next string, err error) {
+	if limit <= 0 {
+		return nil, "", nil
+	}
+	chainMu.RLock()
+	defer chainMu.RUnlock()
+	// 多取一个判断是否还有下一页
+	utxos, err = store.UTXOPage(address, after, limit+1)
+	if err != nil || len(utxos) <= limit {
+		return utxos, "", err
+	}
+	return utxos[:limit], utxos[limit-1].Key(), nil
+}
@@ -0,0 +1,83 @@
+package block
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"math"
+	"sort"
+)
+
+// ErrFeeTooLow 表示交易的手续费低于交易池要求的最低手续费
+var ErrFeeTooLow = errors.New("block: transaction fee is below the minimum")
+
+// MinFee 是交易池接受花费币的交易时要求的最低手续费，由 main 按配置设置。
+// 这是本节点的策略，不是共识规则；只转移物品或发行物品的交易没有币的输入，不要求手续费
+var MinFee = 0
+
+// Size 返回交易编码后的字节数，手续费率是手续费除以字节数
+func (tx Transaction) Size() int {
+	var encoded bytes.Buffer
+	if err := gob.NewEncoder(&encoded).Encode(tx); err != nil {
+		return 0
+	}
+	return encoded.Len()
+}
+
+// spendsCoins 判断交易是否花费了币的输出
+func spendsCoins(prevOutputs map[string]TXOutput) bool {
+	for _, out := range prevOutputs {
+		if out.Value > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// feeRate 是每字节的手续费
+func feeRate(fee, size int) float64 {
+	if size <= 0 {
+		return 0
+	}
+	return float64(fee) / float64(size)
+}
+
+// FeeEstimate 是大小为 Size 字节的交易的手续费估计:
+// Minimum 是最低手续费，NextBlock 是按交易池现在的情况能进入下一个区块的手续费，Median 是交易池中手续费率的中位数
+type FeeEstimate struct {
+	Size      int `json:"size"`
+	Minimum   int `json:"minimum"`
+	NextBlock int `json:"nextBlock"`
+	Median    int `json:"median"`
+	Pending   int `json:"pending"` // 交易池中的交易数
+}
+
+// EstimateFee 根据交易池中交易的手续费率估计大小为 size 字节的交易需要的手续费
+func EstimateFee(size int) FeeEstimate {
+	pool.mu.Lock()
+	rates := make([]float64, 0, len(pool.txs))
+	for _, tx := range pool.txs {
+		f := pool.fees[tx.ID]
+		rates = append(rates, feeRate(f.fee, f.size))
+	}
+	blockSize := pool.maxSize
+	pool.mu.Unlock()
+
+	est := FeeEstimate{Size: size, Minimum: MinFee, NextBlock: MinFee, Median: MinFee, Pending: len(rates)}
+	if len(rates) == 0 {
+		return est
+	}
+	sort.Sort(sort.Reverse(sort.Float64Slice(rates)))
+	fee := func(rate float64) int {
+		if n := int(math.Ceil(rate * float64(size))); n > MinFee {
+			return n
+		}
+		return MinFee
+	}
+	est.Median = fee(rates[len(rates)/2])
+	// 交易池已经攒够一个区块时，要比能进入下一个区块的最后一笔交易付得多
+	if blockSize > 0 && len(rates) >= blockSize {
+		est.NextBlock = fee(rates[blockSize-1]) + 1
+	}
+	return est
+}
@@ -0,0 +1,77 @@
+package block
+
+import "testing"
+
+func TestCheckAmounts(t *testing.T) {
+	prev := map[string]TXOutput{
+		outpoint("a", 0): {10, "alice", "", 0},
+		outpoint("a", 1): {0, "alice", "sword", 2},
+	}
+	coin := TXInput{"a", 0, nil, nil}
+	item := TXInput{"a", 1, nil, nil}
+	issue := TXInput{"", IssueVout, nil, nil}
+	tests := []struct {
+		name string
+		vin  []TXInput
+		vout []TXOutput
+		fee  int
+		ok   bool
+	}{
+		{"no fee", []TXInput{coin}, []TXOutput{{6, "bob", "", 0}, {4, "alice", "", 0}}, 0, true},
+		{"fee is inputs minus outputs", []TXInput{coin}, []TXOutput{{7, "bob", "", 0}}, 3, true},
+		{"outputs exceed inputs", []TXInput{coin}, []TXOutput{{11, "bob", "", 0}}, 0, false},
+		{"item moved", []TXInput{item}, []TXOutput{{0, "bob", "sword", 2}}, 0, true},
+		{"item split", []TXInput{item}, []TXOutput{{0, "bob", "sword", 1}, {0, "alice", "sword", 1}}, 0, true},
+		{"item created", []TXInput{item}, []TXOutput{{0, "bob", "sword", 3}}, 0, false},
+		{"item burned", []TXInput{item}, []TXOutput{{0, "bob", "sword", 1}}, 0, false},
+		{"item and fee", []TXInput{coin, item}, []TXOutput{{8, "alice", "", 0}, {0, "bob", "sword", 2}}, 2, true},
+		{"issue creates items", []TXInput{issue}, []TXOutput{{0, "bob", "shield", 5}}, 0, true},
+	}
+	for _, tt := range tests {
+		tx := Transaction{"", tt.vin, tt.vout}
+		fee, err := checkAmounts(tx, prev)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: checkAmounts error = %v, want ok %v", tt.name, err, tt.ok)
+			continue
+		}
+		if fee != tt.fee {
+			t.Errorf("%s: checkAmounts fee = %d, want %d", tt.name, fee, tt.fee)
+		}
+	}
+}
+
+func TestSpendsCoins(t *testing.T) {
+	tests := []struct {
+		name string
+		prev map[string]TXOutput
+		want bool
+	}{
+		{"no inputs", nil, false},
+		{"coin input", map[string]TXOutput{"a:0": {5, "alice", "", 0}}, true},
+		{"item input", map[string]TXOutput{"a:0": {0, "alice", "sword", 1}}, false},
+		{"item and coin inputs", map[string]TXOutput{"a:0": {0, "alice", "sword", 1}, "a:1": {1, "alice", "", 0}}, true},
+	}
+	for _, tt := range tests {
+		if got := spendsCoins(tt.prev); got != tt.want {
+			t.Errorf("%s: spendsCoins = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFeeRate(t *testing.T) {
+	tests := []struct {
+		fee, size int
+		want      float64
+	}{
+		{0, 100, 0},
+		{50, 100, 0.5},
+		{300, 100, 3},
+		{10, 0, 0},
+		{10, -1, 0},
+	}
+	for _, tt := range tests {
+		if got := feeRate(tt.fee, tt.size); got != tt.want {
+			t.Errorf("feeRate(%d, %d) = %v, want %v", tt.fee, tt.size, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,267 @@
+package block
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"math/big"
+	"sync"
+	"time"
+)
+
+// ReorgEvent 记录一次链重组: 主链从 Ancestor 之后的 Disconnected 个区块换成了分叉上的 Connected 个区块
+type ReorgEvent struct {
+	Time         string `json:"time"`
+	Ancestor     int    `json:"ancestor"`
+	OldTip       string `json:"oldTip"`
+	NewTip       string `json:"newTip"`
+	Disconnected int    `json:"disconnected"`
+	Connected    int    `json:"connected"`
+}
+
+// maxReorgEvents 是内存中保留的最近链重组次数
+const maxReorgEvents = 100
+
+var (
+	reorgMu     sync.Mutex
+	reorgEvents []ReorgEvent
+)
+
+// Reorgs 返回最近发生的链重组，按时间先后排列
+func Reorgs() []ReorgEvent {
+	reorgMu.Lock()
+	defer reorgMu.Unlock()
+	results := make([]ReorgEvent, len(reorgEvents))
+	copy(results, reorgEvents)
+	return results
+}
+
+func recordReorg(e ReorgEvent) {
+	reorgMu.Lock()
+	defer reorgMu.Unlock()
+	reorgEvents = append(reorgEvents, e)
+	if len(reorgEvents) > maxReorgEvents {
+		reorgEvents = reorgEvents[len(reorgEvents)-maxReorgEvents:]
+	}
+}
+
+// blockWork 是挖出一个区块的期望哈希次数 2^Bits
+func blockWork(b Block) *big.Int {
+	return new(big.Int).Lsh(big.NewInt(1), uint(b.Bits))
+}
+
+// chainWork 是一串区块的累计工作量
+func chainWork(blocks []Block) *big.Int {
+	work := new(big.Int)
+	for _, b := range blocks {
+		work.Add(work, blockWork(b))
+	}
+	return work
+}
+
+// findBranch 从区块 b 沿 PrevHash 往回找到主链上的分叉点，
+// 返回分叉点和分叉点之后的分叉区块（按 index 升序，最后一个是 b）
+func findBranch(b Block) (Block, []Block, error) {
+	branch := []Block{b}
+	for cur := b; ; {
+		if parent, err := store.BlockByHash(cur.PrevHash); err == nil {
+			return parent, branch, nil
+		} else if err != ErrNotFound {
+			return Block{}, nil, err
+		}
+		parent, err := store.SideBlock(cur.PrevHash)
+		if err == ErrNotFound {
+			return Block{}, nil, ErrOrphanBlock
+		} else if err != nil {
+			return Block{}, nil, err
+		}
+		branch = append([]Block{parent}, branch...)
+		cur = parent
+	}
+}
+
+// receiveSideBlock 检查并保存一个不接在链尾的区块，分叉的累计工作量超过主链时切换到分叉。调用方需要持有 chainMu 的写锁。
+func receiveSideBlock(b Block, tip Block) error {
+	ancestor, branch, err := findBranch(b)
+	if err != nil {
+		return err
+	}
+	// 分叉上 b 之前的区块：主链到分叉点为止的最近区块，加上分叉上已有的区块
+	prev, err := recentBlocks(ancestor.Index + 1)
+	if err != nil {
+		return err
+	}
+	prev = append(prev, branch[:len(branch)-1]...)
+	if err := validateBlock(b, prev[len(prev)-1]); err != nil {
+		return err
+	}
+	if err := checkTimestamp(b, prev, time.Now()); err != nil {
+		return err
+	}
+	if err := verifyProofOfWork(b, prev); err != nil {
+		return err
+	}
+	if err := store.SaveSideBlock(b); err != nil {
+		return err
+	}
+	logrus.Info("ChainStore: Save side block ", b.Index, " forked from block ", ancestor.Index)
+
+	old, err := store.Blocks(ancestor.Index+1, tip.Index-ancestor.Index)
+	if err != nil {
+		return err
+	}
+	if chainWork(branch).Cmp(chainWork(old)) <= 0 {
+		return nil
+	}
+	return reorganize(ancestor, old, branch)
+}
+
+// reorganize 把主链上分叉点之后的区块 old 换成分叉区块 branch:
+// 从链尾开始撤销旧区块对 UTXO 集合的影响，再依次验证并写入分叉区块。
+// 分叉区块验证失败时恢复原来的主链，并删除无效的分叉区块。
+// 旧区块中没有进入新主链的交易放回交易池，它们的交易记录从存储中删除，放回交易池的交易的记录等到重新打包时再写入。
+func reorganize(ancestor Block, old, branch []Block) error {
+	for i := len(old) - 1; i >= 0; i-- {
+		if err := undoUTXOSet(old[i]); err != nil {
+			return err
+		}
+	}
+	if err := store.TruncateBlocks(ancestor.Index); err != nil {
+		return err
+	}
+	for _, b := range old {
+		if err := store.SaveSideBlock(b); err != nil {
+			return err
+		}
+	}
+
+	for i, b := range branch {
+		if err := appendBlock(b, nil); err != nil {
+			logrus.Error("ChainStore: Reorg to block ", b.Index, " failed, restore main chain: ", err)
+			for _, bad := range branch[i:] {
+				store.DeleteSideBlock(bad.Hash)
+			}
+			if rerr := restoreChain(ancestor, branch[:i], old); rerr != nil {
+				return fmt.Errorf("restore main chain: %v (reorg error: %v)", rerr, err)
+			}
+			return err
+		}
+		store.DeleteSideBlock(b.Hash)
+	}
+
+	// 旧分支上的交易
+	inBranch := make(map[string]bool)
+	for _, b := range branch {
+		for _, tx := range b.Transactions {
+			inBranch[tx.ID] = true
+		}
+	}
+	var restore []Transaction
+	var orphaned []string
+	for _, b := range old {
+		for _, tx := range b.Transactions {
+			if inBranch[tx.ID] {
+				continue
+			}
+			orphaned = append(orphaned, tx.ID)
+			if !tx.IsCoinbase() {
+				restore = append(restore, tx)
+			}
+		}
+	}
+	pool.revalidate(restore)
+	deleted, err := store.DeleteRecords(orphaned)
+	if err != nil {
+		logrus.Error("ChainStore: Delete orphaned records error: ", err)
+	}
+	for _, r := range deleted {
+		pool.attach(r.Txid, []Record{r})
+	}
+
+	oldTip := ancestor.Hash
+	if len(old) > 0 {
+		oldTip = old[len(old)-1].Hash
+	}
+	e := ReorgEvent{
+		Time:         formatTimestamp(time.Now().Unix()),
+		Ancestor:     ancestor.Index,
+		OldTip:       oldTip,
+		NewTip:       branch[len(branch)-1].Hash,
+		Disconnected: len(old),
+		Connected:    len(branch),
+	}
+	recordReorg(e)
+	logrus.Warn("ChainStore: Reorg at block ", e.Ancestor, ": disconnected ", e.Disconnected,
+		" blocks (tip ", e.OldTip, "), connected ", e.Connected, " blocks (tip ", e.NewTip, ")")
+	return nil
+}
+
+// restoreChain 撤销已经写入的分叉区块 connected，把原来的主链区块 old 写回去
+func restoreChain(ancestor Block, connected, old []Block) error {
+	for i := len(connected) - 1; i >= 0; i-- {
+		if err := undoUTXOSet(connected[i]); err != nil {
+			return err
+		}
+	}
+	if err := store.TruncateBlocks(ancestor.Index); err != nil {
+		return err
+	}
+	for _, b := range connected {
+		if err := store.SaveSideBlock(b); err != nil {
+			return err
+		}
+	}
+	for _, b := range old {
+		if err := store.AppendBlock(b, nil); err != nil {
+			return err
+		}
+		store.DeleteSideBlock(b.Hash)
+	}
+	return nil
+}
+
+// Locator 返回用于同步的主链区块哈希: 从链尾开始，前 10 个逐个往回，之后间隔加倍，最后是创世区块
+func Locator() ([]string, error) {
+	chainMu.RLock()
+	defer chainMu.RUnlock()
+
+	var locator []string
+	step := 1
+	_, height, err := findLastBlock()
+	if err != nil {
+		return nil, err
+	}
+	for i := height; i > 0; i -= step {
+		blocks, err := store.Blocks(i, 1)
+		if err != nil {
+			return nil, err
+		}
+		if len(blocks) == 0 {
+			break
+		}
+		locator = append(locator, blocks[0].Hash)
+		if len(locator) >= 10 {
+			step *= 2
+		}
+	}
+	genesis, err := genesisHash()
+	if err != nil {
+		return nil, err
+	}
+	return append(locator, genesis), nil
+}
+
+// ForkPoint 返回 locator 中第一个在主链上的区块的 index，都不在主链上时返回 -1
+func ForkPoint(locator []string) (int, error) {
+	chainMu.RLock()
+	defer chainMu.RUnlock()
+	for _, hash := range locator {
+		b, err := store.BlockByHash(hash)
+		if err == nil {
+			return b.Index, nil
+		}
+		if err != ErrNotFound {
+			return -1, err
+		}
+	}
+	return -1, nil
+}
@@ -0,0 +1,58 @@
+package block
+
+import (
+	"BlockChain/wallet"
+	"testing"
+)
+
+// withConsensus 修改共识参数，测试结束时恢复
+func withConsensus(t *testing.T, change func(*ConsensusParams)) {
+	saved := Consensus
+	change(&Consensus)
+	t.Cleanup(func() { Consensus = saved })
+}
+
+// signedTx 返回 w 签名的交易，花费 spends 中锁定给 w 的输出
+func signedTx(t *testing.T, w *wallet.Wallet, spends []UTXO, outs ...TXOutput) Transaction {
+	tx := Transaction{Vout: outs}
+	prev := make(map[string]TXOutput)
+	for _, u := range spends {
+		tx.Vin = append(tx.Vin, TXInput{u.Txid, u.Vout, nil, w.PublicKey})
+		prev[u.Key()] = u.Output()
+	}
+	if err := tx.Sign(w.PrivateKey, prev); err != nil {
+		t.Fatal(err)
+	}
+	tx.SetID()
+	return tx
+}
+
+// newWallet 返回一个新的钱包，不保存到钱包文件
+func newWallet(t *testing.T) *wallet.Wallet {
+	w, err := wallet.NewWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
+// withStore 使用空的内存存储，测试结束时恢复原来的存储
+func withStore(t *testing.T) {
+	saved := store
+	store = NewMemoryStore()
+	t.Cleanup(func() { store = saved })
+}
+
+// withMinFee 修改最低手续费，测试结束时恢复
+func withMinFee(t *testing.T, fee int) {
+	saved := MinFee
+	MinFee = fee
+	t.Cleanup(func() { MinFee = saved })
+}
+
+// fund 把 utxos 加入 UTXO 集合
+func fund(t *testing.T, utxos ...UTXO) {
+	if err := store.UpdateUTXO(nil, utxos); err != nil {
+		t.Fatal(err)
+	}
+}
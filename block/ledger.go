@@ -0,0 +1,31 @@
+package block
+
+import "sync"
+
+// 账本的并发模型:
+// 所有修改链的操作（挖矿、交易池出块、接收其他节点的区块、重建 UTXO 集合）都交给唯一的 writer 协程串行执行，
+// 挖矿的哈希计算不持有任何锁；只有真正写入区块和链重组时才持有 chainMu 的写锁。
+// 需要一致视图的查询（余额、可花费输出、区块列表等）持有 chainMu 的读锁，不会看到链重组的中间状态，
+// 也不会因为有人在挖矿而被阻塞。
+var (
+	chainMu sync.RWMutex
+	writes  = make(chan func())
+)
+
+func init() {
+	go func() {
+		for f := range writes {
+			f()
+		}
+	}()
+}
+
+// write 把 f 交给 writer 协程执行，并等待它完成
+func write(f func()) {
+	done := make(chan struct{})
+	writes <- func() {
+		defer close(done)
+		f()
+	}
+	<-done
+}
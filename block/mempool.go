@@ -0,0 +1,360 @@
+package block
+
+import (
+	"errors"
+	"github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+var (
+	ErrInvalidTransaction   = errors.New("block: invalid transaction")
+	ErrDuplicateTransaction = errors.New("block: transaction already in mempool")
+	ErrDoubleSpend          = errors.New("block: transaction spends an unavailable output")
+	ErrInvalidSignature     = errors.New("block: invalid transaction signature")
+)
+
+// Mempool 保存已经验证过、等待打包进区块的交易，txs 按提交顺序排列
+type Mempool struct {
+	mu      sync.Mutex
+	txs     []Transaction
+	ids     map[string]bool
+	spent   map[string]bool     // 交易池中的交易花掉的输出，键为 txid:vout
+	fees    map[string]txFee    // 交易的手续费和大小，键为交易 ID
+	records map[string][]Record // 交易的转账记录，交易被区块打包时和区块一起写入
+	maxSize int
+	full    chan struct{}
+}
+
+func NewMempool() *Mempool {
+	return &Mempool{
+		ids:     make(map[string]bool),
+		spent:   make(map[string]bool),
+		fees:    make(map[string]txFee),
+		records: make(map[string][]Record),
+		full:    make(chan struct{}, 1),
+	}
+}
+
+type txFee struct {
+	fee  int
+	size int
+}
+
+// pool 是节点唯一的交易池
+var pool = NewMempool()
+
+// Add 验证交易并放进交易池，交易池达到 maxSize 时通知出块协程。
+// 交易的每个输入都必须引用 UTXO 集合或交易池中还没有被花掉的输出，
+// 并带有被引用输出所有者的有效签名；发行输入必须由发行人签名。
+// 花费币的交易的手续费不能低于 MinFee。
+func (m *Mempool) Add(tx Transaction) error {
+	if err := checkTransaction(tx); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.ids[tx.ID] || inChain(tx.ID) {
+		return ErrDuplicateTransaction
+	}
+	prevOutputs := make(map[string]TXOutput)
+	for _, vin := range tx.Vin {
+		key := outpoint(vin.Txid, vin.Vout)
+		if vin.IsIssue() {
+			prevOutputs[key] = issuerOutput()
+			continue
+		}
+		if m.spent[key] {
+			return ErrDoubleSpend
+		}
+		out, ok := m.output(key)
+		if !ok {
+			return ErrDoubleSpend
+		}
+		prevOutputs[key] = out
+	}
+	if !tx.Verify(prevOutputs) {
+		return ErrInvalidSignature
+	}
+	fee, err := checkAmounts(tx, prevOutputs)
+	if err != nil {
+		return ErrInvalidTransaction
+	}
+	if fee < MinFee && spendsCoins(prevOutputs) {
+		return ErrFeeTooLow
+	}
+
+	for _, vin := range tx.Vin {
+		if !vin.IsIssue() {
+			m.spent[outpoint(vin.Txid, vin.Vout)] = true
+		}
+	}
+	m.txs = append(m.txs, tx)
+	m.ids[tx.ID] = true
+	m.fees[tx.ID] = txFee{fee, tx.Size()}
+	if m.maxSize > 0 && len(m.txs) >= m.maxSize {
+		select {
+		case m.full <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// Batch 返回最多 n 笔交易的副本，n <= 0 时返回全部。手续费率高的交易先被选中，
+// 花费交易池中另一笔交易输出的交易排在那笔交易之后，手续费率相同时先提交的先选中。
+// 交易仍然留在交易池中，直到区块写入后由 revalidate 去掉，
+// 这样挖矿期间新提交的交易不能花掉正在打包的交易已经花掉的输出。
+func (m *Mempool) Batch(n int) []Transaction {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if n <= 0 || n > len(m.txs) {
+		n = len(m.txs)
+	}
+	// 每次选出父交易都已经选中的交易中手续费率最高的一笔
+	selected := make(map[string]bool, n)
+	batch := make([]Transaction, 0, n)
+	for len(batch) < n {
+		best := -1
+		for i, tx := range m.txs {
+			if selected[tx.ID] || !m.parentsSelected(tx, selected) {
+				continue
+			}
+			if best < 0 || m.rate(tx) > m.rate(m.txs[best]) {
+				best = i
+			}
+		}
+		if best < 0 {
+			break
+		}
+		selected[m.txs[best].ID] = true
+		batch = append(batch, m.txs[best])
+	}
+	return batch
+}
+
+func (m *Mempool) rate(tx Transaction) float64 {
+	f := m.fees[tx.ID]
+	return feeRate(f.fee, f.size)
+}
+
+// parentsSelected 判断 tx 花费的交易池中的交易是否都已经被选中
+func (m *Mempool) parentsSelected(tx Transaction, selected map[string]bool) bool {
+	for _, vin := range tx.Vin {
+		if m.ids[vin.Txid] && !selected[vin.Txid] {
+			return false
+		}
+	}
+	return true
+}
+
+// revalidate 在链上加入别的节点的区块后重新检查交易池:
+// 已经被区块打包的交易，以及输入已经被花掉的交易会被丢弃，它们的转账记录也一起丢弃。
+// restore 是链重组时从旧分支撤下的交易，它们排在交易池原有的交易前面重新加入。
+// 调用方需要持有 chainMu 的写锁。
+func (m *Mempool) revalidate(restore []Transaction) {
+	m.mu.Lock()
+	txs := append(restore, m.txs...)
+	records := m.records
+	m.txs = nil
+	m.ids = make(map[string]bool)
+	m.spent = make(map[string]bool)
+	m.fees = make(map[string]txFee)
+	m.records = make(map[string][]Record)
+	m.mu.Unlock()
+
+	for _, tx := range txs {
+		if err := m.Add(tx); err != nil {
+			logrus.Info("Mempool: drop transaction ", tx.ID, ": ", err)
+			continue
+		}
+		m.attach(tx.ID, records[tx.ID])
+	}
+}
+
+// drop 从交易池中去掉 txs，花费它们的输出的交易也一起去掉。调用方需要持有 chainMu 的写锁。
+func (m *Mempool) drop(txs []Transaction) {
+	bad := make(map[string]bool, len(txs))
+	for _, tx := range txs {
+		bad[tx.ID] = true
+	}
+	m.mu.Lock()
+	var kept []Transaction
+	for _, tx := range m.txs {
+		if bad[tx.ID] {
+			logrus.Info("Mempool: drop transaction ", tx.ID, ": block rejected")
+			continue
+		}
+		kept = append(kept, tx)
+	}
+	m.txs = kept
+	m.mu.Unlock()
+	m.revalidate(nil)
+}
+
+// attach 把转账记录挂到交易池中的交易 txid 上，交易不在交易池中时丢弃
+func (m *Mempool) attach(txid string, records []Record) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.ids[txid] || len(records) == 0 {
+		return
+	}
+	for _, r := range records {
+		r.Txid = txid
+		m.records[txid] = append(m.records[txid], r)
+	}
+}
+
+// blockRecords 返回区块 b 中交易池里的交易的转账记录，时间戳为区块的时间戳
+func (m *Mempool) blockRecords(b Block) []Record {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var results []Record
+	for _, tx := range b.Transactions {
+		for _, r := range m.records[tx.ID] {
+			r.Timestamp = b.Timestamp
+			results = append(results, r)
+		}
+	}
+	return results
+}
+
+// output 在 UTXO 集合和交易池中查找 key 对应的输出
+func (m *Mempool) output(key string) (TXOutput, bool) {
+	if u, err := store.FindUTXO(key); err == nil {
+		return u.Output(), true
+	}
+	for _, tx := range m.txs {
+		for id, out := range tx.Vout {
+			if outpoint(tx.ID, id) == key {
+				return out, true
+			}
+		}
+	}
+	return TXOutput{}, false
+}
+
+func (m *Mempool) has(txid string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.ids[txid]
+}
+
+// find 返回交易池中 ID 为 txid 的交易
+func (m *Mempool) find(txid string) (Transaction, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, tx := range m.txs {
+		if tx.ID == txid {
+			return tx, true
+		}
+	}
+	return Transaction{}, false
+}
+
+func (m *Mempool) isSpent(key string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.spent[key]
+}
+
+// pendingOutputs 返回交易池中锁定给 address 的全部输出，包括已经被交易池中的交易花掉的
+func (m *Mempool) pendingOutputs(address string) []UTXO {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var results []UTXO
+	for _, tx := range m.txs {
+		for id, out := range tx.Vout {
+			if out.ScriptPubKey == address {
+				results = append(results, newUTXO(tx.ID, id, out))
+			}
+		}
+	}
+	return results
+}
+
+func (m *Mempool) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.txs)
+}
+
+// Pending 返回交易池中全部交易的副本
+func (m *Mempool) Pending() []Transaction {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	pending := make([]Transaction, len(m.txs))
+	copy(pending, m.txs)
+	return pending
+}
+
+// checkTransaction 检查交易结构和交易 ID 是否一致，coinbase 交易不能通过交易池提交
+func checkTransaction(tx Transaction) error {
+	if len(tx.Vin) == 0 || len(tx.Vout) == 0 || tx.IsCoinbase() {
+		return ErrInvalidTransaction
+	}
+	if err := checkOutputs(tx); err != nil {
+		return ErrInvalidTransaction
+	}
+	if tx.Hash() != tx.ID {
+		return ErrInvalidTransaction
+	}
+	return nil
+}
+
+// SubmitTransaction 把交易放进交易池，等待出块协程打包。
+// records 是交易的转账记录，只有交易被区块打包时才和区块一起写入，交易被丢弃时记录也被丢弃
+func SubmitTransaction(tx Transaction, records ...Record) error {
+	chainMu.RLock()
+	defer chainMu.RUnlock()
+
+	err := pool.Add(tx)
+	if err != nil {
+		logrus.Info("Mempool: reject transaction ", tx.ID, ": ", err)
+		return err
+	}
+	pool.attach(tx.ID, records)
+	notifyTransaction(tx)
+	return nil
+}
+
+// PendingTransactions 返回还没有被打包的交易
+func PendingTransactions() []Transaction {
+	return pool.Pending()
+}
+
+// StartProducer 启动出块协程: 每隔 interval，或交易池中的交易达到 maxSize 笔时，
+// 把交易池中的交易打包成一个区块
+func StartProducer(interval time.Duration, maxSize int) {
+	pool.mu.Lock()
+	pool.maxSize = maxSize
+	pool.mu.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-pool.full:
+			}
+			produceBlock(maxSize)
+		}
+	}()
+}
+
+func produceBlock(maxSize int) {
+	write(func() {
+		txs := pool.Batch(maxSize)
+		if len(txs) == 0 {
+			return
+		}
+		b, err := produce("", txs)
+		if err != nil {
+			logrus.Error("Mempool: pack block error: ", err)
+			return
+		}
+		logrus.Info("Mempool: packed ", len(txs), " transactions into block ", b.Index)
+	})
+}
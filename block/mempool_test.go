@@ -0,0 +1,169 @@
+package block
+
+import "testing"
+
+func TestMempoolMinFee(t *testing.T) {
+	withStore(t)
+	withMinFee(t, 2)
+	alice := newWallet(t)
+	coins := UTXO{"fund", 0, 10, alice.GetAddress(), "", 0}
+	sword := UTXO{"fund", 1, 0, alice.GetAddress(), "sword", 1}
+	fund(t, coins, sword)
+
+	tests := []struct {
+		name   string
+		spends []UTXO
+		vout   []TXOutput
+		want   error
+	}{
+		{"fee above minimum", []UTXO{coins}, []TXOutput{{7, "bob", "", 0}}, nil},
+		{"fee at minimum", []UTXO{coins}, []TXOutput{{8, "bob", "", 0}}, nil},
+		{"fee below minimum", []UTXO{coins}, []TXOutput{{9, "bob", "", 0}}, ErrFeeTooLow},
+		{"no fee", []UTXO{coins}, []TXOutput{{10, "bob", "", 0}}, ErrFeeTooLow},
+		{"outputs exceed inputs", []UTXO{coins}, []TXOutput{{11, "bob", "", 0}}, ErrInvalidTransaction},
+		{"item transfer needs no fee", []UTXO{sword}, []TXOutput{{0, "bob", "sword", 1}}, nil},
+		{"item transfer with coins", []UTXO{coins, sword}, []TXOutput{{9, "bob", "", 0}, {0, "bob", "sword", 1}}, ErrFeeTooLow},
+	}
+	for _, tt := range tests {
+		tx := signedTx(t, alice, tt.spends, tt.vout...)
+		if err := NewMempool().Add(tx); err != tt.want {
+			t.Errorf("%s: Add = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestMempoolBatch(t *testing.T) {
+	withStore(t)
+	withMinFee(t, 0)
+	alice := newWallet(t)
+	var funds []UTXO
+	for i := 0; i < 4; i++ {
+		funds = append(funds, UTXO{"fund", i, 100, alice.GetAddress(), "", 0})
+	}
+	fund(t, funds...)
+
+	// 签名长度固定，这些交易的大小相近，手续费率的顺序和手续费相同
+	low := signedTx(t, alice, funds[:1], TXOutput{99, alice.GetAddress(), "", 0})
+	high := signedTx(t, alice, funds[1:2], TXOutput{90, "bob", "", 0})
+	// child 花费 low 的输出，手续费率最高，但要排在 low 之后
+	child := signedTx(t, alice, []UTXO{{low.ID, 0, 99, alice.GetAddress(), "", 0}}, TXOutput{80, "bob", "", 0})
+	free1 := signedTx(t, alice, funds[2:3], TXOutput{100, "bob", "", 0})
+	free2 := signedTx(t, alice, funds[3:4], TXOutput{100, "bob", "", 0})
+	names := map[string]string{low.ID: "low", high.ID: "high", child.ID: "child", free1.ID: "free1", free2.ID: "free2"}
+
+	tests := []struct {
+		name   string
+		submit []Transaction
+		n      int
+		want   []string
+	}{
+		{"higher fee rate first", []Transaction{low, high}, 0, []string{"high", "low"}},
+		{"parent before child", []Transaction{low, child}, 0, []string{"low", "child"}},
+		{"child after parent and others", []Transaction{low, high, child}, 0, []string{"high", "low", "child"}},
+		{"child follows parent at once", []Transaction{free1, low, child}, 0, []string{"low", "child", "free1"}},
+		{"ties in submission order", []Transaction{free1, free2}, 0, []string{"free1", "free2"}},
+		{"ties in submission order reversed", []Transaction{free2, free1}, 0, []string{"free2", "free1"}},
+		{"limit", []Transaction{low, high, child}, 1, []string{"high"}},
+		{"limit takes highest rate", []Transaction{low, child, free1}, 1, []string{"low"}},
+		{"limit above size", []Transaction{free1}, 5, []string{"free1"}},
+		{"empty", nil, 0, []string{}},
+	}
+	for _, tt := range tests {
+		m := NewMempool()
+		for _, tx := range tt.submit {
+			if err := m.Add(tx); err != nil {
+				t.Fatalf("%s: Add %s: %v", tt.name, names[tx.ID], err)
+			}
+		}
+		got := []string{}
+		for _, tx := range m.Batch(tt.n) {
+			got = append(got, names[tx.ID])
+		}
+		if !sameOrder(got, tt.want) {
+			t.Errorf("%s: Batch(%d) = %v, want %v", tt.name, tt.n, got, tt.want)
+		}
+	}
+}
+
+func sameOrder(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestMempoolDuplicateInput(t *testing.T) {
+	withStore(t)
+	withMinFee(t, 1)
+	alice := newWallet(t)
+	a := UTXO{"fund", 0, 10, alice.GetAddress(), "", 0}
+	b := UTXO{"fund", 1, 10, alice.GetAddress(), "", 0}
+	fund(t, a, b)
+
+	tests := []struct {
+		name   string
+		spends []UTXO
+		vout   []TXOutput
+		want   error
+	}{
+		{"two inputs", []UTXO{a, b}, []TXOutput{{19, "bob", "", 0}}, nil},
+		// 第二个输入被算两次的话手续费是 10，交易会被优先打包
+		{"same input twice", []UTXO{a, a}, []TXOutput{{9, "bob", "", 0}}, ErrInvalidTransaction},
+		{"same input twice among others", []UTXO{a, b, a}, []TXOutput{{19, "bob", "", 0}}, ErrInvalidTransaction},
+	}
+	for _, tt := range tests {
+		m := NewMempool()
+		tx := signedTx(t, alice, tt.spends, tt.vout...)
+		if err := m.Add(tx); err != tt.want {
+			t.Errorf("%s: Add = %v, want %v", tt.name, err, tt.want)
+		}
+		if tt.want != nil && m.Len() != 0 {
+			t.Errorf("%s: rejected transaction is in the mempool", tt.name)
+		}
+	}
+}
+
+func TestMempoolDrop(t *testing.T) {
+	withStore(t)
+	withMinFee(t, 0)
+	alice := newWallet(t)
+	a := UTXO{"fund", 0, 10, alice.GetAddress(), "", 0}
+	b := UTXO{"fund", 1, 10, alice.GetAddress(), "", 0}
+	fund(t, a, b)
+	parent := signedTx(t, alice, []UTXO{a}, TXOutput{10, alice.GetAddress(), "", 0})
+	child := signedTx(t, alice, []UTXO{{parent.ID, 0, 10, alice.GetAddress(), "", 0}}, TXOutput{10, "bob", "", 0})
+	other := signedTx(t, alice, []UTXO{b}, TXOutput{10, "bob", "", 0})
+	names := map[string]string{parent.ID: "parent", child.ID: "child", other.ID: "other"}
+
+	tests := []struct {
+		name string
+		drop []Transaction
+		want []string
+	}{
+		{"nothing", nil, []string{"parent", "child", "other"}},
+		{"child", []Transaction{child}, []string{"parent", "other"}},
+		{"parent takes child", []Transaction{parent}, []string{"other"}},
+		{"all", []Transaction{parent, child, other}, []string{}},
+	}
+	for _, tt := range tests {
+		m := NewMempool()
+		for _, tx := range []Transaction{parent, child, other} {
+			if err := m.Add(tx); err != nil {
+				t.Fatalf("%s: Add %s: %v", tt.name, names[tx.ID], err)
+			}
+		}
+		m.drop(tt.drop)
+		got := []string{}
+		for _, tx := range m.Pending() {
+			got = append(got, names[tx.ID])
+		}
+		if !sameOrder(got, tt.want) {
+			t.Errorf("%s: pending = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package block
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// MerkleStep 是 Merkle 认证路径上的一步: 兄弟节点的哈希，以及它在左边还是右边
+type MerkleStep struct {
+	Hash string `json:"hash"`
+	Left bool   `json:"left"`
+}
+
+// MerkleProof 证明交易 Txid 包含在区块 BlockIndex 中
+type MerkleProof struct {
+	Txid       string       `json:"txid"`
+	BlockIndex int          `json:"blockIndex"`
+	BlockHash  string       `json:"blockHash"`
+	MerkleRoot string       `json:"merkleRoot"`
+	Path       []MerkleStep `json:"path"`
+}
+
+// hashPair 计算两个子节点的父节点: SHA256(left || right)
+func hashPair(left, right string) string {
+	l, _ := hex.DecodeString(left)
+	r, _ := hex.DecodeString(right)
+	h := sha256.Sum256(append(l, r...))
+	return hex.EncodeToString(h[:])
+}
+
+// merkleLevels 从交易 ID 开始逐层计算 Merkle 树，最后一层只有根。
+// 某一层节点数为奇数时复制最后一个节点。
+func merkleLevels(ids []string) [][]string {
+	if len(ids) == 0 {
+		return nil
+	}
+	level := make([]string, len(ids))
+	copy(level, ids)
+	levels := [][]string{level}
+	for len(level) > 1 {
+		if len(level)%2 == 1 {
+			level = append(level, level[len(level)-1])
+			levels[len(levels)-1] = level
+		}
+		var next []string
+		for i := 0; i < len(level); i += 2 {
+			next = append(next, hashPair(level[i], level[i+1]))
+		}
+		level = next
+		levels = append(levels, level)
+	}
+	return levels
+}
+
+// merkleRoot 返回交易列表的 Merkle 根，没有交易时为空字符串
+func merkleRoot(txs []Transaction) string {
+	ids := make([]string, len(txs))
+	for i, tx := range txs {
+		ids[i] = tx.ID
+	}
+	levels := merkleLevels(ids)
+	if levels == nil {
+		return ""
+	}
+	return levels[len(levels)-1][0]
+}
+
+// merklePath 返回第 index 个叶子到根的认证路径
+func merklePath(ids []string, index int) []MerkleStep {
+	var path []MerkleStep
+	levels := merkleLevels(ids)
+	for _, level := range levels[:len(levels)-1] {
+		if index%2 == 0 {
+			path = append(path, MerkleStep{level[index+1], false})
+		} else {
+			path = append(path, MerkleStep{level[index-1], true})
+		}
+		index /= 2
+	}
+	return path
+}
+
+// FindMerkleProof 找到包含 txid 的区块，并生成交易的 Merkle 认证路径
+func FindMerkleProof(txid string) (MerkleProof, error) {
+	chainMu.RLock()
+	b, err := store.BlockByTxid(txid)
+	chainMu.RUnlock()
+	if err != nil {
+		return MerkleProof{}, err
+	}
+	ids := make([]string, len(b.Transactions))
+	index := -1
+	for i, tx := range b.Transactions {
+		ids[i] = tx.ID
+		if tx.ID == txid {
+			index = i
+		}
+	}
+	if index < 0 {
+		return MerkleProof{}, ErrNotFound
+	}
+	return MerkleProof{
+		Txid:       txid,
+		BlockIndex: b.Index,
+		BlockHash:  b.Hash,
+		MerkleRoot: b.MerkleRoot,
+		Path:       merklePath(ids, index),
+	}, nil
+}
+
+// VerifyMerkleProof 沿认证路径重新计算根，检查它是否等于证明中的 MerkleRoot
+func VerifyMerkleProof(p MerkleProof) bool {
+	hash := p.Txid
+	for _, step := range p.Path {
+		if step.Left {
+			hash = hashPair(step.Hash, hash)
+		} else {
+			hash = hashPair(hash, step.Hash)
+		}
+	}
+	return hash == p.MerkleRoot
+}
@@ -0,0 +1,79 @@
+package block
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"testing"
+)
+
+// txids 返回 n 个不同的十六进制交易 ID
+func txids(n int) []string {
+	ids := make([]string, n)
+	for i := range ids {
+		h := sha256.Sum256([]byte(fmt.Sprint("tx", i)))
+		ids[i] = hex.EncodeToString(h[:])
+	}
+	return ids
+}
+
+func TestMerkleRoot(t *testing.T) {
+	ids := txids(3)
+	ab := hashPair(ids[0], ids[1])
+	tests := []struct {
+		name string
+		ids  []string
+		want string
+	}{
+		{"empty", nil, ""},
+		{"one transaction", ids[:1], ids[0]},
+		{"two transactions", ids[:2], ab},
+		// 奇数个节点时复制最后一个
+		{"three transactions", ids, hashPair(ab, hashPair(ids[2], ids[2]))},
+	}
+	for _, tt := range tests {
+		txs := make([]Transaction, len(tt.ids))
+		for i, id := range tt.ids {
+			txs[i].ID = id
+		}
+		if got := merkleRoot(txs); got != tt.want {
+			t.Errorf("%s: merkleRoot = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMerkleProof(t *testing.T) {
+	for _, n := range []int{1, 2, 3, 4, 5, 7, 8, 13} {
+		ids := txids(n)
+		txs := make([]Transaction, n)
+		for i, id := range ids {
+			txs[i].ID = id
+		}
+		root := merkleRoot(txs)
+		for i, id := range ids {
+			p := MerkleProof{Txid: id, MerkleRoot: root, Path: merklePath(ids, i)}
+			if !VerifyMerkleProof(p) {
+				t.Errorf("%d transactions: proof of leaf %d does not verify", n, i)
+			}
+			if n == 1 {
+				continue
+			}
+			// 换一笔交易、改动路径上的哈希或方向都不能通过验证
+			bad := p
+			bad.Txid = ids[(i+1)%n]
+			if ids[(i+1)%n] != id && VerifyMerkleProof(bad) {
+				t.Errorf("%d transactions: proof of leaf %d verifies another txid", n, i)
+			}
+			bad = MerkleProof{Txid: id, MerkleRoot: root, Path: append([]MerkleStep(nil), p.Path...)}
+			bad.Path[0].Hash = txids(n + 1)[n]
+			if VerifyMerkleProof(bad) {
+				t.Errorf("%d transactions: proof of leaf %d verifies with a wrong sibling", n, i)
+			}
+			bad.Path = append([]MerkleStep(nil), p.Path...)
+			bad.Path[0].Left = !bad.Path[0].Left
+			if bad.Path[0].Hash != id && VerifyMerkleProof(bad) {
+				t.Errorf("%d transactions: proof of leaf %d verifies with a flipped side", n, i)
+			}
+		}
+	}
+}
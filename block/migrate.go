@@ -0,0 +1,118 @@
+package block
+
+import (
+	"context"
+	"errors"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"strings"
+	"time"
+)
+
+// legacyTimeLayouts 是旧版本保存的字符串时间戳的格式: time.Time.String() 和 RFC 3339
+var legacyTimeLayouts = []string{"2006-01-02 15:04:05.999999999 -0700 MST", time.RFC3339Nano}
+
+// parseLegacyTime 把旧版本的字符串时间戳转换成 Unix 秒，time.Time.String() 末尾的单调时钟读数被忽略
+func parseLegacyTime(s string) (int64, bool) {
+	if i := strings.Index(s, " m="); i >= 0 {
+		s = s[:i]
+	}
+	for _, layout := range legacyTimeLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.Unix(), true
+		}
+	}
+	return 0, false
+}
+
+// ResetLegacyChain 允许启动时把旧版本的区块移到 LegacyBlock 并从创世区块重新开始，由 main 按配置设置。
+// 旧链上的币锁定到用户 ID，不能用钱包花费，也不能只转换时间戳后接着使用
+var ResetLegacyChain = false
+
+// ErrLegacyChain 表示 MongoDB 中有旧版本的区块，没有设置 ResetLegacyChain 时节点不能启动
+var ErrLegacyChain = errors.New("block: the chain has blocks in the legacy format, start with --reset-legacy-chain to move them to LegacyBlock and restart from the genesis block")
+
+// legacyBlockFilter 匹配旧版本的区块: 时间戳是字符串，或者交易保存在 transaction 字段中
+var legacyBlockFilter = bson.D{{"$or", bson.A{
+	bson.D{{"timestamp", bson.D{{"$type", "string"}}}},
+	bson.D{{"transaction", bson.D{{"$exists", true}}}},
+}}}
+
+// migrate 把 MongoDB 中旧版本的数据转换成当前的格式，只在第一次启动新版本时有数据需要转换:
+// 交易记录的字符串时间戳转换成 Unix 秒；旧版本的区块哈希算法和创世区块都不同，不能接到当前的链上，
+// 设置了 ResetLegacyChain 时主链和分叉区块移到 BlockChain.LegacyBlock 保存，UTXO 集合清空，
+// 之后从创世区块重新开始，否则返回 ErrLegacyChain，不修改区块
+func (s *mongoStore) migrate() error {
+	ctx := context.Background()
+	cursor, err := s.records.Find(ctx, bson.D{{"timestamp", bson.D{{"$type", "string"}}}})
+	if err != nil {
+		return err
+	}
+	var docs []bson.M
+	if err := cursor.All(ctx, &docs); err != nil {
+		return err
+	}
+	for _, doc := range docs {
+		raw, _ := doc["timestamp"].(string)
+		ts, ok := parseLegacyTime(raw)
+		if !ok {
+			logrus.Warn("MgoDB: Unknown timestamp ", raw, " in Transaction ", doc["_id"], ", set to 0")
+		}
+		_, err := s.records.UpdateOne(ctx, bson.D{{"_id", doc["_id"]}}, bson.D{{"$set", bson.D{{"timestamp", ts}}}})
+		if err != nil {
+			return err
+		}
+	}
+	if len(docs) > 0 {
+		logrus.Info("MgoDB: Migrate ", len(docs), " Transaction timestamps to Unix seconds")
+	}
+
+	if !ResetLegacyChain {
+		for _, c := range []*mongo.Collection{s.blocks, s.side} {
+			n, err := c.CountDocuments(ctx, legacyBlockFilter)
+			if err != nil {
+				return err
+			}
+			if n > 0 {
+				return ErrLegacyChain
+			}
+		}
+		return nil
+	}
+
+	archived := 0
+	legacy := s.client.Database(s.blocks.Database().Name()).Collection("LegacyBlock")
+	for _, c := range []*mongo.Collection{s.blocks, s.side} {
+		cursor, err := c.Find(ctx, legacyBlockFilter)
+		if err != nil {
+			return err
+		}
+		var blocks []interface{}
+		if err := cursor.All(ctx, &blocks); err != nil {
+			return err
+		}
+		if len(blocks) == 0 {
+			continue
+		}
+		// 重复执行时已经移过去的区块 _id 相同，忽略重复键错误
+		if _, err := legacy.InsertMany(ctx, blocks, options.InsertMany().SetOrdered(false)); err != nil && !mongo.IsDuplicateKeyError(err) {
+			return err
+		}
+		// 先清空 UTXO 集合再删除区块，中途失败时下次启动会重新执行
+		if c == s.blocks {
+			if err := s.ResetUTXO(); err != nil {
+				return err
+			}
+		}
+		if _, err := c.DeleteMany(ctx, legacyBlockFilter); err != nil {
+			return err
+		}
+		archived += len(blocks)
+	}
+	if archived > 0 {
+		logrus.Warn("MgoDB: Move ", archived, " legacy blocks to LegacyBlock, the chain restarts from the genesis block")
+	}
+	return nil
+}
@@ -0,0 +1,24 @@
+package block
+
+import "testing"
+
+func TestParseLegacyTime(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int64
+		ok   bool
+	}{
+		{"2023-05-01 12:00:00.123456789 +0800 CST m=+0.012345678", 1682913600, true},
+		{"2023-05-01 04:00:00 +0000 UTC", 1682913600, true},
+		{"2023-05-01T04:00:00Z", 1682913600, true},
+		{"2023-05-01T12:00:00.5+08:00", 1682913600, true},
+		{"yesterday", 0, false},
+		{"", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseLegacyTime(tt.in)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("parseLegacyTime(%q) = %d, %v, want %d, %v", tt.in, got, ok, tt.want, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package block
+
+import (
+	"fmt"
+	"math/bits"
+	"time"
+)
+
+// ConsensusParams 是所有节点必须一致的共识参数
+type ConsensusParams struct {
+	// InitialBits 是创世区块和前 RetargetWindow 个区块的难度，难度是区块哈希前导 0 的位数
+	InitialBits int
+	MinBits     int
+	MaxBits     int
+	// TargetSpacing 是期望的出块间隔
+	TargetSpacing time.Duration
+	// RetargetWindow 是调整难度时参考的最近区块数
+	RetargetWindow int
+	// MedianTimeSpan 是计算中位时间的最近区块数，新区块的时间戳必须晚于中位时间
+	MedianTimeSpan int
+	// MaxFutureDrift 是区块时间戳最多可以超前本机时间多久
+	MaxFutureDrift time.Duration
+	// GenesisTime 是创世区块的时间戳，所有节点的创世区块必须相同
+	GenesisTime int64
+	// Issuer 是可以发行物品的钱包地址，为空时不能发行物品
+	Issuer string
+	// Subsidy 是挖矿奖励，每 HalvingInterval 个区块减半，HalvingInterval 为 0 时不减半
+	Subsidy         int
+	HalvingInterval int
+}
+
+// Consensus 是当前使用的共识参数，需要在 Init 之前设置
+var Consensus = ConsensusParams{
+	InitialBits:     12,
+	MinBits:         1,
+	MaxBits:         32,
+	TargetSpacing:   10 * time.Second,
+	RetargetWindow:  10,
+	MedianTimeSpan:  11,
+	MaxFutureDrift:  2 * time.Hour,
+	GenesisTime:     1672531200, // 2023-01-01T00:00:00Z
+	Subsidy:         10,
+	HalvingInterval: 100000,
+}
+
+// nextBits 根据新区块之前的区块计算它应该使用的难度。
+// prev 按 index 升序排列，至少包含最近 RetargetWindow 个区块。
+// 最近 RetargetWindow 个区块的实际用时不到期望的一半时难度加 1，超过两倍时减 1。
+func nextBits(prev []Block) int {
+	n := Consensus.RetargetWindow
+	if len(prev) == 0 || prev[len(prev)-1].Index+1 <= n || len(prev) < n || n < 2 {
+		return Consensus.InitialBits
+	}
+	window := prev[len(prev)-n:]
+	last := window[len(window)-1]
+	actual := blockTime(last).Sub(blockTime(window[0]))
+	expected := time.Duration(n-1) * Consensus.TargetSpacing
+
+	next := last.Bits
+	if actual < expected/2 {
+		next++
+	} else if actual > expected*2 {
+		next--
+	}
+	if next < Consensus.MinBits {
+		next = Consensus.MinBits
+	}
+	if next > Consensus.MaxBits {
+		next = Consensus.MaxBits
+	}
+	return next
+}
+
+// recentBlocks 返回 index 为 height 的区块之前的最近区块，
+// 数量是 RetargetWindow 和 MedianTimeSpan 中较大的一个
+func recentBlocks(height int) ([]Block, error) {
+	n := Consensus.RetargetWindow
+	if Consensus.MedianTimeSpan > n {
+		n = Consensus.MedianTimeSpan
+	}
+	from := height - n
+	if from < 0 {
+		from = 0
+	}
+	return store.Blocks(from, height-from)
+}
+
+func blockTime(b Block) time.Time {
+	return time.Unix(b.Timestamp, 0)
+}
+
+// hashMeetsBits 检查十六进制哈希是否至少有 n 位前导 0
+func hashMeetsBits(hash string, n int) bool {
+	zeros := 0
+	for _, c := range hash {
+		var v uint64
+		switch {
+		case c >= '0' && c <= '9':
+			v = uint64(c - '0')
+		case c >= 'a' && c <= 'f':
+			v = uint64(c-'a') + 10
+		default:
+			return false
+		}
+		if v != 0 {
+			zeros += bits.LeadingZeros64(v) - 60
+			break
+		}
+		zeros += 4
+	}
+	return zeros >= n
+}
+
+// mine 计算区块的 Merkle 根，然后不断增加 Nonce，直到区块哈希满足 b.Bits 的难度
+func mine(b *Block) {
+	b.MerkleRoot = merkleRoot(b.Transactions)
+	b.Nonce = 0
+	for {
+		b.Hash = calculateBlockHash(*b)
+		if hashMeetsBits(b.Hash, b.Bits) {
+			return
+		}
+		b.Nonce++
+	}
+}
+
+// verifyProofOfWork 检查区块记录的难度是否等于它所在高度应有的难度，并且哈希满足这个难度
+func verifyProofOfWork(b Block, prev []Block) error {
+	if expected := nextBits(prev); b.Bits != expected {
+		return fmt.Errorf("difficulty %d does not match expected difficulty %d", b.Bits, expected)
+	}
+	if !hashMeetsBits(b.Hash, b.Bits) {
+		return fmt.Errorf("hash %s does not meet difficulty %d", b.Hash, b.Bits)
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package block
+
+import "testing"
+
+// chainBlocks 返回 index 从 0 开始的 n 个区块，相邻区块的时间相差 spacing 秒，难度都是 bits
+func chainBlocks(n int, spacing int64, bits int) []Block {
+	blocks := make([]Block, n)
+	for i := range blocks {
+		blocks[i] = Block{Index: i, Timestamp: 1577836800 + int64(i)*spacing, Bits: bits}
+	}
+	return blocks
+}
+
+func TestNextBits(t *testing.T) {
+	window := Consensus.RetargetWindow
+	spacing := int64(Consensus.TargetSpacing.Seconds())
+	tests := []struct {
+		name string
+		prev []Block
+		want int
+	}{
+		{"empty chain", nil, Consensus.InitialBits},
+		{"before first window", chainBlocks(window-1, 1, 20), Consensus.InitialBits},
+		{"on target", chainBlocks(window+1, spacing, 20), 20},
+		{"exactly half", chainBlocks(window+1, spacing/2, 20), 20},
+		{"too fast", chainBlocks(window+1, spacing/2-1, 20), 21},
+		{"exactly double", chainBlocks(window+1, spacing*2, 20), 20},
+		{"too slow", chainBlocks(window+1, spacing*2+1, 20), 19},
+		{"min bits", chainBlocks(window+1, spacing*3, Consensus.MinBits), Consensus.MinBits},
+		{"max bits", chainBlocks(window+1, 0, Consensus.MaxBits), Consensus.MaxBits},
+	}
+	for _, tt := range tests {
+		if got := nextBits(tt.prev); got != tt.want {
+			t.Errorf("%s: nextBits = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestHashMeetsBits(t *testing.T) {
+	tests := []struct {
+		hash string
+		bits int
+		want bool
+	}{
+		{"ffff", 0, true},
+		{"ffff", 1, false},
+		{"7fff", 1, true},
+		{"7fff", 2, false},
+		{"0fff", 4, true},
+		{"0fff", 5, false},
+		{"001f", 11, true},
+		{"001f", 12, false},
+		{"0000", 16, true},
+		{"00g0", 8, false},
+	}
+	for _, tt := range tests {
+		if got := hashMeetsBits(tt.hash, tt.bits); got != tt.want {
+			t.Errorf("hashMeetsBits(%q, %d) = %v, want %v", tt.hash, tt.bits, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package block
+
+import "fmt"
+
+// BlockSubsidy 返回高度为 height 的区块的挖矿奖励: Consensus.Subsidy 每 HalvingInterval 个区块减半，
+// HalvingInterval 为 0 时不减半。创世区块的输出不受奖励限制
+func BlockSubsidy(height int) int {
+	if Consensus.HalvingInterval <= 0 {
+		return Consensus.Subsidy
+	}
+	halvings := height / Consensus.HalvingInterval
+	if halvings >= 63 {
+		return 0
+	}
+	return Consensus.Subsidy >> uint(halvings)
+}
+
+// checkCoinbase 检查 coinbase 交易只产生币，并且不超过区块奖励加上区块中交易的手续费
+func checkCoinbase(tx Transaction, height, fees int) error {
+	total := 0
+	for _, out := range tx.Vout {
+		if out.Asset != "" {
+			return fmt.Errorf("coinbase must not create items")
+		}
+		if out.Value <= 0 {
+			return fmt.Errorf("coinbase output must have a positive value")
+		}
+		total += out.Value
+	}
+	if height > 0 && total > BlockSubsidy(height)+fees {
+		return fmt.Errorf("coinbase pays %d, more than subsidy %d plus fees %d", total, BlockSubsidy(height), fees)
+	}
+	return nil
+}
+
+// blockFees 计算 transactions 的手续费之和，即币的输入减去输出。调用方需要持有 chainMu 的读锁
+func blockFees(transactions []Transaction) int {
+	view := utxoView(Block{Transactions: transactions})
+	fees := 0
+	for _, tx := range transactions {
+		if !tx.IsCoinbase() {
+			prevOutputs := make(map[string]TXOutput)
+			for _, vin := range tx.Vin {
+				key := outpoint(vin.Txid, vin.Vout)
+				prevOutputs[key] = view[key]
+			}
+			if fee, err := checkAmounts(tx, prevOutputs); err == nil {
+				fees += fee
+			}
+		}
+		for id, vout := range tx.Vout {
+			view[outpoint(tx.ID, id)] = vout
+		}
+	}
+	return fees
+}
+
+// SupplyInfo 是币的发行情况: Minted 是 coinbase 产生的新币（不包括矿工领取的手续费），
+// Burned 是没有被矿工领取的手续费，Circulating 是 UTXO 中的币，等于 Minted 减去 Burned
+type SupplyInfo struct {
+	Height          int `json:"height"`
+	Minted          int `json:"minted"`
+	Burned          int `json:"burned"`
+	Circulating     int `json:"circulating"`
+	Subsidy         int `json:"subsidy"` // 下一个区块的挖矿奖励
+	HalvingInterval int `json:"halvingInterval"`
+	NextHalving     int `json:"nextHalving,omitempty"` // 下一次减半的高度
+}
+
+// Supply 从创世区块开始统计币的发行和流通
+func Supply() (SupplyInfo, error) {
+	chainMu.RLock()
+	blocks, err := store.AllBlocks()
+	chainMu.RUnlock()
+	if err != nil {
+		return SupplyInfo{}, err
+	}
+	info := SupplyInfo{Height: len(blocks) - 1, HalvingInterval: Consensus.HalvingInterval}
+	// coins 是还没有被花掉的币的输出
+	coins := make(map[string]int)
+	for _, b := range blocks {
+		// 区块使币的总量变化 coinbase - fees，为正时是新发行的币，为负时是销毁的手续费
+		coinbase, fees := 0, 0
+		for _, tx := range b.Transactions {
+			if tx.IsCoinbase() {
+				for _, out := range tx.Vout {
+					coinbase += out.Value
+				}
+			} else {
+				for _, vin := range tx.Vin {
+					key := outpoint(vin.Txid, vin.Vout)
+					fees += coins[key]
+					delete(coins, key)
+				}
+				for _, out := range tx.Vout {
+					fees -= out.Value
+				}
+			}
+			for id, out := range tx.Vout {
+				if out.Asset == "" {
+					coins[outpoint(tx.ID, id)] = out.Value
+				}
+			}
+		}
+		if coinbase > fees {
+			info.Minted += coinbase - fees
+		} else {
+			info.Burned += fees - coinbase
+		}
+	}
+	for _, v := range coins {
+		info.Circulating += v
+	}
+	info.Subsidy = BlockSubsidy(info.Height + 1)
+	if n := Consensus.HalvingInterval; n > 0 && info.Subsidy > 0 {
+		info.NextHalving = ((info.Height+1)/n + 1) * n
+	}
+	return info, nil
+}
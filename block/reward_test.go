@@ -0,0 +1,100 @@
+package block
+
+import "testing"
+
+func TestBlockSubsidy(t *testing.T) {
+	tests := []struct {
+		name     string
+		subsidy  int
+		interval int
+		height   int
+		want     int
+	}{
+		{"first block", 50, 10, 1, 50},
+		{"before first halving", 50, 10, 9, 50},
+		{"first halving", 50, 10, 10, 25},
+		{"second halving", 50, 10, 25, 12},
+		{"rounds down", 50, 10, 30, 6},
+		{"reaches zero", 50, 10, 60, 0},
+		{"many halvings", 50, 10, 10 * 100, 0},
+		{"no halving", 50, 0, 1000000, 50},
+		{"no subsidy", 0, 10, 1, 0},
+	}
+	for _, tt := range tests {
+		withConsensus(t, func(c *ConsensusParams) {
+			c.Subsidy = tt.subsidy
+			c.HalvingInterval = tt.interval
+		})
+		if got := BlockSubsidy(tt.height); got != tt.want {
+			t.Errorf("%s: BlockSubsidy(%d) = %d, want %d", tt.name, tt.height, got, tt.want)
+		}
+	}
+}
+
+func TestCheckCoinbase(t *testing.T) {
+	withConsensus(t, func(c *ConsensusParams) {
+		c.Subsidy = 10
+		c.HalvingInterval = 100
+	})
+	coinbase := func(outs ...TXOutput) Transaction {
+		return Transaction{"cb", []TXInput{{"", -1, nil, nil}}, outs}
+	}
+	tests := []struct {
+		name   string
+		tx     Transaction
+		height int
+		fees   int
+		ok     bool
+	}{
+		{"subsidy", coinbase(TXOutput{10, "miner", "", 0}), 1, 0, true},
+		{"subsidy and fees", coinbase(TXOutput{13, "miner", "", 0}), 1, 3, true},
+		{"less than allowed", coinbase(TXOutput{5, "miner", "", 0}), 1, 3, true},
+		{"split outputs", coinbase(TXOutput{6, "a", "", 0}, TXOutput{7, "b", "", 0}), 1, 3, true},
+		{"more than subsidy and fees", coinbase(TXOutput{14, "miner", "", 0}), 1, 3, false},
+		{"after halving", coinbase(TXOutput{6, "miner", "", 0}), 100, 0, false},
+		{"halved subsidy", coinbase(TXOutput{5, "miner", "", 0}), 100, 0, true},
+		{"items", coinbase(TXOutput{0, "miner", "sword", 1}), 1, 0, false},
+		{"zero value", coinbase(TXOutput{0, "miner", "", 0}), 1, 0, false},
+		// 创世区块不受限制
+		{"genesis", coinbase(TXOutput{50, "genesis", "", 0}), 0, 0, true},
+	}
+	for _, tt := range tests {
+		err := checkCoinbase(tt.tx, tt.height, tt.fees)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: checkCoinbase = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestVerifyTransactionsCoinbase(t *testing.T) {
+	withConsensus(t, func(c *ConsensusParams) {
+		c.Subsidy = 10
+		c.HalvingInterval = 0
+	})
+	alice := newWallet(t)
+	funding := UTXO{"funding", 0, 20, alice.GetAddress(), "", 0}
+	// 付 15 个币，手续费 5
+	pay := signedTx(t, alice, []UTXO{funding}, TXOutput{15, "bob", "", 0})
+	tests := []struct {
+		name string
+		txs  []Transaction
+		ok   bool
+	}{
+		{"subsidy plus fees", []Transaction{NewCoinbaseTX("miner", 15), pay}, true},
+		{"more than subsidy plus fees", []Transaction{NewCoinbaseTX("miner", 16), pay}, false},
+		{"subsidy without fees", []Transaction{NewCoinbaseTX("miner", 10)}, true},
+		{"fees without transactions", []Transaction{NewCoinbaseTX("miner", 11)}, false},
+		{"no coinbase", []Transaction{pay}, true},
+		{"coinbase not first", []Transaction{pay, NewCoinbaseTX("miner", 10)}, false},
+		{"two coinbases", []Transaction{NewCoinbaseTX("miner", 5), NewCoinbaseTX("miner", 5)}, false},
+		{"duplicate transaction", []Transaction{pay, pay}, false},
+	}
+	for _, tt := range tests {
+		utxos := map[string]TXOutput{funding.Key(): funding.Output()}
+		b := Block{Index: 1, Transactions: tt.txs}
+		err := verifyTransactions(b, utxos, func(string) bool { return false })
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: verifyTransactions = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
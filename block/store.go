@@ -0,0 +1,78 @@
+package block
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrNotFound 表示存储中没有找到对应的区块或记录
+	ErrNotFound = errors.New("block: not found")
+	// ErrConflict 表示写入的区块和已有区块的 index 或 hash 重复，通常是另一个进程先写入了同一高度的区块
+	ErrConflict = errors.New("block: block index or hash already exists")
+)
+
+// ChainStore 是区块链的存储后端。
+// block 包里所有对区块、交易记录的读写都经过它，
+// 这样节点可以在没有 MongoDB 的机器上用本地文件或内存运行。
+type ChainStore interface {
+	// LastBlock 返回 index 最大的区块，链为空时返回 ErrNotFound
+	LastBlock() (Block, error)
+	// AppendBlock 在一个事务中把区块写到链尾、按区块更新 UTXO 集合并保存 records，
+	// 要么全部完成，要么都不生效。index 或 hash 已经存在时返回 ErrConflict。
+	AppendBlock(b Block, records []Record) error
+	// AllBlocks 按 index 升序返回全部区块
+	AllBlocks() ([]Block, error)
+	// Blocks 按 index 升序返回从 from 开始的最多 limit 个区块
+	Blocks(from, limit int) ([]Block, error)
+	// BlockByTxid 返回包含交易 txid 的区块，不存在时返回 ErrNotFound
+	BlockByTxid(txid string) (Block, error)
+	// BlockByHash 返回主链上哈希为 hash 的区块，不存在时返回 ErrNotFound
+	BlockByHash(hash string) (Block, error)
+	// TruncateBlocks 删除主链上 index 大于 height 的区块，用于链重组
+	TruncateBlocks(height int) error
+	// SaveSideBlock 保存一个不在主链上的分叉区块
+	SaveSideBlock(b Block) error
+	// SideBlock 按哈希查找分叉区块，不存在时返回 ErrNotFound
+	SideBlock(hash string) (Block, error)
+	// DeleteSideBlock 删除一个分叉区块
+	DeleteSideBlock(hash string) error
+	// FindUTXO 按 txid:vout 查找 UTXO，不存在时返回 ErrNotFound
+	FindUTXO(key string) (UTXO, error)
+	// FindUTXOs 返回锁定给 address 的全部 UTXO
+	FindUTXOs(address string) ([]UTXO, error)
+	// UTXOPage 按 txid:vout 的字符串顺序返回锁定给 address、键大于 after 的最多 limit 个 UTXO
+	UTXOPage(address, after string, limit int) ([]UTXO, error)
+	// UpdateUTXO 从 UTXO 集合删除 spent 中的键并加入 created
+	UpdateUTXO(spent []string, created []UTXO) error
+	// ResetUTXO 清空 UTXO 集合
+	ResetUTXO() error
+	// FindRecords 返回 from 或 to 为 userid，并且时间在 [since, until) 内的交易记录，
+	// since 或 until 为 0 时不限制对应的一端
+	FindRecords(userid string, since, until int64) ([]Record, error)
+	// DeleteRecords 删除 txid 在 txids 中的交易记录并返回被删除的记录，用于链重组
+	DeleteRecords(txids []string) ([]Record, error)
+	Close() error
+}
+
+// 可以通过配置选择的存储后端
+const (
+	StoreMongo  = "mongo"
+	StoreBolt   = "bolt"
+	StoreMemory = "memory"
+)
+
+// OpenStore 按 kind 打开一个存储后端，path 只对 bolt 有效。
+// mongo 后端使用 database.Mgo 中已经建立好的连接。
+func OpenStore(kind, path string) (ChainStore, error) {
+	switch kind {
+	case "", StoreMongo:
+		return NewMongoStore()
+	case StoreBolt:
+		return NewBoltStore(path)
+	case StoreMemory:
+		return NewMemoryStore(), nil
+	default:
+		return nil, fmt.Errorf("block: unknown chain store %q", kind)
+	}
+}
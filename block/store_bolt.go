@@ -0,0 +1,485 @@
+package block
+
+import (
+	"bytes"
+	"encoding/binary"
+	"go.etcd.io/bbolt"
+	"go.mongodb.org/mongo-driver/bson"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var (
+	blocksBucket  = []byte("blocks")
+	hashesBucket  = []byte("hashes")
+	sideBucket    = []byte("side")
+	txindexBucket = []byte("txindex")
+	utxoBucket    = []byte("utxo")
+	recordsBucket = []byte("records")
+	// 索引的键是 前缀 + 0 + 被索引的键，值为空
+	addressBucket    = []byte("utxoaddress")
+	recordUserBucket = []byte("recorduser")
+	recordTxBucket   = []byte("recordtx")
+)
+
+// boltStore 把数据保存在本地的 bolt 文件里:
+// blocks 以大端序的 index 为键，hashes 记录 hash -> index，txindex 记录 txid -> index，side 以 hash 为键保存分叉区块，
+// utxo 以 txid:vout 为键，records 以自增序号为键。值都用 bson 编码，和 MongoDB 里的文档保持一致。
+// utxoaddress 是地址到 txid:vout 的索引，recorduser 和 recordtx 是用户和 txid 到交易记录序号的索引，
+// 和被索引的数据在同一个 bolt 事务中写入。
+type boltStore struct {
+	db *bbolt.DB
+}
+
+func NewBoltStore(path string) (ChainStore, error) {
+	if path == "" {
+		path = "data/chain.db"
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		for _, name := range [][]byte{blocksBucket, hashesBucket, sideBucket, txindexBucket, utxoBucket, recordsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		// 旧版本的文件没有索引，从已有的数据建立
+		if tx.Bucket(addressBucket) == nil {
+			if err := rebuildAddressIndex(tx); err != nil {
+				return err
+			}
+		}
+		if tx.Bucket(recordUserBucket) == nil || tx.Bucket(recordTxBucket) == nil {
+			return rebuildRecordIndex(tx)
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltStore{db: db}, nil
+}
+
+// indexKey 返回索引 prefix 中 key 的键，prefix 中不会有 0 字节
+func indexKey(prefix string, key []byte) []byte {
+	return append(append([]byte(prefix), 0), key...)
+}
+
+// scanIndex 按顺序对索引 bucket 中前缀为 prefix 的每个被索引的键调用 f
+func scanIndex(b *bbolt.Bucket, prefix string, f func(key []byte) error) error {
+	start := indexKey(prefix, nil)
+	c := b.Cursor()
+	for k, _ := c.Seek(start); k != nil && bytes.HasPrefix(k, start); k, _ = c.Next() {
+		if err := f(k[len(start):]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func rebuildAddressIndex(tx *bbolt.Tx) error {
+	if tx.Bucket(addressBucket) != nil {
+		if err := tx.DeleteBucket(addressBucket); err != nil {
+			return err
+		}
+	}
+	index, err := tx.CreateBucket(addressBucket)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(utxoBucket).ForEach(func(k, v []byte) error {
+		u := UTXO{}
+		if err := bson.Unmarshal(v, &u); err != nil {
+			return err
+		}
+		return index.Put(indexKey(u.ScriptPubKey, k), nil)
+	})
+}
+
+func rebuildRecordIndex(tx *bbolt.Tx) error {
+	for _, name := range [][]byte{recordUserBucket, recordTxBucket} {
+		if tx.Bucket(name) != nil {
+			if err := tx.DeleteBucket(name); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.CreateBucket(name); err != nil {
+			return err
+		}
+	}
+	return tx.Bucket(recordsBucket).ForEach(func(k, v []byte) error {
+		r := Record{}
+		if err := bson.Unmarshal(v, &r); err != nil {
+			return err
+		}
+		return indexRecord(tx, k, r)
+	})
+}
+
+func itob(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+func (s *boltStore) LastBlock() (Block, error) {
+	result := Block{}
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		_, v := tx.Bucket(blocksBucket).Cursor().Last()
+		if v == nil {
+			return ErrNotFound
+		}
+		return bson.Unmarshal(v, &result)
+	})
+	return result, err
+}
+
+func (s *boltStore) AppendBlock(b Block, records []Record) error {
+	data, err := bson.Marshal(b)
+	if err != nil {
+		return err
+	}
+	spent, created := utxoChanges(b)
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		key := itob(uint64(b.Index))
+		blocks, hashes := tx.Bucket(blocksBucket), tx.Bucket(hashesBucket)
+		if blocks.Get(key) != nil || hashes.Get([]byte(b.Hash)) != nil {
+			return ErrConflict
+		}
+		if err := blocks.Put(key, data); err != nil {
+			return err
+		}
+		if err := hashes.Put([]byte(b.Hash), key); err != nil {
+			return err
+		}
+		txindex := tx.Bucket(txindexBucket)
+		for _, t := range b.Transactions {
+			if err := txindex.Put([]byte(t.ID), key); err != nil {
+				return err
+			}
+		}
+		if err := updateUTXOBucket(tx, spent, created); err != nil {
+			return err
+		}
+		for _, r := range records {
+			if err := putRecord(tx, r); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) AllBlocks() ([]Block, error) {
+	var results []Block
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(blocksBucket).ForEach(func(_, v []byte) error {
+			b := Block{}
+			if err := bson.Unmarshal(v, &b); err != nil {
+				return err
+			}
+			results = append(results, b)
+			return nil
+		})
+	})
+	return results, err
+}
+
+func (s *boltStore) Blocks(from, limit int) ([]Block, error) {
+	var results []Block
+	if from < 0 {
+		from = 0
+	}
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		c := tx.Bucket(blocksBucket).Cursor()
+		for k, v := c.Seek(itob(uint64(from))); k != nil && len(results) < limit; k, v = c.Next() {
+			b := Block{}
+			if err := bson.Unmarshal(v, &b); err != nil {
+				return err
+			}
+			results = append(results, b)
+		}
+		return nil
+	})
+	return results, err
+}
+
+func (s *boltStore) BlockByTxid(txid string) (Block, error) {
+	result := Block{}
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		key := tx.Bucket(txindexBucket).Get([]byte(txid))
+		if key == nil {
+			return ErrNotFound
+		}
+		return bson.Unmarshal(tx.Bucket(blocksBucket).Get(key), &result)
+	})
+	return result, err
+}
+
+func (s *boltStore) BlockByHash(hash string) (Block, error) {
+	result := Block{}
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		key := tx.Bucket(hashesBucket).Get([]byte(hash))
+		if key == nil {
+			return ErrNotFound
+		}
+		return bson.Unmarshal(tx.Bucket(blocksBucket).Get(key), &result)
+	})
+	return result, err
+}
+
+func (s *boltStore) TruncateBlocks(height int) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		blocks := tx.Bucket(blocksBucket)
+		var keys [][]byte
+		c := blocks.Cursor()
+		for k, v := c.Seek(itob(uint64(height + 1))); k != nil; k, v = c.Next() {
+			b := Block{}
+			if err := bson.Unmarshal(v, &b); err != nil {
+				return err
+			}
+			if err := tx.Bucket(hashesBucket).Delete([]byte(b.Hash)); err != nil {
+				return err
+			}
+			for _, t := range b.Transactions {
+				if err := tx.Bucket(txindexBucket).Delete([]byte(t.ID)); err != nil {
+					return err
+				}
+			}
+			keys = append(keys, append([]byte(nil), k...))
+		}
+		for _, k := range keys {
+			if err := blocks.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) SaveSideBlock(b Block) error {
+	data, err := bson.Marshal(b)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(sideBucket).Put([]byte(b.Hash), data)
+	})
+}
+
+func (s *boltStore) SideBlock(hash string) (Block, error) {
+	result := Block{}
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		v := tx.Bucket(sideBucket).Get([]byte(hash))
+		if v == nil {
+			return ErrNotFound
+		}
+		return bson.Unmarshal(v, &result)
+	})
+	return result, err
+}
+
+func (s *boltStore) DeleteSideBlock(hash string) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(sideBucket).Delete([]byte(hash))
+	})
+}
+
+func (s *boltStore) FindUTXO(key string) (UTXO, error) {
+	result := UTXO{}
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		v := tx.Bucket(utxoBucket).Get([]byte(key))
+		if v == nil {
+			return ErrNotFound
+		}
+		return bson.Unmarshal(v, &result)
+	})
+	return result, err
+}
+
+func (s *boltStore) FindUTXOs(address string) ([]UTXO, error) {
+	var results []UTXO
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		utxos := tx.Bucket(utxoBucket)
+		return scanIndex(tx.Bucket(addressBucket), address, func(key []byte) error {
+			u := UTXO{}
+			if err := bson.Unmarshal(utxos.Get(key), &u); err != nil {
+				return err
+			}
+			results = append(results, u)
+			return nil
+		})
+	})
+	return results, err
+}
+
+func (s *boltStore) UTXOPage(address, after string, limit int) ([]UTXO, error) {
+	var results []UTXO
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		utxos := tx.Bucket(utxoBucket)
+		start := indexKey(address, nil)
+		c := tx.Bucket(addressBucket).Cursor()
+		k, _ := c.Seek(indexKey(address, []byte(after)))
+		for ; k != nil && bytes.HasPrefix(k, start) && len(results) < limit; k, _ = c.Next() {
+			key := k[len(start):]
+			if string(key) == after {
+				continue
+			}
+			u := UTXO{}
+			if err := bson.Unmarshal(utxos.Get(key), &u); err != nil {
+				return err
+			}
+			results = append(results, u)
+		}
+		return nil
+	})
+	return results, err
+}
+
+func (s *boltStore) UpdateUTXO(spent []string, created []UTXO) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		return updateUTXOBucket(tx, spent, created)
+	})
+}
+
+// updateUTXOBucket 删除 spent、加入 created，同时更新地址索引
+func updateUTXOBucket(tx *bbolt.Tx, spent []string, created []UTXO) error {
+	utxos, index := tx.Bucket(utxoBucket), tx.Bucket(addressBucket)
+	for _, key := range spent {
+		v := utxos.Get([]byte(key))
+		if v == nil {
+			continue
+		}
+		u := UTXO{}
+		if err := bson.Unmarshal(v, &u); err != nil {
+			return err
+		}
+		if err := index.Delete(indexKey(u.ScriptPubKey, []byte(key))); err != nil {
+			return err
+		}
+		if err := utxos.Delete([]byte(key)); err != nil {
+			return err
+		}
+	}
+	for _, u := range created {
+		data, err := bson.Marshal(u)
+		if err != nil {
+			return err
+		}
+		if err := utxos.Put([]byte(u.Key()), data); err != nil {
+			return err
+		}
+		if err := index.Put(indexKey(u.ScriptPubKey, []byte(u.Key())), nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *boltStore) ResetUTXO() error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		if err := tx.DeleteBucket(utxoBucket); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucket(utxoBucket); err != nil {
+			return err
+		}
+		return rebuildAddressIndex(tx)
+	})
+}
+
+func putRecord(tx *bbolt.Tx, r Record) error {
+	data, err := bson.Marshal(r)
+	if err != nil {
+		return err
+	}
+	records := tx.Bucket(recordsBucket)
+	seq, err := records.NextSequence()
+	if err != nil {
+		return err
+	}
+	if err := records.Put(itob(seq), data); err != nil {
+		return err
+	}
+	return indexRecord(tx, itob(seq), r)
+}
+
+// indexRecord 把序号为 key 的交易记录加入付款人、收款人和 txid 的索引
+func indexRecord(tx *bbolt.Tx, key []byte, r Record) error {
+	users := tx.Bucket(recordUserBucket)
+	for _, userid := range []string{r.From, r.To} {
+		if err := users.Put(indexKey(userid, key), nil); err != nil {
+			return err
+		}
+	}
+	return tx.Bucket(recordTxBucket).Put(indexKey(r.Txid, key), nil)
+}
+
+func (s *boltStore) FindRecords(userid string, since, until int64) ([]Record, error) {
+	var results []Record
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		records := tx.Bucket(recordsBucket)
+		return scanIndex(tx.Bucket(recordUserBucket), userid, func(key []byte) error {
+			r := Record{}
+			if err := bson.Unmarshal(records.Get(key), &r); err != nil {
+				return err
+			}
+			if r.inRange(since, until) {
+				results = append(results, r)
+			}
+			return nil
+		})
+	})
+	return results, err
+}
+
+func (s *boltStore) DeleteRecords(txids []string) ([]Record, error) {
+	var deleted []Record
+	err := s.db.Update(func(tx *bbolt.Tx) error {
+		records, users, txs := tx.Bucket(recordsBucket), tx.Bucket(recordUserBucket), tx.Bucket(recordTxBucket)
+		for _, txid := range txids {
+			var keys [][]byte
+			err := scanIndex(txs, txid, func(key []byte) error {
+				keys = append(keys, append([]byte(nil), key...))
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			for _, key := range keys {
+				r := Record{}
+				if err := bson.Unmarshal(records.Get(key), &r); err != nil {
+					return err
+				}
+				for _, userid := range []string{r.From, r.To} {
+					if err := users.Delete(indexKey(userid, key)); err != nil {
+						return err
+					}
+				}
+				if err := txs.Delete(indexKey(txid, key)); err != nil {
+					return err
+				}
+				if err := records.Delete(key); err != nil {
+					return err
+				}
+				deleted = append(deleted, r)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return deleted, nil
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,161 @@
+package block
+
+import (
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"go.etcd.io/bbolt"
+)
+
+// storeBlocks 是写入存储的测试区块: 区块 0 给 alice 和 bob 各一个输出，区块 1 花掉 alice 的输出付给 carol
+func storeBlocks() []Block {
+	cb := Transaction{"cb", []TXInput{{"", -1, nil, nil}}, []TXOutput{{10, "alice", "", 0}, {5, "bob", "", 0}}}
+	pay := Transaction{"pay", []TXInput{{"cb", 0, nil, nil}}, []TXOutput{{7, "carol", "", 0}, {3, "alice", "", 0}}}
+	return []Block{
+		{Index: 0, Hash: "h0", Transactions: []Transaction{cb}},
+		{Index: 1, Hash: "h1", PrevHash: "h0", Transactions: []Transaction{pay}},
+	}
+}
+
+func utxoKeys(utxos []UTXO) []string {
+	keys := []string{}
+	for _, u := range utxos {
+		keys = append(keys, u.Key())
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sameKeys(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func openBolt(t *testing.T, path string) ChainStore {
+	s, err := NewBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestBoltStoreIndexes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chain.db")
+	s := openBolt(t, path)
+	records := [][]Record{
+		{{100, "miner", "alice", 10, "cb"}},
+		{{200, "alice", "carol", 7, "pay"}, {200, "alice", "alice", 3, "pay"}},
+	}
+	for i, b := range storeBlocks() {
+		if err := s.AppendBlock(b, records[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	check := func(name string, s ChainStore) {
+		utxos := []struct {
+			address string
+			want    []string
+		}{
+			{"alice", []string{"pay:1"}},
+			{"bob", []string{"cb:1"}},
+			{"carol", []string{"pay:0"}},
+			{"dave", []string{}},
+			// 前缀相同的地址不能匹配
+			{"ali", []string{}},
+		}
+		for _, tt := range utxos {
+			got, err := s.FindUTXOs(tt.address)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if keys := utxoKeys(got); !sameKeys(keys, tt.want) {
+				t.Errorf("%s: FindUTXOs(%s) = %v, want %v", name, tt.address, keys, tt.want)
+			}
+		}
+		found := []struct {
+			user         string
+			since, until int64
+			want         int
+		}{
+			{"alice", 0, 0, 3},
+			{"alice", 150, 0, 2},
+			{"alice", 0, 150, 1},
+			{"carol", 0, 0, 1},
+			{"bob", 0, 0, 0},
+		}
+		for _, tt := range found {
+			got, err := s.FindRecords(tt.user, tt.since, tt.until)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != tt.want {
+				t.Errorf("%s: FindRecords(%s, %d, %d) = %d records, want %d", name, tt.user, tt.since, tt.until, len(got), tt.want)
+			}
+		}
+	}
+	check("append", s)
+
+	// 没有索引的旧文件打开时重建索引
+	s.Close()
+	db, err := bbolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		for _, name := range [][]byte{addressBucket, recordUserBucket, recordTxBucket} {
+			if err := tx.DeleteBucket(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = openBolt(t, path)
+	defer s.Close()
+	check("rebuild", s)
+
+	deleted, err := s.DeleteRecords([]string{"pay", "missing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deleted) != 2 {
+		t.Errorf("DeleteRecords deleted %d records, want 2", len(deleted))
+	}
+	if got, _ := s.FindRecords("alice", 0, 0); len(got) != 1 {
+		t.Errorf("after DeleteRecords alice has %d records, want 1", len(got))
+	}
+	if got, _ := s.FindRecords("carol", 0, 0); len(got) != 0 {
+		t.Errorf("after DeleteRecords carol has %d records, want 0", len(got))
+	}
+
+	if err := s.ResetUTXO(); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := s.FindUTXOs("alice"); len(got) != 0 {
+		t.Errorf("after ResetUTXO alice has %d UTXOs, want 0", len(got))
+	}
+	if err := s.UpdateUTXO(nil, []UTXO{{"x", 0, 1, "alice", "", 0}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.UpdateUTXO([]string{"x:0"}, []UTXO{{"y", 0, 1, "bob", "", 0}}); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := s.FindUTXOs("alice"); len(got) != 0 {
+		t.Errorf("spent UTXO is still indexed for alice: %v", utxoKeys(got))
+	}
+	if got, _ := s.FindUTXOs("bob"); !sameKeys(utxoKeys(got), []string{"y:0"}) {
+		t.Errorf("FindUTXOs(bob) = %v, want [y:0]", utxoKeys(got))
+	}
+}
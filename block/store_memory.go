@@ -0,0 +1,227 @@
+package block
+
+import (
+	"sort"
+	"sync"
+)
+
+// memoryStore 把数据放在进程内存里，进程退出后数据丢失，适合本地调试和测试
+type memoryStore struct {
+	mu      sync.RWMutex
+	blocks  []Block
+	side    map[string]Block
+	utxos   map[string]UTXO
+	records []Record
+}
+
+func NewMemoryStore() ChainStore {
+	return &memoryStore{side: make(map[string]Block), utxos: make(map[string]UTXO)}
+}
+
+func (s *memoryStore) LastBlock() (Block, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(s.blocks) == 0 {
+		return Block{}, ErrNotFound
+	}
+	return s.blocks[len(s.blocks)-1], nil
+}
+
+func (s *memoryStore) AppendBlock(b Block, records []Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if b.Index != len(s.blocks) {
+		return ErrConflict
+	}
+	for _, old := range s.blocks {
+		if old.Hash == b.Hash {
+			return ErrConflict
+		}
+	}
+	s.blocks = append(s.blocks, b)
+	spent, created := utxoChanges(b)
+	for _, key := range spent {
+		delete(s.utxos, key)
+	}
+	for _, u := range created {
+		s.utxos[u.Key()] = u
+	}
+	s.records = append(s.records, records...)
+	return nil
+}
+
+func (s *memoryStore) AllBlocks() ([]Block, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	results := make([]Block, len(s.blocks))
+	copy(results, s.blocks)
+	return results, nil
+}
+
+func (s *memoryStore) Blocks(from, limit int) ([]Block, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if from < 0 {
+		from = 0
+	}
+	if from >= len(s.blocks) || limit <= 0 {
+		return nil, nil
+	}
+	to := from + limit
+	if to > len(s.blocks) {
+		to = len(s.blocks)
+	}
+	results := make([]Block, to-from)
+	copy(results, s.blocks[from:to])
+	return results, nil
+}
+
+func (s *memoryStore) BlockByTxid(txid string) (Block, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, b := range s.blocks {
+		for _, tx := range b.Transactions {
+			if tx.ID == txid {
+				return b, nil
+			}
+		}
+	}
+	return Block{}, ErrNotFound
+}
+
+func (s *memoryStore) BlockByHash(hash string) (Block, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, b := range s.blocks {
+		if b.Hash == hash {
+			return b, nil
+		}
+	}
+	return Block{}, ErrNotFound
+}
+
+func (s *memoryStore) TruncateBlocks(height int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if height+1 < len(s.blocks) {
+		s.blocks = s.blocks[:height+1]
+	}
+	return nil
+}
+
+func (s *memoryStore) SaveSideBlock(b Block) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.side[b.Hash] = b
+	return nil
+}
+
+func (s *memoryStore) SideBlock(hash string) (Block, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	b, ok := s.side[hash]
+	if !ok {
+		return b, ErrNotFound
+	}
+	return b, nil
+}
+
+func (s *memoryStore) DeleteSideBlock(hash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.side, hash)
+	return nil
+}
+
+func (s *memoryStore) FindUTXO(key string) (UTXO, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	u, ok := s.utxos[key]
+	if !ok {
+		return u, ErrNotFound
+	}
+	return u, nil
+}
+
+func (s *memoryStore) FindUTXOs(address string) ([]UTXO, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var results []UTXO
+	for _, u := range s.utxos {
+		if u.ScriptPubKey == address {
+			results = append(results, u)
+		}
+	}
+	return results, nil
+}
+
+func (s *memoryStore) UTXOPage(address, after string, limit int) ([]UTXO, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var results []UTXO
+	for key, u := range s.utxos {
+		if u.ScriptPubKey == address && key > after {
+			results = append(results, u)
+		}
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Key() < results[j].Key() })
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results, nil
+}
+
+func (s *memoryStore) UpdateUTXO(spent []string, created []UTXO) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, key := range spent {
+		delete(s.utxos, key)
+	}
+	for _, u := range created {
+		s.utxos[u.Key()] = u
+	}
+	return nil
+}
+
+func (s *memoryStore) ResetUTXO() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.utxos = make(map[string]UTXO)
+	return nil
+}
+
+func (s *memoryStore) FindRecords(userid string, since, until int64) ([]Record, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var results []Record
+	for _, r := range s.records {
+		if (r.From == userid || r.To == userid) && r.inRange(since, until) {
+			results = append(results, r)
+		}
+	}
+	return results, nil
+}
+
+func (s *memoryStore) DeleteRecords(txids []string) ([]Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	remove := make(map[string]bool, len(txids))
+	for _, id := range txids {
+		remove[id] = true
+	}
+	var deleted []Record
+	records := s.records[:0]
+	for _, r := range s.records {
+		if remove[r.Txid] {
+			deleted = append(deleted, r)
+		} else {
+			records = append(records, r)
+		}
+	}
+	s.records = records
+	return deleted, nil
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
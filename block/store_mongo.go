@@ -0,0 +1,296 @@
+package block
+
+import (
+	"BlockChain/database"
+	"context"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// mongoStore 把主链区块保存在 BlockChain.Block，分叉区块保存在 BlockChain.SideBlock，
+// UTXO 集合保存在 BlockChain.UTXO，交易记录保存在 BlockChain.Transaction。
+// 写入区块使用多文档事务，MongoDB 需要以副本集方式运行。
+type mongoStore struct {
+	client  *mongo.Client
+	blocks  *mongo.Collection
+	side    *mongo.Collection
+	utxos   *mongo.Collection
+	records *mongo.Collection
+}
+
+// NewMongoStore 使用 database.Mgo 的连接，并建立区块 index 和 hash 上的唯一索引。
+// 多个进程写同一个数据库时，唯一索引保证同一高度只有一个区块。
+func NewMongoStore() (ChainStore, error) {
+	db := database.Mgo.Db
+	s := &mongoStore{
+		client:  database.Mgo.Client,
+		blocks:  db.Collection("Block"),
+		side:    db.Collection("SideBlock"),
+		utxos:   db.Collection("UTXO"),
+		records: db.Collection("Transaction"),
+	}
+	// 旧版本的区块和交易记录先转换成当前的格式，否则读取区块时解码失败
+	if err := s.migrate(); err != nil {
+		return nil, err
+	}
+	unique := options.Index().SetUnique(true)
+	_, err := s.blocks.Indexes().CreateMany(context.TODO(), []mongo.IndexModel{
+		{Keys: bson.D{{"index", 1}}, Options: unique},
+		{Keys: bson.D{{"hash", 1}}, Options: unique},
+		{Keys: bson.D{{"transactions.id", 1}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	_, err = s.side.Indexes().CreateOne(context.TODO(), mongo.IndexModel{Keys: bson.D{{"hash", 1}}, Options: unique})
+	if err != nil {
+		return nil, err
+	}
+	// 按地址查询和按 _id 分页都使用这个索引
+	_, err = s.utxos.Indexes().CreateOne(context.TODO(), mongo.IndexModel{Keys: bson.D{{"scriptPubKey", 1}, {"_id", 1}}})
+	if err != nil {
+		return nil, err
+	}
+	_, err = s.records.Indexes().CreateMany(context.TODO(), []mongo.IndexModel{
+		{Keys: bson.D{{"txid", 1}}},
+		{Keys: bson.D{{"from", 1}, {"timestamp", 1}}},
+		{Keys: bson.D{{"to", 1}, {"timestamp", 1}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// utxoDoc 是 UTXO 在 MongoDB 中的文档，_id 为 txid:vout
+type utxoDoc struct {
+	Key  string `bson:"_id"`
+	UTXO `bson:",inline"`
+}
+
+func (s *mongoStore) LastBlock() (Block, error) {
+	result := Block{}
+	opts := options.FindOne().SetSort(bson.D{{"index", -1}})
+	err := s.blocks.FindOne(context.TODO(), bson.D{}, opts).Decode(&result)
+	if err == mongo.ErrNoDocuments {
+		return result, ErrNotFound
+	}
+	return result, err
+}
+
+// AppendBlock 在一个会话事务中写入区块、UTXO 变化和交易记录，
+// 遇到临时性的事务错误时由驱动自动重试
+func (s *mongoStore) AppendBlock(b Block, records []Record) error {
+	spent, created := utxoChanges(b)
+	session, err := s.client.StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(context.TODO())
+
+	_, err = session.WithTransaction(context.TODO(), func(sc mongo.SessionContext) (interface{}, error) {
+		if _, err := s.blocks.InsertOne(sc, b); err != nil {
+			return nil, err
+		}
+		if err := s.updateUTXO(sc, spent, created); err != nil {
+			return nil, err
+		}
+		if len(records) > 0 {
+			docs := make([]interface{}, 0, len(records))
+			for _, r := range records {
+				docs = append(docs, r)
+			}
+			if _, err := s.records.InsertMany(sc, docs); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	})
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrConflict
+	}
+	return err
+}
+
+func (s *mongoStore) AllBlocks() ([]Block, error) {
+	opts := options.Find().SetSort(bson.D{{"index", 1}})
+	cursor, err := s.blocks.Find(context.TODO(), bson.D{}, opts)
+	if err != nil {
+		return nil, err
+	}
+	var results []Block
+	err = cursor.All(context.TODO(), &results)
+	return results, err
+}
+
+func (s *mongoStore) Blocks(from, limit int) ([]Block, error) {
+	if limit <= 0 {
+		return nil, nil
+	}
+	filter := bson.D{{"index", bson.D{{"$gte", from}}}}
+	opts := options.Find().SetSort(bson.D{{"index", 1}}).SetLimit(int64(limit))
+	cursor, err := s.blocks.Find(context.TODO(), filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	var results []Block
+	err = cursor.All(context.TODO(), &results)
+	return results, err
+}
+
+func (s *mongoStore) BlockByTxid(txid string) (Block, error) {
+	result := Block{}
+	err := s.blocks.FindOne(context.TODO(), bson.D{{"transactions.id", txid}}).Decode(&result)
+	if err == mongo.ErrNoDocuments {
+		return result, ErrNotFound
+	}
+	return result, err
+}
+
+func (s *mongoStore) BlockByHash(hash string) (Block, error) {
+	result := Block{}
+	err := s.blocks.FindOne(context.TODO(), bson.D{{"hash", hash}}).Decode(&result)
+	if err == mongo.ErrNoDocuments {
+		return result, ErrNotFound
+	}
+	return result, err
+}
+
+func (s *mongoStore) TruncateBlocks(height int) error {
+	_, err := s.blocks.DeleteMany(context.TODO(), bson.D{{"index", bson.D{{"$gt", height}}}})
+	return err
+}
+
+func (s *mongoStore) SaveSideBlock(b Block) error {
+	opts := options.Replace().SetUpsert(true)
+	_, err := s.side.ReplaceOne(context.TODO(), bson.D{{"hash", b.Hash}}, b, opts)
+	return err
+}
+
+func (s *mongoStore) SideBlock(hash string) (Block, error) {
+	result := Block{}
+	err := s.side.FindOne(context.TODO(), bson.D{{"hash", hash}}).Decode(&result)
+	if err == mongo.ErrNoDocuments {
+		return result, ErrNotFound
+	}
+	return result, err
+}
+
+func (s *mongoStore) DeleteSideBlock(hash string) error {
+	_, err := s.side.DeleteOne(context.TODO(), bson.D{{"hash", hash}})
+	return err
+}
+
+func (s *mongoStore) FindUTXO(key string) (UTXO, error) {
+	result := utxoDoc{}
+	err := s.utxos.FindOne(context.TODO(), bson.D{{"_id", key}}).Decode(&result)
+	if err == mongo.ErrNoDocuments {
+		return UTXO{}, ErrNotFound
+	}
+	return result.UTXO, err
+}
+
+func (s *mongoStore) FindUTXOs(address string) ([]UTXO, error) {
+	cursor, err := s.utxos.Find(context.TODO(), bson.D{{"scriptPubKey", address}})
+	if err != nil {
+		return nil, err
+	}
+	var docs []utxoDoc
+	if err = cursor.All(context.TODO(), &docs); err != nil {
+		return nil, err
+	}
+	results := make([]UTXO, 0, len(docs))
+	for _, d := range docs {
+		results = append(results, d.UTXO)
+	}
+	return results, nil
+}
+
+func (s *mongoStore) UTXOPage(address, after string, limit int) ([]UTXO, error) {
+	filter := bson.D{{"scriptPubKey", address}, {"_id", bson.D{{"$gt", after}}}}
+	opts := options.Find().SetSort(bson.D{{"_id", 1}}).SetLimit(int64(limit))
+	cursor, err := s.utxos.Find(context.TODO(), filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	var docs []utxoDoc
+	if err = cursor.All(context.TODO(), &docs); err != nil {
+		return nil, err
+	}
+	results := make([]UTXO, 0, len(docs))
+	for _, d := range docs {
+		results = append(results, d.UTXO)
+	}
+	return results, nil
+}
+
+func (s *mongoStore) UpdateUTXO(spent []string, created []UTXO) error {
+	return s.updateUTXO(context.TODO(), spent, created)
+}
+
+func (s *mongoStore) updateUTXO(ctx context.Context, spent []string, created []UTXO) error {
+	if len(spent) > 0 {
+		_, err := s.utxos.DeleteMany(ctx, bson.D{{"_id", bson.D{{"$in", spent}}}})
+		if err != nil {
+			return err
+		}
+	}
+	if len(created) > 0 {
+		docs := make([]interface{}, 0, len(created))
+		for _, u := range created {
+			docs = append(docs, utxoDoc{u.Key(), u})
+		}
+		_, err := s.utxos.InsertMany(ctx, docs)
+		return err
+	}
+	return nil
+}
+
+func (s *mongoStore) ResetUTXO() error {
+	_, err := s.utxos.DeleteMany(context.TODO(), bson.D{})
+	return err
+}
+
+func (s *mongoStore) FindRecords(userid string, since, until int64) ([]Record, error) {
+	filter := bson.D{{"$or", bson.A{bson.D{{"from", userid}}, bson.D{{"to", userid}}}}}
+	timeRange := bson.D{}
+	if since != 0 {
+		timeRange = append(timeRange, bson.E{"$gte", since})
+	}
+	if until != 0 {
+		timeRange = append(timeRange, bson.E{"$lt", until})
+	}
+	if len(timeRange) > 0 {
+		filter = append(filter, bson.E{"timestamp", timeRange})
+	}
+	cursor, err := s.records.Find(context.Background(), filter)
+	if err != nil {
+		return nil, err
+	}
+	var results []Record
+	err = cursor.All(context.TODO(), &results)
+	return results, err
+}
+
+func (s *mongoStore) DeleteRecords(txids []string) ([]Record, error) {
+	if len(txids) == 0 {
+		return nil, nil
+	}
+	filter := bson.D{{"txid", bson.D{{"$in", txids}}}}
+	cursor, err := s.records.Find(context.Background(), filter)
+	if err != nil {
+		return nil, err
+	}
+	var deleted []Record
+	if err := cursor.All(context.TODO(), &deleted); err != nil {
+		return nil, err
+	}
+	_, err = s.records.DeleteMany(context.Background(), filter)
+	return deleted, err
+}
+
+// Close 不断开连接，MongoDB 客户端由 database 包管理
+func (s *mongoStore) Close() error {
+	return nil
+}
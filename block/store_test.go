@@ -0,0 +1,57 @@
+package block
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestUTXOPage(t *testing.T) {
+	var utxos []UTXO
+	for _, txid := range []string{"c", "a", "b"} {
+		for vout := 0; vout < 2; vout++ {
+			utxos = append(utxos, UTXO{txid, vout, 1, "alice", "", 0})
+		}
+	}
+	utxos = append(utxos, UTXO{"a", 2, 1, "bob", "", 0})
+
+	bolt, err := NewBoltStore(filepath.Join(t.TempDir(), "chain.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bolt.Close()
+	stores := map[string]ChainStore{"memory": NewMemoryStore(), "bolt": bolt}
+
+	tests := []struct {
+		address string
+		after   string
+		limit   int
+		want    []string
+	}{
+		{"alice", "", 10, []string{"a:0", "a:1", "b:0", "b:1", "c:0", "c:1"}},
+		{"alice", "", 2, []string{"a:0", "a:1"}},
+		{"alice", "a:1", 3, []string{"b:0", "b:1", "c:0"}},
+		// after 不一定是已有的 UTXO
+		{"alice", "b", 10, []string{"b:0", "b:1", "c:0", "c:1"}},
+		{"alice", "c:1", 10, []string{}},
+		{"bob", "", 10, []string{"a:2"}},
+		{"carol", "", 10, []string{}},
+	}
+	for name, s := range stores {
+		if err := s.UpdateUTXO(nil, utxos); err != nil {
+			t.Fatal(err)
+		}
+		for _, tt := range tests {
+			got, err := s.UTXOPage(tt.address, tt.after, tt.limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			keys := []string{}
+			for _, u := range got {
+				keys = append(keys, u.Key())
+			}
+			if !sameKeys(keys, tt.want) {
+				t.Errorf("%s: UTXOPage(%q, %q, %d) = %v, want %v", name, tt.address, tt.after, tt.limit, keys, tt.want)
+			}
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package block
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// 区块和交易记录的时间戳都是 Unix 秒，接口返回时格式化为 RFC 3339
+
+func formatTimestamp(ts int64) string {
+	return time.Unix(ts, 0).UTC().Format(time.RFC3339)
+}
+
+func parseTimestamp(s string) (int64, error) {
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return 0, err
+	}
+	return t.Unix(), nil
+}
+
+// medianTime 返回最近 MedianTimeSpan 个区块时间戳的中位数，prev 按 index 升序排列
+func medianTime(prev []Block) int64 {
+	if len(prev) == 0 {
+		return 0
+	}
+	if n := Consensus.MedianTimeSpan; n > 0 && len(prev) > n {
+		prev = prev[len(prev)-n:]
+	}
+	times := make([]int64, len(prev))
+	for i, b := range prev {
+		times[i] = b.Timestamp
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+	return times[len(times)/2]
+}
+
+// nextTimestamp 返回新区块使用的时间戳: 当前时间，但至少比最近区块的中位时间大 1 秒
+func nextTimestamp(prev []Block, now time.Time) int64 {
+	ts := now.Unix()
+	if median := medianTime(prev); len(prev) > 0 && ts <= median {
+		ts = median + 1
+	}
+	return ts
+}
+
+// checkTimestamp 检查区块时间戳必须晚于最近区块的中位时间，并且不能超过当前时间 MaxFutureDrift
+func checkTimestamp(b Block, prev []Block, now time.Time) error {
+	if len(prev) > 0 {
+		if median := medianTime(prev); b.Timestamp <= median {
+			return fmt.Errorf("timestamp %s is not after median time %s", formatTimestamp(b.Timestamp), formatTimestamp(median))
+		}
+	}
+	if limit := now.Add(Consensus.MaxFutureDrift).Unix(); b.Timestamp > limit {
+		return fmt.Errorf("timestamp %s is too far in the future", formatTimestamp(b.Timestamp))
+	}
+	return nil
+}
+
+// MarshalJSON 把时间戳输出为 RFC 3339
+func (b Block) MarshalJSON() ([]byte, error) {
+	type alias Block
+	return json.Marshal(struct {
+		alias
+		Timestamp string
+	}{alias(b), formatTimestamp(b.Timestamp)})
+}
+
+func (b *Block) UnmarshalJSON(data []byte) error {
+	type alias Block
+	aux := struct {
+		*alias
+		Timestamp string
+	}{alias: (*alias)(b)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	ts, err := parseTimestamp(aux.Timestamp)
+	if err != nil {
+		return err
+	}
+	b.Timestamp = ts
+	return nil
+}
+
+// MarshalJSON 把时间戳输出为 RFC 3339
+func (r Record) MarshalJSON() ([]byte, error) {
+	type alias Record
+	return json.Marshal(struct {
+		alias
+		Timestamp string `json:"timestamp"`
+	}{alias(r), formatTimestamp(r.Timestamp)})
+}
+
+func (r *Record) UnmarshalJSON(data []byte) error {
+	type alias Record
+	aux := struct {
+		*alias
+		Timestamp string `json:"timestamp"`
+	}{alias: (*alias)(r)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	ts, err := parseTimestamp(aux.Timestamp)
+	if err != nil {
+		return err
+	}
+	r.Timestamp = ts
+	return nil
+}
+
+// inRange 检查记录时间是否在 [since, until) 内，0 表示不限制
+func (r Record) inRange(since, until int64) bool {
+	return (since == 0 || r.Timestamp >= since) && (until == 0 || r.Timestamp < until)
+}
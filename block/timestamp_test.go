@@ -0,0 +1,120 @@
+package block
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// timedBlocks 返回时间戳依次为 times 的区块
+func timedBlocks(times ...int64) []Block {
+	blocks := make([]Block, len(times))
+	for i, ts := range times {
+		blocks[i] = Block{Index: i, Timestamp: ts}
+	}
+	return blocks
+}
+
+func TestMedianTime(t *testing.T) {
+	span := Consensus.MedianTimeSpan
+	many := make([]int64, span+5)
+	for i := range many {
+		many[i] = int64(i)
+	}
+	tests := []struct {
+		name string
+		prev []Block
+		want int64
+	}{
+		{"empty", nil, 0},
+		{"one block", timedBlocks(100), 100},
+		{"unsorted", timedBlocks(300, 100, 200), 200},
+		{"even count takes upper middle", timedBlocks(100, 400, 200, 300), 300},
+		// 只看最近 MedianTimeSpan 个区块
+		{"longer than span", timedBlocks(many...), many[len(many)-span/2-1]},
+	}
+	for _, tt := range tests {
+		if got := medianTime(tt.prev); got != tt.want {
+			t.Errorf("%s: medianTime = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestNextTimestamp(t *testing.T) {
+	now := time.Unix(1000, 0)
+	tests := []struct {
+		name string
+		prev []Block
+		want int64
+	}{
+		{"no blocks", nil, 1000},
+		{"clock ahead of median", timedBlocks(900, 950, 990), 1000},
+		{"median equals now", timedBlocks(1000, 1000, 1000), 1001},
+		{"median in the future", timedBlocks(1100, 1200, 1300), 1201},
+	}
+	for _, tt := range tests {
+		if got := nextTimestamp(tt.prev, now); got != tt.want {
+			t.Errorf("%s: nextTimestamp = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCheckTimestamp(t *testing.T) {
+	now := time.Unix(100000, 0)
+	drift := int64(Consensus.MaxFutureDrift.Seconds())
+	prev := timedBlocks(100, 200, 300)
+	tests := []struct {
+		name string
+		ts   int64
+		prev []Block
+		ok   bool
+	}{
+		{"after median", 201, prev, true},
+		{"equal to median", 200, prev, false},
+		{"before median", 150, prev, false},
+		// 可以早于前一个区块，只要晚于中位时间
+		{"before previous block", 250, prev, true},
+		{"at drift limit", now.Unix() + drift, prev, true},
+		{"beyond drift limit", now.Unix() + drift + 1, prev, false},
+		{"genesis", 0, nil, true},
+	}
+	for _, tt := range tests {
+		err := checkTimestamp(Block{Timestamp: tt.ts}, tt.prev, now)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: checkTimestamp(%d) = %v, want ok %v", tt.name, tt.ts, err, tt.ok)
+		}
+	}
+}
+
+func TestTimestampJSON(t *testing.T) {
+	b := Block{Index: 1, Timestamp: 1672531200, Hash: "h"}
+	data, err := json.Marshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]interface{}
+	json.Unmarshal(data, &fields)
+	if fields["Timestamp"] != "2023-01-01T00:00:00Z" {
+		t.Errorf("block JSON timestamp = %v, want 2023-01-01T00:00:00Z", fields["Timestamp"])
+	}
+	var decoded Block
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Timestamp != b.Timestamp || decoded.Hash != b.Hash {
+		t.Errorf("decoded block = %+v, want %+v", decoded, b)
+	}
+
+	r := Record{Timestamp: 1672531200, From: "alice", To: "bob", Amount: 3, Txid: "t"}
+	data, err = json.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decodedRecord Record
+	if err := json.Unmarshal(data, &decodedRecord); err != nil {
+		t.Fatal(err)
+	}
+	if decodedRecord != r {
+		t.Errorf("decoded record = %+v, want %+v", decodedRecord, r)
+	}
+}
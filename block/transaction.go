@@ -1,15 +1,16 @@
 package block
 
 import (
-	"BlockChain/database"
+	"BlockChain/wallet"
 	"bytes"
-	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/gob"
 	"encoding/hex"
-	"github.com/sirupsen/logrus"
-	"go.mongodb.org/mongo-driver/bson"
-	"log"
+	"fmt"
+	"math/big"
 )
 
 // Transaction 由交易 ID，输入和输出构成
@@ -19,188 +20,191 @@ type Transaction struct {
 	Vout []TXOutput `bson:"vout"`
 }
 
-// TXInput 包含 3 部分
+// TXInput 包含 4 部分
 // Txid: 一个交易输入引用了之前一笔交易的一个输出, ID 表明是之前哪笔交易
 // Vout: 一笔交易可能有多个输出，Vout 为输出的索引
-// ScriptSig: 提供解锁输出 Txid:Vout 的数据
+// Signature: 花费者用私钥对交易的签名
+// PubKey: 花费者的公钥，它的哈希必须等于被引用输出锁定的公钥哈希
 type TXInput struct {
 	Txid      string `bson:"txid"`
 	Vout      int    `bson:"vout"`
-	ScriptSig string `bson:"scriptSig"`
+	Signature []byte `bson:"signature"`
+	PubKey    []byte `bson:"pubKey"`
 }
 
 // TXOutput 包含两部分
 // Value: 有多少币，就是存储在 Value 里面
-// ScriptPubKey: 对输出进行锁定: （目前版本的实现）货币的拥有者，也就是地址
-// 在当前实现中，ScriptPubKey 将仅用一个字符串来代替
+// ScriptPubKey: 对输出进行锁定: 货币拥有者的钱包地址，地址由公钥哈希生成
+// 物品输出的 Asset 是物品 id，Quantity 是数量，Value 为 0；币的输出 Asset 为空
+// 输出是否被花费不再写回区块，而是由 UTXO 集合记录
 type TXOutput struct {
 	Value        int    `bson:"value"`
 	ScriptPubKey string `bson:"scriptPubKey"`
-	Ifused       bool   `bson:"ifused"`
+	Asset        string `bson:"asset,omitempty" json:",omitempty"`
+	Quantity     int    `bson:"quantity,omitempty" json:",omitempty"`
 }
 
+// Record 是一条转账记录，Timestamp 是 Unix 秒，JSON 中为 RFC 3339
 type Record struct {
-	Timestamp string `bson:"timestamp" json:"timestamp"`
+	Timestamp int64  `bson:"timestamp" json:"timestamp"`
 	From      string `bson:"from" json:"from"`
 	To        string `bson:"to" json:"to"`
 	Amount    int    `bson:"amount" json:"amount"`
 	Txid      string `bson:"txid" json:"txid"`
 }
 
-// CanUnlockOutputWith 这里的 unlockingData 可以理解为地址
-func (in *TXInput) CanUnlockOutputWith(unlockingData string) bool {
-	return in.ScriptSig == unlockingData
+// UsesKey 检查输入使用的公钥哈希是否为 pubKeyHash
+func (in *TXInput) UsesKey(pubKeyHash []byte) bool {
+	return bytes.Equal(wallet.HashPubKey(in.PubKey), pubKeyHash)
 }
 
-func (out *TXOutput) CanBeUnlockedWith(unlockingData string) bool {
-	return out.ScriptPubKey == unlockingData
+// IsLockedWithKey 检查输出是否锁定给 pubKeyHash
+func (out *TXOutput) IsLockedWithKey(pubKeyHash []byte) bool {
+	lockingHash := wallet.PubKeyHash(out.ScriptPubKey)
+	return lockingHash != nil && bytes.Equal(lockingHash, pubKeyHash)
 }
 
 // NewCoinbaseTX coinbase 交易只有一个输出，没有输入。
 // 在我们的实现中，它表现为 Txid 为空，Vout 等于 -1。
-// 并且，在当前实现中，coinbase 交易也没有在 ScriptSig 中存储脚本，
-// 而只是存储了一个任意的字符串 data。
+// 并且 coinbase 交易不需要签名，PubKey 中只存储了一个任意的字符串 data。
+// data 里带上随机数，保证给同一个人同样奖励的 coinbase 交易 ID 也不相同，
+// 否则它们在 UTXO 集合中会互相覆盖。
 func NewCoinbaseTX(to string, amount int) Transaction {
 
-	txin := TXInput{"", -1, "genesis"}
+	randData := make([]byte, 16)
+	rand.Read(randData)
+	txin := TXInput{"", -1, nil, []byte(fmt.Sprintf("genesis %x", randData))}
 	// subsidy = 10, 第一个coinbase交易的奖励是10个币
-	txout := TXOutput{amount, to, false}
+	txout := TXOutput{Value: amount, ScriptPubKey: to}
 	tx := Transaction{"", []TXInput{txin}, []TXOutput{txout}}
 	tx.SetID()
 
 	return tx
 }
 
-func (tx *Transaction) SetID() {
+// IsCoinbase 判断交易是否为 coinbase 交易
+func (tx Transaction) IsCoinbase() bool {
+	return len(tx.Vin) == 1 && tx.Vin[0].Txid == "" && tx.Vin[0].Vout == -1
+}
+
+// Hash 计算 ID 为空时交易的哈希，也就是 SetID 写入的交易 ID
+func (tx Transaction) Hash() string {
 	var encoded bytes.Buffer
 	var hash [32]byte
 
-	enc := gob.NewEncoder(&encoded)
-	err := enc.Encode(tx)
-	if err != nil {
-		log.Panic(err)
-	}
+	tx.ID = ""
+	// 交易只包含字符串、整数和字节切片，编码到 bytes.Buffer 不会出错
+	_ = gob.NewEncoder(&encoded).Encode(tx)
 	hash = sha256.Sum256(encoded.Bytes())
-	tx.ID = hex.EncodeToString(hash[:])
+	return hex.EncodeToString(hash[:])
 }
 
-func NewTransaction(timestamp string, from, to string, amount int) Transaction {
-	var inputs []TXInput
-	var outputs []TXOutput
-	// 1. 找到足够的钱
-	// 2. 创建输入
-	// 3. 创建输出
-	// 4. 创建交易
-	acc, validOutputs := FindSpendableOutputs(from, amount)
-	if acc < amount {
-		log.Panic("ERROR: Not enough funds")
-	}
-	// Build a list of inputs
-	for txid, outs := range validOutputs {
-
-		for _, out := range outs {
-			input := TXInput{txid, out, from}
-			inputs = append(inputs, input)
-		}
-	}
+func (tx *Transaction) SetID() {
+	tx.ID = tx.Hash()
+}
 
-	outputs = append(outputs, TXOutput{amount, to, false})
-	if acc > amount {
-		outputs = append(outputs, TXOutput{acc - amount, from, false}) // a change
+// TrimmedCopy 返回去掉签名和公钥的交易副本，签名和验证都针对这个副本
+func (tx *Transaction) TrimmedCopy() Transaction {
+	var inputs []TXInput
+	for _, vin := range tx.Vin {
+		inputs = append(inputs, TXInput{vin.Txid, vin.Vout, nil, nil})
 	}
+	outputs := make([]TXOutput, len(tx.Vout))
+	copy(outputs, tx.Vout)
+	return Transaction{tx.ID, inputs, outputs}
+}
 
-	tx := Transaction{"", inputs, outputs}
-	tx.SetID()
-
-	InsertRecord(timestamp, from, to, amount, tx.ID)
-	return tx
+// signatureHash 计算第 inID 个输入要签名的数据:
+// 副本中只有这个输入的 PubKey 被设置为被引用输出的锁定地址
+func (tx *Transaction) signatureHash(txCopy Transaction, inID int, prevOut TXOutput) []byte {
+	txCopy.Vin[inID].PubKey = []byte(prevOut.ScriptPubKey)
+	hash, _ := hex.DecodeString(txCopy.Hash())
+	txCopy.Vin[inID].PubKey = nil
+	return hash
 }
 
-// FindSpendableOutputs 为用户 address 找到足够 amount 的输出
-func FindSpendableOutputs(address string, amount int) (int, map[string][]int) {
-	unspentOutputs := make(map[string][]int)
-	accumulated := 0
-
-	Blocks := FindAllBlocks()
-	logrus.Info("FindSpendableOutputs: ", address, amount)
-Work:
-	for _, block := range Blocks {
-		tx := block.Transactions
-		tx2 := block.Transactions
-		flag := false
-		for id, out := range tx.Vout {
-			if out.ScriptPubKey == address && out.Ifused == false {
-				unspentOutputs[tx.ID] = append(unspentOutputs[tx.ID], id)
-				accumulated += out.Value
-				flag = true
-				tx2.Vout[id].Ifused = true
-
-				if accumulated >= amount {
-					if flag {
-						hash := block.Hash
-						updateUsed(tx2, hash)
-					}
-					break Work
-				}
-			}
+// Sign 用私钥对引用的输出属于这个私钥的输入签名，prevOutputs 以 txid:vout 为键保存被引用的输出。
+// 有多个付款人的交易由每个付款人分别签名。
+func (tx *Transaction) Sign(privKey ecdsa.PrivateKey, prevOutputs map[string]TXOutput) error {
+	if tx.IsCoinbase() {
+		return nil
+	}
+	pubKey := append(privKey.PublicKey.X.FillBytes(make([]byte, 32)), privKey.PublicKey.Y.FillBytes(make([]byte, 32))...)
+	pubKeyHash := wallet.HashPubKey(pubKey)
+	txCopy := tx.TrimmedCopy()
+	for inID, vin := range tx.Vin {
+		prevOut, ok := prevOutputs[outpoint(vin.Txid, vin.Vout)]
+		if !ok {
+			return ErrDoubleSpend
+		}
+		if !prevOut.IsLockedWithKey(pubKeyHash) {
+			continue
 		}
-		if flag {
-			hash := block.Hash
-			updateUsed(tx2, hash)
+		r, s, err := ecdsa.Sign(rand.Reader, &privKey, tx.signatureHash(txCopy, inID, prevOut))
+		if err != nil {
+			return err
 		}
+		signature := append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+		tx.Vin[inID].Signature = signature
 	}
-	return accumulated, unspentOutputs
+	return nil
 }
 
-func updateUsed(tx Transaction, hash string) {
-	client := database.Mgo.Client
-	collection := client.Database("BlockChain").Collection("Block")
-	filter := bson.D{{"hash", hash}}
-	update := bson.D{{"$set", bson.D{{"transaction", tx}}}}
-	_, err := collection.UpdateOne(context.TODO(), filter, update)
-	if err != nil {
-		logrus.Info("MgoDB: find block error: ", err)
+// Verify 检查每个输入的公钥是否拥有被引用的输出，以及签名是否有效
+func (tx *Transaction) Verify(prevOutputs map[string]TXOutput) bool {
+	if tx.IsCoinbase() {
+		return true
 	}
-}
-
-func GetBalance(Userid string) int {
-	balance := 0
-	Blocks := FindAllBlocks()
-	for _, block := range Blocks {
-		tx := block.Transactions
-		for _, out := range tx.Vout {
-			if out.ScriptPubKey == Userid && out.Ifused == false {
-				balance += out.Value
-			}
+	txCopy := tx.TrimmedCopy()
+	curve := elliptic.P256()
+	for inID, vin := range tx.Vin {
+		prevOut, ok := prevOutputs[outpoint(vin.Txid, vin.Vout)]
+		if !ok || !prevOut.IsLockedWithKey(wallet.HashPubKey(vin.PubKey)) {
+			return false
+		}
+		if len(vin.Signature) != 64 || len(vin.PubKey) != 64 {
+			return false
+		}
+		r := new(big.Int).SetBytes(vin.Signature[:32])
+		s := new(big.Int).SetBytes(vin.Signature[32:])
+		x := new(big.Int).SetBytes(vin.PubKey[:32])
+		y := new(big.Int).SetBytes(vin.PubKey[32:])
+		if !curve.IsOnCurve(x, y) {
+			return false
+		}
+		rawPubKey := ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+		if !ecdsa.Verify(&rawPubKey, tx.signatureHash(txCopy, inID, prevOut), r, s) {
+			return false
 		}
 	}
-	return balance
+	return true
 }
 
-func FindAllTransactionRecords(Userid string) []Record {
-	client := database.Mgo.Client
-	collection := client.Database("BlockChain").Collection("Transaction")
-	filter := bson.D{{"$or", bson.A{bson.D{{"from", Userid}}, bson.D{{"to", Userid}}}}}
-	cursor, err := collection.Find(context.Background(), filter)
-	if err != nil {
-		logrus.Info("MgoDB: find record error: ", err)
+// GetBalance 返回 UTXO 集合中属于 Userid 钱包的余额，不包括交易池中的交易
+func GetBalance(Userid string) (int, error) {
+	balance := 0
+	w, ok := wallet.Find(Userid)
+	if !ok {
+		return balance, nil
 	}
-	var results []Record
-	if err = cursor.All(context.TODO(), &results); err != nil {
-		logrus.Info("MgoDB: find record error: ", err)
+	utxos, err := FindUTXOs(w.GetAddress())
+	if err != nil {
+		return 0, err
 	}
-	for _, result := range results {
-		cursor.Decode(&result)
+	for _, u := range utxos {
+		balance += u.Value
 	}
-	return results
+	return balance, nil
 }
 
-func InsertRecord(timestamp string, from, to string, amount int, txid string) {
-	client := database.Mgo.Client
-	collection := client.Database("BlockChain").Collection("Transaction")
-	record := Record{timestamp, from, to, amount, txid}
-	_, err := collection.InsertOne(context.Background(), record)
-	if err != nil {
-		logrus.Info("MgoDB: insert record error: ", err)
-	}
+func FindAllTransactionRecords(Userid string) ([]Record, error) {
+	return FindTransactionRecords(Userid, 0, 0)
+}
+
+// FindTransactionRecords 返回 Userid 在 [since, until) 时间范围内的交易记录，0 表示不限制
+func FindTransactionRecords(Userid string, since, until int64) ([]Record, error) {
+	chainMu.RLock()
+	defer chainMu.RUnlock()
+
+	return store.FindRecords(Userid, since, until)
 }
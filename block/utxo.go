@@ -0,0 +1,162 @@
+package block
+
+import (
+	"github.com/sirupsen/logrus"
+	"strconv"
+	"strings"
+)
+
+// UTXO 是一个还没有被花费的交易输出，在 UTXO 集合里以 txid:vout 为键。
+// 物品输出的 Asset 和 Quantity 是物品 id 和数量
+type UTXO struct {
+	Txid         string `bson:"txid" json:"txid"`
+	Vout         int    `bson:"vout" json:"vout"`
+	Value        int    `bson:"value" json:"value"`
+	ScriptPubKey string `bson:"scriptPubKey" json:"scriptPubKey"`
+	Asset        string `bson:"asset,omitempty" json:"asset,omitempty"`
+	Quantity     int    `bson:"quantity,omitempty" json:"quantity,omitempty"`
+}
+
+func newUTXO(txid string, vout int, out TXOutput) UTXO {
+	return UTXO{txid, vout, out.Value, out.ScriptPubKey, out.Asset, out.Quantity}
+}
+
+// Key 返回 UTXO 在集合中的键
+func (u UTXO) Key() string {
+	return outpoint(u.Txid, u.Vout)
+}
+
+// Output 返回 UTXO 对应的交易输出
+func (u UTXO) Output() TXOutput {
+	return TXOutput{u.Value, u.ScriptPubKey, u.Asset, u.Quantity}
+}
+
+func outpoint(txid string, vout int) string {
+	return txid + ":" + strconv.Itoa(vout)
+}
+
+// utxoChanges 计算区块对 UTXO 集合的影响: 被花掉的输出和新产生的输出。
+// 同一个区块内产生又被花掉的输出两边都不出现。
+func utxoChanges(b Block) ([]string, []UTXO) {
+	created := make(map[string]UTXO)
+	var order []string
+	var spent []string
+	for _, tx := range b.Transactions {
+		if !tx.IsCoinbase() {
+			for _, in := range tx.Vin {
+				if in.IsIssue() {
+					continue
+				}
+				key := outpoint(in.Txid, in.Vout)
+				if _, ok := created[key]; ok {
+					delete(created, key)
+				} else {
+					spent = append(spent, key)
+				}
+			}
+		}
+		for id, out := range tx.Vout {
+			u := newUTXO(tx.ID, id, out)
+			created[u.Key()] = u
+			order = append(order, u.Key())
+		}
+	}
+	var utxos []UTXO
+	for _, key := range order {
+		if u, ok := created[key]; ok {
+			utxos = append(utxos, u)
+		}
+	}
+	return spent, utxos
+}
+
+// updateUTXOSet 把区块对 UTXO 集合的影响写入存储，重建 UTXO 集合时使用
+func updateUTXOSet(b Block) error {
+	spent, created := utxoChanges(b)
+	return store.UpdateUTXO(spent, created)
+}
+
+// undoUTXOSet 撤销区块对 UTXO 集合的影响: 删除区块产生的输出，恢复区块花掉的输出。
+// 被花掉的输出从主链上产生它的交易中找回，所以需要从链尾开始逐个撤销。
+func undoUTXOSet(b Block) error {
+	spent, created := utxoChanges(b)
+	restored := make([]UTXO, 0, len(spent))
+	for _, key := range spent {
+		i := strings.LastIndex(key, ":")
+		txid := key[:i]
+		vout, _ := strconv.Atoi(key[i+1:])
+		src, err := store.BlockByTxid(txid)
+		if err != nil {
+			return err
+		}
+		for _, tx := range src.Transactions {
+			if tx.ID == txid && vout < len(tx.Vout) {
+				out := tx.Vout[vout]
+				restored = append(restored, newUTXO(txid, vout, out))
+			}
+		}
+	}
+	keys := make([]string, len(created))
+	for i, u := range created {
+		keys[i] = u.Key()
+	}
+	return store.UpdateUTXO(keys, restored)
+}
+
+// utxoView 从 UTXO 集合中取出区块的输入引用的输出，用于验证区块中的交易
+func utxoView(b Block) map[string]TXOutput {
+	view := make(map[string]TXOutput)
+	for _, tx := range b.Transactions {
+		if tx.IsCoinbase() {
+			continue
+		}
+		for _, in := range tx.Vin {
+			if in.IsIssue() {
+				continue
+			}
+			key := outpoint(in.Txid, in.Vout)
+			if u, err := store.FindUTXO(key); err == nil {
+				view[key] = u.Output()
+			}
+		}
+	}
+	return view
+}
+
+// Reindex 清空 UTXO 集合，并从创世区块开始按顺序重新计算
+func Reindex() (err error) {
+	write(func() {
+		chainMu.Lock()
+		defer chainMu.Unlock()
+		err = reindex()
+	})
+	return err
+}
+
+func reindex() error {
+	blocks, err := store.AllBlocks()
+	if err != nil {
+		return err
+	}
+	if err := store.ResetUTXO(); err != nil {
+		return err
+	}
+	for _, b := range blocks {
+		if err := updateUTXOSet(b); err != nil {
+			return err
+		}
+	}
+	logrus.Info("ChainStore: Reindex UTXO set from ", len(blocks), " blocks")
+	return nil
+}
+
+// FindUTXOs 返回 address 在 UTXO 集合中的全部输出，不包括交易池中的交易
+func FindUTXOs(address string) ([]UTXO, error) {
+	chainMu.RLock()
+	defer chainMu.RUnlock()
+	return findUTXOs(address)
+}
+
+func findUTXOs(address string) ([]UTXO, error) {
+	return store.FindUTXOs(address)
+}
@@ -0,0 +1,132 @@
+package block
+
+import (
+	"fmt"
+	"time"
+)
+
+// VerifyResult 是 VerifyChain 的结果，链无效时 BadIndex/BadHash/Reason 指出第一个出错的区块
+type VerifyResult struct {
+	Valid    bool   `json:"valid"`
+	Blocks   int    `json:"blocks"`
+	BadIndex int    `json:"badIndex,omitempty"`
+	BadHash  string `json:"badHash,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// VerifyChain 从创世区块开始检查整条链:
+// 区块哈希、PrevHash 链接、index 连续、时间戳、工作量证明、交易 ID、签名、双花、物品数量和挖矿奖励。
+// 遇到第一个有问题的区块就停止，并在结果中给出原因。
+func VerifyChain() (VerifyResult, error) {
+	chainMu.RLock()
+	blocks, err := store.AllBlocks()
+	chainMu.RUnlock()
+	if err != nil {
+		return VerifyResult{}, err
+	}
+	result := VerifyResult{Valid: true, Blocks: len(blocks)}
+	if len(blocks) == 0 {
+		return result, nil
+	}
+
+	// utxos 是验证到当前区块为止的 UTXO 集合，seen 是已经验证过的交易
+	utxos := make(map[string]TXOutput)
+	seen := make(map[string]bool)
+	known := func(txid string) bool { return seen[txid] }
+	now := time.Now()
+	for i, b := range blocks {
+		var err error
+		if i == 0 {
+			err = verifyGenesis(b)
+		} else {
+			err = validateBlock(b, blocks[i-1])
+			if err == nil {
+				err = checkTimestamp(b, blocks[:i], now)
+			}
+			if err == nil {
+				err = verifyProofOfWork(b, blocks[:i])
+			}
+		}
+		if err == nil {
+			err = verifyTransactions(b, utxos, known)
+		}
+		if err != nil {
+			result.Valid = false
+			result.BadIndex = b.Index
+			result.BadHash = b.Hash
+			result.Reason = err.Error()
+			return result, nil
+		}
+		for _, tx := range b.Transactions {
+			seen[tx.ID] = true
+		}
+	}
+	return result, nil
+}
+
+func verifyGenesis(b Block) error {
+	if b.Index != 0 || b.PrevHash != "" {
+		return fmt.Errorf("genesis block must have index 0 and empty prevHash")
+	}
+	if err := validateBlockHash(b); err != nil {
+		return err
+	}
+	return verifyProofOfWork(b, nil)
+}
+
+// verifyTransactions 检查区块中的交易，并把区块的影响应用到 utxos 上。
+// known 判断交易是否已经在之前的区块中，只有发行输入的交易不花费输出，不能靠 UTXO 防止重放。
+// 区块最多一个 coinbase 交易，它的输出不能超过区块奖励加上区块中交易的手续费
+func verifyTransactions(b Block, utxos map[string]TXOutput, known func(txid string) bool) error {
+	inBlock := make(map[string]bool)
+	fees := 0
+	for i, tx := range b.Transactions {
+		if tx.Hash() != tx.ID {
+			return fmt.Errorf("transaction %s: id does not match its content", tx.ID)
+		}
+		if inBlock[tx.ID] || known(tx.ID) {
+			return fmt.Errorf("transaction %s: already in chain", tx.ID)
+		}
+		inBlock[tx.ID] = true
+		if tx.IsCoinbase() {
+			if i != 0 {
+				return fmt.Errorf("transaction %s: coinbase must be the first transaction", tx.ID)
+			}
+		} else {
+			if err := checkOutputs(tx); err != nil {
+				return fmt.Errorf("transaction %s: %v", tx.ID, err)
+			}
+			prevOutputs := make(map[string]TXOutput)
+			for _, vin := range tx.Vin {
+				key := outpoint(vin.Txid, vin.Vout)
+				if vin.IsIssue() {
+					prevOutputs[key] = issuerOutput()
+					continue
+				}
+				out, ok := utxos[key]
+				if !ok {
+					return fmt.Errorf("transaction %s: input %s is already spent or does not exist", tx.ID, key)
+				}
+				prevOutputs[key] = out
+				delete(utxos, key)
+			}
+			fee, err := checkAmounts(tx, prevOutputs)
+			if err != nil {
+				return fmt.Errorf("transaction %s: %v", tx.ID, err)
+			}
+			fees += fee
+			if !tx.Verify(prevOutputs) {
+				return fmt.Errorf("transaction %s: invalid signature", tx.ID)
+			}
+		}
+		for id, vout := range tx.Vout {
+			utxos[outpoint(tx.ID, id)] = vout
+		}
+	}
+	if len(b.Transactions) > 0 && b.Transactions[0].IsCoinbase() {
+		if err := checkCoinbase(b.Transactions[0], b.Index, fees); err != nil {
+			return fmt.Errorf("transaction %s: %v", b.Transactions[0].ID, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package commodity
+
+import (
+	"BlockChain/database"
+	"context"
+	"encoding/json"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"os"
+)
+
+// 物品分类
+const (
+	CategoryShop       = "shop"       // 商店出售的工具和宝石
+	CategoryRestaurant = "restaurant" // 餐厅出售的食物
+	CategoryResource   = "resource"   // 采集得到的资源，不出售
+)
+
+// 工具的用途，Item.Tool 为空的物品不是工具
+const (
+	ToolFishing = "fishing"
+	ToolMining  = "mining"
+	ToolLogging = "logging"
+)
+
+// Item 是物品目录中的一种物品。Price 为 0 的物品不能在商店或餐厅购买。
+// 目录保存在 MongoDB 的 Item 集合中，增加物品不需要修改代码。
+type Item struct {
+	ID        string `bson:"id" json:"id"`
+	Name      string `bson:"name" json:"name"`
+	Category  string `bson:"category" json:"category"`
+	Price     int    `bson:"price" json:"price"`
+	Stock     int    `bson:"stock" json:"stock"`         // 商店或餐厅的库存
+	Stackable bool   `bson:"stackable" json:"stackable"` // 能否在背包中堆叠
+	Tool      string `bson:"tool" json:"tool,omitempty"` // 工具的用途: fishing / mining / logging
+	// Durability 是工具的耐久度，使用这么多次后损坏，为 0 时不会损坏
+	Durability int `bson:"durability" json:"durability,omitempty"`
+}
+
+// DefaultCatalog 是没有指定目录文件时初始化的物品目录
+var DefaultCatalog = []Item{
+	{"diamond", "Diamond", CategoryShop, 500, 100, true, "", 0},
+	{"axe", "Axe", CategoryShop, 30, 100, true, ToolLogging, 50},
+	{"pickaxe", "Pickaxe", CategoryShop, 50, 100, true, ToolMining, 30},
+	{"fishingrod", "Fishing rod", CategoryShop, 70, 100, true, ToolFishing, 50},
+	{"beer", "Beer", CategoryRestaurant, 7, 100, true, "", 0},
+	{"soda", "Soda", CategoryRestaurant, 3, 100, true, "", 0},
+	{"hamburger", "Hamburger", CategoryRestaurant, 10, 100, true, "", 0},
+	{"cola", "Cola", CategoryRestaurant, 3, 100, true, "", 0},
+	{"fish", "Fish", CategoryResource, 0, 0, true, "", 0},
+	{"log", "Log", CategoryResource, 0, 0, true, "", 0},
+}
+
+func itemCollection() *mongo.Collection {
+	return database.Mgo.Db.Collection("Item")
+}
+
+// LoadCatalogFile 读取 JSON 格式的物品目录文件，path 为空时返回 DefaultCatalog
+func LoadCatalogFile(path string) ([]Item, error) {
+	if path == "" {
+		return DefaultCatalog, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var catalog []Item
+	err = json.Unmarshal(data, &catalog)
+	return catalog, err
+}
+
+// InitCatalog 建立物品 id 上的唯一索引，并把目录中还不存在的物品写入 Item 集合。
+// 已经存在的物品不会被覆盖，价格和库存以数据库为准，只补上旧版本没有的耐久度。
+func InitCatalog(catalog []Item) error {
+	_, err := itemCollection().Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.D{{"id", 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return err
+	}
+	legacy := legacyStock()
+	for _, item := range catalog {
+		if stock, ok := legacy[item.ID]; ok {
+			item.Stock = stock
+		}
+		_, err := itemCollection().UpdateOne(context.Background(), bson.D{{"id", item.ID}},
+			bson.D{{"$setOnInsert", item}}, options.Update().SetUpsert(true))
+		if err != nil {
+			return err
+		}
+		// 旧版本的物品没有耐久度
+		_, err = itemCollection().UpdateOne(context.Background(),
+			bson.D{{"id", item.ID}, {"durability", bson.D{{"$exists", false}}}},
+			bson.D{{"$set", bson.D{{"durability", item.Durability}}}})
+		if err != nil {
+			return err
+		}
+	}
+	logrus.Info("MgoDB: Init item catalog success")
+	return nil
+}
+
+// Catalog 返回全部物品
+func Catalog() ([]Item, error) {
+	cursor, err := itemCollection().Find(context.Background(), bson.D{}, options.Find().SetSort(bson.D{{"id", 1}}))
+	if err != nil {
+		return nil, err
+	}
+	var results []Item
+	err = cursor.All(context.Background(), &results)
+	return results, err
+}
+
+// CatalogByCategory 返回分类 category 中的物品，以物品 id 为键
+func CatalogByCategory(category string) (map[string]Item, error) {
+	cursor, err := itemCollection().Find(context.Background(), bson.D{{"category", category}})
+	if err != nil {
+		return nil, err
+	}
+	var list []Item
+	if err = cursor.All(context.Background(), &list); err != nil {
+		return nil, err
+	}
+	results := make(map[string]Item, len(list))
+	for _, item := range list {
+		results[item.ID] = item
+	}
+	return results, nil
+}
+
+// FindItem 返回 id 对应的物品，不存在时返回 ErrUnknownItem
+func FindItem(id string) (Item, error) {
+	result := Item{}
+	err := itemCollection().FindOne(context.Background(), bson.D{{"id", id}}).Decode(&result)
+	if err == mongo.ErrNoDocuments {
+		return result, ErrUnknownItem
+	}
+	return result, err
+}
+
+// ForSale 返回商店和餐厅出售的物品（Price 大于 0）
+func ForSale() ([]Item, error) {
+	cursor, err := itemCollection().Find(context.Background(), bson.D{{"price", bson.D{{"$gt", 0}}}})
+	if err != nil {
+		return nil, err
+	}
+	var results []Item
+	err = cursor.All(context.Background(), &results)
+	return results, err
+}
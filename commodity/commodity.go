@@ -1,26 +1,52 @@
 package commodity
 
 import (
+	"BlockChain/block"
 	"BlockChain/database"
+	"BlockChain/wallet"
 	"context"
+	"errors"
 	"github.com/sirupsen/logrus"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
-	_ "go.mongodb.org/mongo-driver/mongo/options"
+	"math"
+	"sort"
 )
 
+// 节点自己使用的用户: 商店收取购买物品的币，默认也是物品的发行人；挂单的物品由托管用户保管
+const (
+	ShopID   = "shop"
+	EscrowID = "escrow"
+)
+
+var (
+	// ErrInvalidQuantity 表示物品数量是负数，或者数量太大、总价超出 int 的范围
+	ErrInvalidQuantity = errors.New("commodity: quantity is negative or too large")
+	// ErrUnknownUser 表示用户在本节点没有钱包
+	ErrUnknownUser = errors.New("commodity: user has no wallet")
+	// ErrUnknownItem 表示物品目录中没有这个物品
+	ErrUnknownItem = errors.New("commodity: unknown item")
+)
+
+// InsufficientError 表示背包或库存中的物品不够，这时数量没有被修改。
+// UserID 为空时是商店或餐厅的库存不够。
+type InsufficientError struct {
+	UserID string
+	Item   string
+}
+
+func (e *InsufficientError) Error() string {
+	if e.UserID == "" {
+		return e.Item + " is out of stock"
+	}
+	return e.Item + " is not enough"
+}
+
+// Commodity 是用户的背包，Items 以物品 id 为键保存数量。
+// 物品是链上的物品输出，背包由用户钱包的 UTXO 和交易池中的交易计算得到
 type Commodity struct {
-	UserID     string `bson:"userid" json:"userid"`
-	Diamond    int    `bson:"diamond" json:"diamond"`
-	Axe        int    `bson:"axe" json:"axe"`
-	Pickaxe    int    `bson:"pickaxe" json:"pickaxe"`
-	Fishingrod int    `bson:"fishingrod" json:"fishingrod"`
-	Beer       int    `bson:"beer" json:"beer"`
-	Soda       int    `bson:"soda" json:"soda"`
-	Hamburger  int    `bson:"hamburger" json:"hamburger"`
-	Cola       int    `bson:"cola" json:"cola"`
-	Fish       int    `bson:"fish" json:"fish"`
-	Log        int    `bson:"log" json:"log"`
+	UserID string         `bson:"userid" json:"userid"`
+	Items  map[string]int `bson:"items" json:"items"`
 }
 
 type Profile struct {
@@ -28,161 +54,236 @@ type Profile struct {
 	Balance   int       `bson:"balance" json:"balance"`
 }
 
-type Shop struct {
-	Diamond    Info `bson:"diamond" json:"diamond"`
-	Axe        Info `bson:"axe" json:"axe"`
-	Pickaxe    Info `bson:"pickaxe" json:"pickaxe"`
-	Fishingrod Info `bson:"fishingrod" json:"fishingrod"`
+// inventories 是旧版本保存背包的集合，只在迁移时使用
+func inventories() *mongo.Collection {
+	return database.Mgo.Db.Collection("Commodity")
 }
 
-type Restaurant struct {
-	Beer      Info `bson:"beer" json:"beer"`
-	Soda      Info `bson:"soda" json:"soda"`
-	Hamburger Info `bson:"hamburger" json:"hamburger"`
-	Cola      Info `bson:"cola" json:"cola"`
+// GetShopList 返回商店出售的物品，以物品 id 为键
+func GetShopList() (map[string]Item, error) {
+	return CatalogByCategory(CategoryShop)
 }
 
-type Info struct {
-	Stock int `bson:"stock" json:"stock"`
-	Price int `bson:"price" json:"price"`
+// GetRestaurantList 返回餐厅出售的物品，以物品 id 为键
+func GetRestaurantList() (map[string]Item, error) {
+	return CatalogByCategory(CategoryRestaurant)
 }
 
-func GetShopList() (Shop, error) {
-	client := database.Mgo.Client
-	collection := client.Database("BlockChain").Collection("Shop")
-	result := Shop{}
-	err := collection.FindOne(context.TODO(), bson.M{}).Decode(&result)
-	return result, err
+// GetPersonalInfo 返回用户链上的物品，用户没有钱包时返回 ErrUnknownUser
+func GetPersonalInfo(userid string) (Commodity, error) {
+	if _, ok := wallet.Find(userid); !ok {
+		return Commodity{userid, make(map[string]int)}, ErrUnknownUser
+	}
+	items, err := block.Assets(userid)
+	if err != nil {
+		return Commodity{userid, make(map[string]int)}, err
+	}
+	return Commodity{userid, items}, nil
 }
 
-func GetRestaurantList() (Restaurant, error) {
-	client := database.Mgo.Client
-	collection := client.Database("BlockChain").Collection("Restaurant")
-	result := Restaurant{}
-	err := collection.FindOne(context.TODO(), bson.M{}).Decode(&result)
-	return result, err
+// AddItems 发行 items 中的物品给用户，交易进入交易池后就可以使用
+func AddItems(userid string, items map[string]int) error {
+	ids, err := sortedIDs(items)
+	if err != nil || len(ids) == 0 {
+		return err
+	}
+	b := block.NewTxBuilder()
+	for _, id := range ids {
+		if err := b.Issue(userid, id, items[id]); err != nil {
+			return err
+		}
+	}
+	return submit(b, "Issue items to "+userid)
 }
 
-func GetPersonalInfo(userid string) (Commodity, error) {
-	client := database.Mgo.Client
-	collection := client.Database("BlockChain").Collection("Commodity")
-	result := Commodity{}
-	filter := bson.D{{"userid", userid}}
-	err := collection.FindOne(context.TODO(), filter).Decode(&result)
-	result.UserID = userid
-	return result, err
-}
-
-func PostTransaction(C Commodity) {
-	client := database.Mgo.Client
-	collection := client.Database("BlockChain").Collection("Commodity")
-	result := Commodity{}
-	filter := bson.D{{"userid", C.UserID}}
-	err := collection.FindOne(context.TODO(), filter).Decode(&result)
-
-	tmp := Commodity{
-		UserID:     C.UserID,
-		Diamond:    result.Diamond + C.Diamond,
-		Axe:        result.Axe + C.Axe,
-		Pickaxe:    result.Pickaxe + C.Pickaxe,
-		Fishingrod: result.Fishingrod + C.Fishingrod,
-		Beer:       result.Beer + C.Beer,
-		Soda:       result.Soda + C.Soda,
-		Hamburger:  result.Hamburger + C.Hamburger,
-		Cola:       result.Cola + C.Cola,
-		Fish:       result.Fish + C.Fish,
-		Log:        result.Log + C.Log,
+// RemoveItems 把用户的 items 交还给发行人，物品不够时返回 *InsufficientError
+func RemoveItems(userid string, items map[string]int) error {
+	issuer, ok := wallet.Owner(block.Consensus.Issuer)
+	if !ok {
+		return block.ErrNoIssuer
 	}
+	return Transfer(userid, issuer, items)
+}
 
-	if err != nil {
-		if err == mongo.ErrNoDocuments {
-			// This error means your query did not match any documents.
-			_, err2 := collection.InsertOne(context.Background(), tmp)
-			if err2 != nil {
-				logrus.Error("MgoDB: Insert Commodity data error: ", err2)
-			}
-		} else {
-			logrus.Error("MgoDB: Query BlockChain data error: ", err)
-		}
-	} else {
-		filter2 := bson.D{{"userid", C.UserID}}
-		update := bson.D{{"$set", bson.D{
-			{"diamond", tmp.Diamond},
-			{"axe", tmp.Axe},
-			{"pickaxe", tmp.Pickaxe},
-			{"fishingrod", tmp.Fishingrod},
-			{"beer", tmp.Beer},
-			{"soda", tmp.Soda},
-			{"hamburger", tmp.Hamburger},
-			{"cola", tmp.Cola},
-		}}}
-		_, err = collection.UpdateOne(context.Background(), filter2, update)
-		if err != nil {
-			logrus.Error("MgoDB: Update Commodity data error: ", err)
-		} else {
-			logrus.Info("MgoDB: Update Commodity transaction success")
+// Transfer 把 from 的 items 在一笔交易中转给 to，物品不够时返回 *InsufficientError，什么都不会转
+func Transfer(from, to string, items map[string]int) error {
+	ids, err := sortedIDs(items)
+	if err != nil || len(ids) == 0 {
+		return err
+	}
+	b := block.NewTxBuilder()
+	for _, id := range ids {
+		if err := b.Send(from, to, id, items[id]); err != nil {
+			return assetError(err, from, id)
 		}
 	}
-	ChangeStock(C)
+	return submit(b, "Transfer items from "+from+" to "+to)
 }
 
-func ChangeStock(C Commodity) {
-	client := database.Mgo.Client
-	collection := client.Database("BlockChain").Collection("Shop")
-	result := Shop{}
-	err := collection.FindOne(context.TODO(), bson.M{}).Decode(&result)
+// Swap 在一笔交易中由 buyer 付 price 个币给 seller，同时把 holder 的 items 转给 buyer。
+// holder 是卖家自己或保管挂单物品的托管用户；两边要么一起生效，要么都不生效
+func Swap(buyer, seller, holder string, price int, items map[string]int) (block.Transaction, error) {
+	ids, err := sortedIDs(items)
 	if err != nil {
-		logrus.Error("MgoDB: Query Shop data error: ", err)
-	}
-	result2 := Shop{
-		Diamond: Info{
-			Stock: result.Diamond.Stock - C.Diamond, Price: result.Diamond.Price,
-		},
-		Axe: Info{
-			Stock: result.Axe.Stock - C.Axe, Price: result.Axe.Price,
-		},
-		Pickaxe: Info{
-			Stock: result.Pickaxe.Stock - C.Pickaxe, Price: result.Pickaxe.Price,
-		},
-		Fishingrod: Info{
-			Stock: result.Fishingrod.Stock - C.Fishingrod, Price: result.Fishingrod.Price,
-		},
-	}
-	_, err = collection.DeleteOne(context.Background(), bson.M{})
+		return block.Transaction{}, err
+	}
+	b := block.NewTxBuilder()
+	if price > 0 {
+		if err := b.Pay(buyer, seller, price); err != nil {
+			return block.Transaction{}, err
+		}
+	}
+	for _, id := range ids {
+		if err := b.Send(holder, buyer, id, items[id]); err != nil {
+			return block.Transaction{}, assetError(err, holder, id)
+		}
+	}
+	tx, err := b.Submit()
 	if err != nil {
-		logrus.Error("MgoDB: Delete Shop data error: ", err)
+		logrus.Error("Commodity: Swap items error: ", err)
 	}
-	_, err = collection.InsertOne(context.Background(), result2)
+	return tx, err
+}
+
+// sortedIDs 按物品 id 排序，数量为 0 的物品不返回，有负数时返回 ErrInvalidQuantity
+func sortedIDs(items map[string]int) ([]string, error) {
+	ids := make([]string, 0, len(items))
+	for id, n := range items {
+		if n < 0 {
+			return nil, ErrInvalidQuantity
+		}
+		if n > 0 {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+func assetError(err error, userid, id string) error {
+	if err == block.ErrInsufficientAssets {
+		return &InsufficientError{UserID: userid, Item: id}
+	}
+	return err
+}
+
+func submit(b *block.TxBuilder, action string) error {
+	tx, err := b.Submit()
 	if err != nil {
-		logrus.Error("MgoDB: Insert Shop data error: ", err)
+		logrus.Error("Commodity: ", action, " error: ", err)
+		return err
 	}
+	logrus.Info("Commodity: ", action, " in transaction ", tx.ID)
+	return nil
+}
 
-	collection = client.Database("BlockChain").Collection("Restaurant")
-	result4 := Restaurant{}
-	err = collection.FindOne(context.TODO(), bson.M{}).Decode(&result4)
+// FindTool 返回用户背包中用途为 tool 的工具，没有时 ok 为 false
+func FindTool(userid, tool string) (item Item, ok bool, err error) {
+	C, err := GetPersonalInfo(userid)
 	if err != nil {
-		logrus.Error("MgoDB: Query Restaurant data error: ", err)
-	}
-	result3 := Restaurant{
-		Beer: Info{
-			Stock: result4.Beer.Stock - C.Beer, Price: result4.Beer.Price,
-		},
-		Soda: Info{
-			Stock: result4.Soda.Stock - C.Soda, Price: result4.Soda.Price,
-		},
-		Hamburger: Info{
-			Stock: result4.Hamburger.Stock - C.Hamburger, Price: result4.Hamburger.Price,
-		},
-		Cola: Info{
-			Stock: result4.Cola.Stock - C.Cola, Price: result4.Cola.Price,
-		},
-	}
-	_, err = collection.DeleteOne(context.Background(), bson.M{})
+		return Item{}, false, err
+	}
+	catalog, err := Catalog()
 	if err != nil {
-		logrus.Error("MgoDB: Delete Restaurant data error: ", err)
+		return Item{}, false, err
+	}
+	for _, item := range catalog {
+		if item.Tool == tool && C.Items[item.ID] > 0 {
+			return item, true, nil
+		}
+	}
+	return Item{}, false, nil
+}
+
+// Cost 按物品目录中的价格计算购买 items 的总价，有物品不出售时 ok 为 false，
+// 数量是负数或总价超出 int 的范围时返回 ErrInvalidQuantity
+func Cost(items map[string]int) (amount int, ok bool, err error) {
+	for id, n := range items {
+		if n < 0 {
+			return 0, false, ErrInvalidQuantity
+		}
+		item, err := FindItem(id)
+		if err == ErrUnknownItem || (err == nil && item.Price <= 0) {
+			return 0, false, nil
+		}
+		if err != nil {
+			return 0, false, err
+		}
+		// 总价溢出会变成很小的数，用户只付很少的币就能买到物品
+		if n > 0 && item.Price > (math.MaxInt-amount)/n {
+			return 0, false, ErrInvalidQuantity
+		}
+		amount += n * item.Price
+	}
+	return amount, true, nil
+}
+
+// PostTransaction 在商店或餐厅购买 items：先扣减库存，再在一笔交易中由用户付 amount 个币给商店并发行物品给用户。
+// 库存不够时返回 *InsufficientError，交易失败时退回库存并返回交易的错误。
+func PostTransaction(userid string, items map[string]int, amount int) error {
+	if err := TakeStock(items); err != nil {
+		return err
+	}
+	ids, _ := sortedIDs(items)
+	b := block.NewTxBuilder()
+	err := b.Pay(userid, ShopID, amount)
+	for _, id := range ids {
+		if err == nil {
+			err = b.Issue(userid, id, items[id])
+		}
+	}
+	if err == nil {
+		err = submit(b, "Buy items for "+userid)
 	}
-	_, err = collection.InsertOne(context.Background(), result3)
 	if err != nil {
-		logrus.Error("MgoDB: Insert Restaurant data error: ", err)
+		rollbackStock(items)
+	}
+	return err
+}
+
+// TakeStock 从商店和餐厅的库存中减去 items 中的物品，库存不会变成负数。
+// 有物品库存不够时退回已经扣减的部分，返回 *InsufficientError。
+func TakeStock(items map[string]int) error {
+	taken := make(map[string]int, len(items))
+	for id, n := range items {
+		if n < 0 {
+			rollbackStock(taken)
+			return ErrInvalidQuantity
+		}
+		if n == 0 {
+			continue
+		}
+		result, err := itemCollection().UpdateOne(context.Background(),
+			bson.D{{"id", id}, {"stock", bson.D{{"$gte", n}}}},
+			bson.D{{"$inc", bson.D{{"stock", -n}}}})
+		if err == nil && result.MatchedCount == 0 {
+			err = &InsufficientError{Item: id}
+		}
+		if err != nil {
+			rollbackStock(taken)
+			return err
+		}
+		taken[id] = n
+	}
+	return nil
+}
+
+// ReturnStock 把 items 中的物品加回商店和餐厅的库存，某个物品写入失败时仍然继续退回其他物品，返回第一个错误
+func ReturnStock(items map[string]int) error {
+	var first error
+	for id, n := range items {
+		_, err := itemCollection().UpdateOne(context.Background(), bson.D{{"id", id}},
+			bson.D{{"$inc", bson.D{{"stock", n}}}})
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// rollbackStock 在操作失败后退回库存，调用方返回的是原来的错误，退回失败只能记录日志
+func rollbackStock(items map[string]int) {
+	if err := ReturnStock(items); err != nil {
+		logrus.Error("MgoDB: Update Item stock error: ", err)
 	}
 }
@@ -0,0 +1,296 @@
+package commodity
+
+import (
+	"BlockChain/database"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"math"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrUnknownActivity 表示没有这种采集
+	ErrUnknownActivity = errors.New("commodity: unknown gathering activity")
+	// ErrNoTool 表示用户没有采集需要的工具
+	ErrNoTool = errors.New("commodity: no tool for this activity")
+)
+
+// CooldownError 表示采集还在冷却中，Wait 之后才能再次采集
+type CooldownError struct {
+	Activity string
+	Wait     time.Duration
+}
+
+func (e *CooldownError) Error() string {
+	return fmt.Sprintf("%s is cooling down, retry in %.0fs", e.Activity, math.Ceil(e.Wait.Seconds()))
+}
+
+// Drop 是掉落表中的一项: 以 Chance（0 到 1）的概率得到 Min 到 Max 个物品 Item
+type Drop struct {
+	Item   string  `json:"item"`
+	Min    int     `json:"min"`
+	Max    int     `json:"max"`
+	Chance float64 `json:"chance"`
+}
+
+// Activity 是一种采集，需要用途为 Tool 的工具，每次采集后 Cooldown 秒内不能再次采集
+type Activity struct {
+	ID       string `json:"id"`
+	Tool     string `json:"tool"`
+	Cooldown int    `json:"cooldown"`
+	Drops    []Drop `json:"drops"`
+}
+
+// 采集的 id，挖矿的币奖励由 web 在挖出的区块中发放
+const (
+	ActivityFishing = "fishing"
+	ActivityLogging = "logging"
+	ActivityMining  = "mining"
+)
+
+// DefaultActivities 是没有指定掉落表文件时使用的掉落表
+var DefaultActivities = []Activity{
+	{ActivityFishing, ToolFishing, 30, []Drop{{"fish", 1, 3, 1}}},
+	{ActivityLogging, ToolLogging, 30, []Drop{{"log", 1, 5, 1}}},
+	{ActivityMining, ToolMining, 60, []Drop{{"diamond", 1, 1, 0.02}}},
+}
+
+// Gathering 是一次采集的结果。Uses 是工具已经使用的次数，工具达到耐久度 Durability 时损坏，Broken 为 true
+type Gathering struct {
+	Activity   string         `json:"activity"`
+	Items      map[string]int `json:"items"`
+	Tool       string         `json:"tool"`
+	Uses       int            `json:"uses"`
+	Durability int            `json:"durability"`
+	Broken     bool           `json:"broken"`
+}
+
+var (
+	activitiesMu sync.RWMutex
+	activities   = indexActivities(DefaultActivities)
+	rng          = rand.New(rand.NewSource(time.Now().UnixNano()))
+	rngMu        sync.Mutex
+)
+
+func indexActivities(list []Activity) map[string]Activity {
+	m := make(map[string]Activity, len(list))
+	for _, a := range list {
+		m[a.ID] = a
+	}
+	return m
+}
+
+// LoadActivitiesFile 读取 JSON 格式的掉落表文件，path 为空时返回 DefaultActivities
+func LoadActivitiesFile(path string) ([]Activity, error) {
+	if path == "" {
+		return DefaultActivities, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var list []Activity
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, err
+	}
+	for _, a := range list {
+		if a.ID == "" || a.Cooldown < 0 {
+			return nil, fmt.Errorf("activity %q: id must not be empty and cooldown must not be negative", a.ID)
+		}
+		for _, d := range a.Drops {
+			if d.Item == "" || d.Min < 0 || d.Max < d.Min || d.Chance < 0 || d.Chance > 1 {
+				return nil, fmt.Errorf("activity %s: invalid drop %+v", a.ID, d)
+			}
+		}
+	}
+	return list, nil
+}
+
+// SetActivities 替换使用的掉落表
+func SetActivities(list []Activity) {
+	activitiesMu.Lock()
+	defer activitiesMu.Unlock()
+	activities = indexActivities(list)
+}
+
+// FindActivity 返回 id 对应的采集
+func FindActivity(id string) (Activity, bool) {
+	activitiesMu.RLock()
+	defer activitiesMu.RUnlock()
+	a, ok := activities[id]
+	return a, ok
+}
+
+func cooldowns() *mongo.Collection {
+	return database.Mgo.Db.Collection("Cooldown")
+}
+
+func toolWear() *mongo.Collection {
+	return database.Mgo.Db.Collection("ToolWear")
+}
+
+// EnsureGatheringIndexes 建立冷却和工具磨损的唯一索引，冷却的条件更新依赖这个索引
+func EnsureGatheringIndexes() error {
+	for _, coll := range []*mongo.Collection{cooldowns(), toolWear()} {
+		_, err := coll.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+			Keys:    bson.D{{"userid", 1}, {"key", 1}},
+			Options: options.Index().SetUnique(true),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Gather 进行一次采集: 检查工具，开始冷却，按掉落表发行物品，再磨损工具。
+// 没有工具时返回 ErrNoTool，冷却中返回 *CooldownError，这两种情况什么都不会修改
+func Gather(userid, activity string) (Gathering, error) {
+	return GatherWith(userid, activity, nil)
+}
+
+// GatherWith 和 Gather 一样，但在开始冷却之后、发行物品之前先执行 action，例如挖矿时挖出区块。
+// action 失败时结束冷却并返回它的错误，不发行物品也不磨损工具；
+// action 成功之后冷却不再撤销，物品发行失败时返回的 Gathering 中 Items 为空
+func GatherWith(userid, activity string, action func() error) (Gathering, error) {
+	act, ok := FindActivity(activity)
+	if !ok {
+		return Gathering{}, ErrUnknownActivity
+	}
+	tool, ok, err := FindTool(userid, act.Tool)
+	if err != nil {
+		return Gathering{}, err
+	}
+	if !ok {
+		return Gathering{}, ErrNoTool
+	}
+	if err := startCooldown(userid, act); err != nil {
+		return Gathering{}, err
+	}
+	if action != nil {
+		if err := action(); err != nil {
+			resetCooldown(userid, act.ID)
+			return Gathering{}, err
+		}
+	}
+	result := Gathering{Activity: act.ID, Items: roll(act.Drops), Tool: tool.ID, Durability: tool.Durability}
+	if err := AddItems(userid, result.Items); err != nil {
+		if action == nil {
+			resetCooldown(userid, act.ID)
+		}
+		result.Items = nil
+		return result, err
+	}
+	result.Uses, result.Broken, err = wear(userid, tool)
+	if err != nil {
+		logrus.Error("Commodity: wear ", tool.ID, " of ", userid, " error: ", err)
+	}
+	return result, nil
+}
+
+// CheckGather 检查用户现在能否进行采集 activity，返回要使用的工具和它的使用次数。
+// 没有工具时返回 ErrNoTool，冷却中返回 *CooldownError
+func CheckGather(userid, activity string) (Gathering, error) {
+	act, ok := FindActivity(activity)
+	if !ok {
+		return Gathering{}, ErrUnknownActivity
+	}
+	tool, ok, err := FindTool(userid, act.Tool)
+	if err != nil {
+		return Gathering{}, err
+	}
+	if !ok {
+		return Gathering{}, ErrNoTool
+	}
+	var doc struct {
+		Ready int64 `bson:"ready"`
+		Uses  int   `bson:"uses"`
+	}
+	now := time.Now()
+	err = cooldowns().FindOne(context.Background(), bson.D{{"userid", userid}, {"key", act.ID}}).Decode(&doc)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return Gathering{}, err
+	}
+	if doc.Ready > now.Unix() {
+		return Gathering{}, &CooldownError{act.ID, time.Unix(doc.Ready, 0).Sub(now)}
+	}
+	err = toolWear().FindOne(context.Background(), bson.D{{"userid", userid}, {"key", tool.ID}}).Decode(&doc)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return Gathering{}, err
+	}
+	return Gathering{Activity: act.ID, Tool: tool.ID, Uses: doc.Uses, Durability: tool.Durability}, nil
+}
+
+// roll 按掉落表随机得到物品，以物品 id 为键
+func roll(drops []Drop) map[string]int {
+	rngMu.Lock()
+	defer rngMu.Unlock()
+	items := make(map[string]int)
+	for _, d := range drops {
+		if rng.Float64() >= d.Chance {
+			continue
+		}
+		if n := d.Min + rng.Intn(d.Max-d.Min+1); n > 0 {
+			items[d.Item] += n
+		}
+	}
+	return items
+}
+
+// startCooldown 在冷却已经结束时原子地设置下一次可以采集的时间，还在冷却时返回 *CooldownError。
+// 文档存在但还在冷却时条件不满足，upsert 会违反唯一索引
+func startCooldown(userid string, act Activity) error {
+	now := time.Now()
+	ready := now.Add(time.Duration(act.Cooldown) * time.Second).Unix()
+	_, err := cooldowns().UpdateOne(context.Background(),
+		bson.D{{"userid", userid}, {"key", act.ID}, {"ready", bson.D{{"$lte", now.Unix()}}}},
+		bson.D{{"$set", bson.D{{"ready", ready}}}}, options.Update().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		var doc struct {
+			Ready int64 `bson:"ready"`
+		}
+		cooldowns().FindOne(context.Background(), bson.D{{"userid", userid}, {"key", act.ID}}).Decode(&doc)
+		return &CooldownError{act.ID, time.Unix(doc.Ready, 0).Sub(now)}
+	}
+	return err
+}
+
+// resetCooldown 在采集失败时结束冷却
+func resetCooldown(userid, activity string) {
+	_, err := cooldowns().UpdateOne(context.Background(), bson.D{{"userid", userid}, {"key", activity}},
+		bson.D{{"$set", bson.D{{"ready", 0}}}})
+	if err != nil {
+		logrus.Error("MgoDB: Update Cooldown data error: ", err)
+	}
+}
+
+// wear 把用户正在使用的工具 tool 的使用次数加一，达到耐久度时把一个工具交还发行人并重新计数。
+// Durability 为 0 的工具不会损坏
+func wear(userid string, tool Item) (uses int, broken bool, err error) {
+	var doc struct {
+		Uses int `bson:"uses"`
+	}
+	err = toolWear().FindOneAndUpdate(context.Background(),
+		bson.D{{"userid", userid}, {"key", tool.ID}},
+		bson.D{{"$inc", bson.D{{"uses", 1}}}},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)).Decode(&doc)
+	if err != nil || tool.Durability <= 0 || doc.Uses < tool.Durability {
+		return doc.Uses, false, err
+	}
+	if err := RemoveItems(userid, map[string]int{tool.ID: 1}); err != nil {
+		return doc.Uses, false, err
+	}
+	_, err = toolWear().UpdateOne(context.Background(), bson.D{{"userid", userid}, {"key", tool.ID}},
+		bson.D{{"$inc", bson.D{{"uses", -tool.Durability}}}})
+	logrus.Info("Commodity: ", tool.ID, " of ", userid, " is broken")
+	return doc.Uses, true, err
+}
@@ -0,0 +1,84 @@
+package commodity
+
+import (
+	"BlockChain/database"
+	"context"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// legacyItems 是旧版本背包文档中每种物品一个字段的字段名，也就是物品 id
+var legacyItems = []string{"diamond", "axe", "pickaxe", "fishingrod", "beer", "soda", "hamburger", "cola", "fish", "log"}
+
+// legacyStock 读取旧版本 Shop 和 Restaurant 文档中的库存，以物品 id 为键
+func legacyStock() map[string]int {
+	stock := make(map[string]int)
+	for _, name := range []string{"Shop", "Restaurant"} {
+		doc := bson.M{}
+		if err := database.Mgo.Db.Collection(name).FindOne(context.Background(), bson.D{}).Decode(&doc); err != nil {
+			continue
+		}
+		for id, v := range doc {
+			if info, ok := v.(bson.M); ok {
+				if _, ok := info["stock"]; ok {
+					stock[id] = count(info["stock"])
+				}
+			}
+		}
+	}
+	return stock
+}
+
+// MigrateInventories 把 MongoDB 中旧版本的背包发行为链上的物品，迁移成功的背包文档会被删除。
+// 旧文档可能是每种物品一个字段，也可能是 items 中物品 id 到数量的映射
+func MigrateInventories() error {
+	cursor, err := inventories().Find(context.Background(), bson.D{})
+	if err != nil {
+		return err
+	}
+	var docs []bson.M
+	if err := cursor.All(context.Background(), &docs); err != nil {
+		return err
+	}
+	migrated := 0
+	for _, doc := range docs {
+		userid, _ := doc["userid"].(string)
+		if userid == "" {
+			continue
+		}
+		items := make(map[string]int)
+		for _, id := range legacyItems {
+			if n := count(doc[id]); n > 0 {
+				items[id] += n
+			}
+		}
+		if m, ok := doc["items"].(bson.M); ok {
+			for id, v := range m {
+				if n := count(v); n > 0 {
+					items[id] += n
+				}
+			}
+		}
+		if err := AddItems(userid, items); err != nil {
+			return err
+		}
+		if _, err := inventories().DeleteOne(context.Background(), bson.D{{"_id", doc["_id"]}}); err != nil {
+			return err
+		}
+		migrated++
+	}
+	if migrated > 0 {
+		logrus.Info("MgoDB: Migrate ", migrated, " Commodity documents to items on chain")
+	}
+	return nil
+}
+
+func count(v interface{}) int {
+	switch n := v.(type) {
+	case int32:
+		return int(n)
+	case int64:
+		return int(n)
+	}
+	return 0
+}
@@ -0,0 +1,334 @@
+package config
+
+import (
+	"BlockChain/wallet"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Config 是节点的全部配置。
+// 配置依次从默认值、配置文件（JSON）、环境变量和命令行参数加载，后加载的覆盖先加载的。
+// 时间都以秒为单位。
+type Config struct {
+	Mongo     MongoConfig     `json:"mongo"`
+	HTTP      HTTPConfig      `json:"http"`
+	Log       LogConfig       `json:"log"`
+	Chain     ChainConfig     `json:"chain"`
+	Mempool   MempoolConfig   `json:"mempool"`
+	P2P       P2PConfig       `json:"p2p"`
+	Auth      AuthConfig      `json:"auth"`
+	Mining    MiningConfig    `json:"mining"`
+	Catalog   CatalogConfig   `json:"catalog"`
+	Gathering GatheringConfig `json:"gathering"`
+	Market    MarketConfig    `json:"market"`
+}
+
+type MongoConfig struct {
+	URI      string `json:"uri"`
+	Database string `json:"database"`
+}
+
+type HTTPConfig struct {
+	Port int `json:"port"`
+}
+
+type LogConfig struct {
+	Level string `json:"level"` // logrus 的日志级别
+	File  string `json:"file"`  // 为空时输出到标准错误
+}
+
+type ChainConfig struct {
+	Store          string `json:"store"` // mongo / bolt / memory
+	StorePath      string `json:"storePath"`
+	WalletFile     string `json:"walletFile"`
+	DifficultyBits int    `json:"difficultyBits"`
+	BlockSpacing   int    `json:"blockSpacing"`
+	RetargetWindow int    `json:"retargetWindow"`
+	Issuer         string `json:"issuer"` // 可以发行物品的钱包地址，为空时使用本节点 shop 用户的钱包，启用 P2P 时必须设置
+	// ResetLegacyChain 允许把 MongoDB 中旧版本的区块移走并从创世区块重新开始，旧链上的余额不会保留
+	ResetLegacyChain bool `json:"resetLegacyChain"`
+}
+
+type MempoolConfig struct {
+	Interval int `json:"interval"`
+	MaxSize  int `json:"maxSize"`
+	MinFee   int `json:"minFee"` // 花费币的交易最低的手续费
+}
+
+type P2PConfig struct {
+	Listen string   `json:"listen"`
+	Peers  []string `json:"peers"`
+}
+
+type AuthConfig struct {
+	Secret   string   `json:"secret"`
+	TokenTTL int      `json:"tokenTTL"`
+	Admins   []string `json:"admins"`
+}
+
+type MiningConfig struct {
+	Reward          int `json:"reward"`          // 区块奖励，所有节点必须相同
+	HalvingInterval int `json:"halvingInterval"` // 区块奖励每多少个区块减半，0 表示不减半
+}
+
+type MarketConfig struct {
+	ListingTTL int `json:"listingTTL"` // 挂单默认的有效期，为 0 时不会过期
+}
+
+type CatalogConfig struct {
+	File string `json:"file"` // 初始化物品目录的 JSON 文件，为空时使用内置目录
+}
+
+type GatheringConfig struct {
+	File string `json:"file"` // 捕鱼、伐木和挖矿掉落表的 JSON 文件，为空时使用内置掉落表
+}
+
+// Default 返回默认配置，MongoDB 的地址没有默认值
+func Default() Config {
+	return Config{
+		Mongo: MongoConfig{Database: "BlockChain"},
+		HTTP:  HTTPConfig{Port: 8080},
+		Log:   LogConfig{Level: "trace", File: "log/log.txt"},
+		Chain: ChainConfig{
+			Store:          "mongo",
+			DifficultyBits: 12,
+			BlockSpacing:   10,
+			RetargetWindow: 10,
+		},
+		Mempool: MempoolConfig{Interval: 10, MaxSize: 50},
+		Auth:    AuthConfig{TokenTTL: 24 * 3600},
+		Mining:  MiningConfig{Reward: 10, HalvingInterval: 100000},
+		Market:  MarketConfig{ListingTTL: 7 * 24 * 3600},
+	}
+}
+
+// setting 是一个可以用环境变量和命令行参数设置的配置项，str、num、list、on 中只有一个不为空。
+// secret 的配置项不在帮助信息中显示当前值。
+type setting struct {
+	env    string
+	flag   string
+	usage  string
+	secret bool
+	str    *string
+	num    *int
+	list   *[]string
+	on     *bool
+}
+
+func (c *Config) settings() []setting {
+	return []setting{
+		{env: "MONGO_URI", flag: "mongo-uri", usage: "MongoDB 地址", secret: true, str: &c.Mongo.URI},
+		{env: "MONGO_DATABASE", flag: "mongo-database", usage: "MongoDB 数据库名", str: &c.Mongo.Database},
+		{env: "PORT", flag: "port", usage: "HTTP 端口", num: &c.HTTP.Port},
+		{env: "LOG_LEVEL", flag: "log-level", usage: "日志级别", str: &c.Log.Level},
+		{env: "LOG_FILE", flag: "log-file", usage: "日志文件，为空时输出到标准错误", str: &c.Log.File},
+		{env: "CHAIN_STORE", flag: "chain-store", usage: "区块链存储后端 mongo/bolt/memory", str: &c.Chain.Store},
+		{env: "CHAIN_STORE_PATH", flag: "chain-store-path", usage: "bolt 数据文件", str: &c.Chain.StorePath},
+		{env: "WALLET_FILE", flag: "wallet-file", usage: "钱包文件", str: &c.Chain.WalletFile},
+		{env: "DIFFICULTY_BITS", flag: "difficulty-bits", usage: "初始难度", num: &c.Chain.DifficultyBits},
+		{env: "BLOCK_SPACING", flag: "block-spacing", usage: "期望出块间隔（秒）", num: &c.Chain.BlockSpacing},
+		{env: "RETARGET_WINDOW", flag: "retarget-window", usage: "调整难度参考的区块数", num: &c.Chain.RetargetWindow},
+		{env: "ITEM_ISSUER", flag: "item-issuer", usage: "发行物品的钱包地址，所有节点必须相同", str: &c.Chain.Issuer},
+		{env: "RESET_LEGACY_CHAIN", flag: "reset-legacy-chain", usage: "把旧版本的区块移到 LegacyBlock 并从创世区块重新开始", on: &c.Chain.ResetLegacyChain},
+		{env: "MEMPOOL_INTERVAL", flag: "mempool-interval", usage: "交易池出块间隔（秒）", num: &c.Mempool.Interval},
+		{env: "MEMPOOL_MAX_SIZE", flag: "mempool-max-size", usage: "交易池攒够多少笔交易立即出块", num: &c.Mempool.MaxSize},
+		{env: "MEMPOOL_MIN_FEE", flag: "mempool-min-fee", usage: "交易池接受的最低手续费", num: &c.Mempool.MinFee},
+		{env: "P2P_LISTEN", flag: "p2p-listen", usage: "P2P 监听地址", str: &c.P2P.Listen},
+		{env: "P2P_PEERS", flag: "p2p-peers", usage: "启动时连接的节点，逗号分隔", list: &c.P2P.Peers},
+		{env: "AUTH_SECRET", flag: "auth-secret", usage: "令牌签名密钥", secret: true, str: &c.Auth.Secret},
+		{env: "TOKEN_TTL", flag: "token-ttl", usage: "令牌有效期（秒）", num: &c.Auth.TokenTTL},
+		{env: "ADMIN_USERS", flag: "admin-users", usage: "管理员用户，逗号分隔", list: &c.Auth.Admins},
+		{env: "MINING_REWARD", flag: "mining-reward", usage: "区块奖励，所有节点必须相同", num: &c.Mining.Reward},
+		{env: "HALVING_INTERVAL", flag: "halving-interval", usage: "区块奖励减半的间隔（区块数），0 表示不减半", num: &c.Mining.HalvingInterval},
+		{env: "LISTING_TTL", flag: "listing-ttl", usage: "挂单默认的有效期（秒），0 表示不过期", num: &c.Market.ListingTTL},
+		{env: "CATALOG_FILE", flag: "catalog-file", usage: "物品目录文件，为空时使用内置目录", str: &c.Catalog.File},
+		{env: "GATHERING_FILE", flag: "gathering-file", usage: "掉落表文件，为空时使用内置掉落表", str: &c.Gathering.File},
+	}
+}
+
+// Load 按默认值、配置文件、环境变量、命令行参数的顺序加载配置并检查。
+// 配置文件由参数 -config 或环境变量 CONFIG_FILE 指定，都没有时读取当前目录下存在的 config.json。
+// 返回 args 中参数之后剩下的部分（子命令）。参数中有 -h 时打印帮助并返回 flag.ErrHelp。
+func Load(args []string) (Config, []string, error) {
+	path := configPath(args)
+	c := Default()
+	if err := c.loadFile(path); err != nil {
+		return c, nil, err
+	}
+	var problems []string
+	for _, s := range c.settings() {
+		if v, ok := os.LookupEnv(s.env); ok {
+			if err := s.set(v); err != nil {
+				problems = append(problems, fmt.Sprintf("%s=%q: %v", s.env, v, err))
+			}
+		}
+	}
+	fs := flag.NewFlagSet("BlockChain", flag.ContinueOnError)
+	fs.String("config", path, "配置文件（环境变量 CONFIG_FILE）")
+	for _, s := range c.settings() {
+		fs.Var(settingValue{s}, s.flag, s.usage+"（环境变量 "+s.env+"）")
+	}
+	if err := fs.Parse(args); err != nil {
+		return c, nil, err
+	}
+	if len(problems) > 0 {
+		return c, nil, ValidationError(append(problems, c.validate()...))
+	}
+	if err := c.Validate(); err != nil {
+		return c, nil, err
+	}
+	return c, fs.Args(), nil
+}
+
+// configPath 在加载其他配置之前从参数中找出 -config，没有时使用环境变量 CONFIG_FILE
+func configPath(args []string) string {
+	path := os.Getenv("CONFIG_FILE")
+	for i, arg := range args {
+		if arg == "--" || !strings.HasPrefix(arg, "-") {
+			break
+		}
+		name := strings.TrimLeft(arg, "-")
+		if name == "config" && i+1 < len(args) {
+			path = args[i+1]
+		} else if strings.HasPrefix(name, "config=") {
+			path = strings.TrimPrefix(name, "config=")
+		}
+	}
+	return path
+}
+
+func (c *Config) loadFile(path string) error {
+	explicit := path != ""
+	if !explicit {
+		path = "config.json"
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) && !explicit {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("config: read %s: %v", path, err)
+	}
+	if err := json.Unmarshal(data, c); err != nil {
+		return fmt.Errorf("config: parse %s: %v", path, err)
+	}
+	return nil
+}
+
+func (s setting) set(v string) error {
+	switch {
+	case s.str != nil:
+		*s.str = v
+	case s.num != nil:
+		n, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil {
+			return errors.New("not an integer")
+		}
+		*s.num = n
+	case s.on != nil:
+		b, err := strconv.ParseBool(strings.TrimSpace(v))
+		if err != nil {
+			return errors.New("not a boolean")
+		}
+		*s.on = b
+	case s.list != nil:
+		*s.list = nil
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				*s.list = append(*s.list, item)
+			}
+		}
+	}
+	return nil
+}
+
+// settingValue 把 setting 包装成 flag.Value
+type settingValue struct{ s setting }
+
+func (v settingValue) Set(value string) error { return v.s.set(value) }
+
+// IsBoolFlag 让开关的配置项可以只写 -reset-legacy-chain，不带值
+func (v settingValue) IsBoolFlag() bool { return v.s.on != nil }
+
+func (v settingValue) String() string {
+	switch {
+	case v.s.secret:
+		return ""
+	case v.s.str != nil:
+		return *v.s.str
+	case v.s.num != nil:
+		return strconv.Itoa(*v.s.num)
+	case v.s.list != nil:
+		return strings.Join(*v.s.list, ",")
+	case v.s.on != nil:
+		return strconv.FormatBool(*v.s.on)
+	}
+	return ""
+}
+
+// ValidationError 列出全部无效的配置项
+type ValidationError []string
+
+func (e ValidationError) Error() string {
+	return "invalid configuration:\n  - " + strings.Join(e, "\n  - ")
+}
+
+// Validate 检查全部配置项，有无效配置时返回列出所有问题的 ValidationError
+func (c *Config) Validate() error {
+	if problems := c.validate(); len(problems) > 0 {
+		return ValidationError(problems)
+	}
+	return nil
+}
+
+func (c *Config) validate() []string {
+	var problems []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+	switch c.Chain.Store {
+	case "mongo", "bolt", "memory":
+	default:
+		problems = append(problems, fmt.Sprintf("chain.store (CHAIN_STORE) must be mongo, bolt or memory, got %q", c.Chain.Store))
+	}
+	check(c.Mongo.URI != "" || c.Chain.Store != "mongo", "mongo.uri (MONGO_URI) is required when chain.store is mongo")
+	check(c.Mongo.URI == "" || strings.HasPrefix(c.Mongo.URI, "mongodb://") || strings.HasPrefix(c.Mongo.URI, "mongodb+srv://"),
+		"mongo.uri (MONGO_URI) must start with mongodb:// or mongodb+srv://")
+	check(c.Mongo.Database != "", "mongo.database (MONGO_DATABASE) must not be empty")
+	check(c.HTTP.Port > 0 && c.HTTP.Port < 65536, "http.port (PORT) must be between 1 and 65535, got %d", c.HTTP.Port)
+	_, err := logrus.ParseLevel(c.Log.Level)
+	check(err == nil, "log.level (LOG_LEVEL) %q is not a valid level", c.Log.Level)
+	check(c.Chain.DifficultyBits > 0 && c.Chain.DifficultyBits < 256,
+		"chain.difficultyBits (DIFFICULTY_BITS) must be between 1 and 255, got %d", c.Chain.DifficultyBits)
+	check(c.Chain.BlockSpacing > 0, "chain.blockSpacing (BLOCK_SPACING) must be positive, got %d", c.Chain.BlockSpacing)
+	check(c.Chain.RetargetWindow > 0, "chain.retargetWindow (RETARGET_WINDOW) must be positive, got %d", c.Chain.RetargetWindow)
+	check(c.Chain.Issuer == "" || wallet.ValidateAddress(c.Chain.Issuer), "chain.issuer (ITEM_ISSUER) %q is not a valid address", c.Chain.Issuer)
+	// 本节点 shop 用户的钱包只存在于本节点，多个节点必须配置同一个发行人
+	check(c.Chain.Issuer != "" || (c.P2P.Listen == "" && len(c.P2P.Peers) == 0),
+		"chain.issuer (ITEM_ISSUER) is required when p2p is enabled, all nodes must use the same issuer")
+	check(c.Mempool.Interval > 0, "mempool.interval (MEMPOOL_INTERVAL) must be positive, got %d", c.Mempool.Interval)
+	check(c.Mempool.MaxSize > 0, "mempool.maxSize (MEMPOOL_MAX_SIZE) must be positive, got %d", c.Mempool.MaxSize)
+	check(c.Mempool.MinFee >= 0, "mempool.minFee (MEMPOOL_MIN_FEE) must not be negative, got %d", c.Mempool.MinFee)
+	check(c.Auth.TokenTTL > 0, "auth.tokenTTL (TOKEN_TTL) must be positive, got %d", c.Auth.TokenTTL)
+	check(c.Mining.Reward >= 0, "mining.reward (MINING_REWARD) must not be negative, got %d", c.Mining.Reward)
+	check(c.Mining.HalvingInterval >= 0, "mining.halvingInterval (HALVING_INTERVAL) must not be negative, got %d", c.Mining.HalvingInterval)
+	check(c.Market.ListingTTL >= 0, "market.listingTTL (LISTING_TTL) must not be negative, got %d", c.Market.ListingTTL)
+	if c.Catalog.File != "" {
+		_, err := os.Stat(c.Catalog.File)
+		check(err == nil, "catalog.file (CATALOG_FILE) %q is not readable: %v", c.Catalog.File, err)
+	}
+	if c.Gathering.File != "" {
+		_, err := os.Stat(c.Gathering.File)
+		check(err == nil, "gathering.file (GATHERING_FILE) %q is not readable: %v", c.Gathering.File, err)
+	}
+	return problems
+}
@@ -0,0 +1,77 @@
+package config
+
+import (
+	"BlockChain/wallet"
+	"strings"
+	"testing"
+)
+
+func TestValidateIssuer(t *testing.T) {
+	w, err := wallet.NewWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := w.GetAddress()
+	tests := []struct {
+		name   string
+		issuer string
+		listen string
+		peers  []string
+		ok     bool
+	}{
+		{"no p2p", "", "", nil, true},
+		{"listen without issuer", "", "127.0.0.1:3001", nil, false},
+		{"peers without issuer", "", "", []string{"127.0.0.1:3001"}, false},
+		{"p2p with issuer", address, "127.0.0.1:3001", []string{"127.0.0.1:3002"}, true},
+		{"invalid issuer", "not-an-address", "", nil, false},
+	}
+	for _, tt := range tests {
+		c := Default()
+		c.Chain.Issuer = tt.issuer
+		c.P2P.Listen = tt.listen
+		c.P2P.Peers = tt.peers
+		var issuerProblems []string
+		for _, p := range c.validate() {
+			if strings.Contains(p, "ITEM_ISSUER") {
+				issuerProblems = append(issuerProblems, p)
+			}
+		}
+		if ok := len(issuerProblems) == 0; ok != tt.ok {
+			t.Errorf("%s: valid = %v, want %v: %v", tt.name, ok, tt.ok, issuerProblems)
+		}
+	}
+}
+
+func TestLoadResetLegacyChain(t *testing.T) {
+	tests := []struct {
+		name string
+		env  string
+		args []string
+		want bool
+		ok   bool
+	}{
+		{"default", "", nil, false, true},
+		{"flag", "", []string{"-reset-legacy-chain"}, true, true},
+		{"double dash flag", "", []string{"--reset-legacy-chain"}, true, true},
+		{"flag false", "", []string{"-reset-legacy-chain=false"}, false, true},
+		{"env", "true", nil, true, true},
+		{"flag overrides env", "true", []string{"-reset-legacy-chain=false"}, false, true},
+		{"invalid env", "maybe", nil, false, false},
+	}
+	t.Setenv("CHAIN_STORE", "memory")
+	t.Setenv("CONFIG_FILE", "")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.env != "" {
+				t.Setenv("RESET_LEGACY_CHAIN", tt.env)
+			}
+			c, _, err := Load(tt.args)
+			if (err == nil) != tt.ok {
+				t.Fatalf("Load error = %v, want ok %v", err, tt.ok)
+			}
+			if err == nil && c.Chain.ResetLegacyChain != tt.want {
+				t.Errorf("ResetLegacyChain = %v, want %v", c.Chain.ResetLegacyChain, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package events
+
+import (
+	"sync"
+	"time"
+)
+
+// 事件主题
+const (
+	TopicBlock     = "block"     // 新区块写入主链
+	TopicTx        = "tx"        // 交易被打包进区块
+	TopicListing   = "listing"   // 交易市场的挂单上架或售出
+	TopicPurchase  = "purchase"  // 买家购买了卖家的挂单
+	TopicInventory = "inventory" // 用户的物品发生变化
+	TopicOrder     = "order"     // 订单簿上的订单下单或撤单
+	TopicTrade     = "trade"     // 订单簿撮合成交
+)
+
+// Event 是进程内事件总线上的一条事件。
+// Users 是和事件相关的用户，只有这些用户的订阅能收到；Users 为空的是所有订阅都能收到的公共事件。
+type Event struct {
+	Topic string      `json:"topic"`
+	Time  string      `json:"time"`
+	Users []string    `json:"users,omitempty"`
+	Data  interface{} `json:"data"`
+}
+
+// subscriptionBuffer 是每个订阅缓存的事件数，客户端读得太慢、缓存满了时订阅会被关闭
+const subscriptionBuffer = 64
+
+// Subscription 是一个订阅，事件从 C 中读取。订阅被关闭后 C 也会被关闭。
+type Subscription struct {
+	C      <-chan Event
+	c      chan Event
+	userid string
+	all    bool
+	topics map[string]bool
+}
+
+var (
+	mu   sync.Mutex
+	subs = make(map[*Subscription]bool)
+)
+
+// Subscribe 订阅 topics 中的公共事件和与 userid 相关的事件，topics 为空时订阅全部主题
+func Subscribe(userid string, topics []string) *Subscription {
+	return subscribe(userid, false, topics)
+}
+
+// SubscribeAll 订阅 topics 中的全部事件，包括和所有用户相关的事件
+func SubscribeAll(topics []string) *Subscription {
+	return subscribe("", true, topics)
+}
+
+func subscribe(userid string, all bool, topics []string) *Subscription {
+	c := make(chan Event, subscriptionBuffer)
+	s := &Subscription{C: c, c: c, userid: userid, all: all, topics: make(map[string]bool)}
+	for _, t := range topics {
+		s.topics[t] = true
+	}
+	mu.Lock()
+	subs[s] = true
+	mu.Unlock()
+	return s
+}
+
+// Close 取消订阅，可以重复调用
+func (s *Subscription) Close() {
+	mu.Lock()
+	defer mu.Unlock()
+	s.close()
+}
+
+// close 调用方需要持有 mu
+func (s *Subscription) close() {
+	if subs[s] {
+		delete(subs, s)
+		close(s.c)
+	}
+}
+
+func (s *Subscription) wants(e Event) bool {
+	if len(s.topics) > 0 && !s.topics[e.Topic] {
+		return false
+	}
+	if len(e.Users) == 0 || s.all {
+		return true
+	}
+	for _, u := range e.Users {
+		if u == s.userid {
+			return true
+		}
+	}
+	return false
+}
+
+// Publish 把事件发给所有订阅了它的客户端，不会阻塞，可以在持有其他锁时调用
+func Publish(topic string, users []string, data interface{}) {
+	e := Event{topic, time.Now().UTC().Format(time.RFC3339), users, data}
+	mu.Lock()
+	defer mu.Unlock()
+	for s := range subs {
+		if !s.wants(e) {
+			continue
+		}
+		select {
+		case s.c <- e:
+		default:
+			s.close()
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package events
+
+import (
+	"BlockChain/block"
+	"BlockChain/wallet"
+	"time"
+)
+
+// BlockEvent 是 block 事件的数据
+type BlockEvent struct {
+	Index        int    `json:"index"`
+	Hash         string `json:"hash"`
+	PrevHash     string `json:"prevHash"`
+	Timestamp    string `json:"timestamp"`
+	Transactions int    `json:"transactions"`
+}
+
+// TxEvent 是 tx 事件的数据
+type TxEvent struct {
+	Txid        string            `json:"txid"`
+	BlockIndex  int               `json:"blockIndex"`
+	BlockHash   string            `json:"blockHash"`
+	Transaction block.Transaction `json:"transaction"`
+}
+
+// WatchChain 订阅区块链的新区块，发布 block 事件，并为区块中的每笔交易发布 tx 事件。
+// tx 事件发给交易的付款人和收款人。
+func WatchChain() {
+	block.OnBlock(func(b block.Block) {
+		Publish(TopicBlock, nil, BlockEvent{
+			b.Index, b.Hash, b.PrevHash,
+			time.Unix(b.Timestamp, 0).UTC().Format(time.RFC3339),
+			len(b.Transactions),
+		})
+		for _, tx := range b.Transactions {
+			Publish(TopicTx, txUsers(tx), TxEvent{tx.ID, b.Index, b.Hash, tx})
+		}
+	})
+}
+
+// txUsers 返回交易输入和输出涉及的本节点用户
+func txUsers(tx block.Transaction) []string {
+	var users []string
+	seen := make(map[string]bool)
+	add := func(address string) {
+		if userid, ok := wallet.Owner(address); ok && !seen[userid] {
+			seen[userid] = true
+			users = append(users, userid)
+		}
+	}
+	if !tx.IsCoinbase() {
+		for _, vin := range tx.Vin {
+			add(wallet.Wallet{PublicKey: vin.PubKey}.GetAddress())
+		}
+	}
+	for _, out := range tx.Vout {
+		add(out.ScriptPubKey)
+	}
+	return users
+}
@@ -1,13 +1,23 @@
 package main
 
 import (
+	"BlockChain/auth"
 	"BlockChain/block"
+	"BlockChain/commodity"
+	"BlockChain/config"
 	"BlockChain/database"
+	"BlockChain/events"
+	"BlockChain/market"
+	"BlockChain/p2p"
+	"BlockChain/wallet"
 	"BlockChain/web"
+	"flag"
 	"fmt"
 	"github.com/joho/godotenv"
 	"log"
 	"os"
+	"path/filepath"
+	"strconv"
 	"time"
 
 	"github.com/gin-contrib/cors"
@@ -19,8 +29,8 @@ func init() {
 
 	logrus.SetLevel(logrus.TraceLevel)
 
-	err := godotenv.Load()
-	if err != nil {
+	// .env 中的变量作为环境变量，文件不存在时只使用已有的环境变量
+	if err := godotenv.Load(); err != nil && !os.IsNotExist(err) {
 		log.Fatal(err)
 	}
 
@@ -28,82 +38,277 @@ func init() {
 
 func main() {
 
-	logFile := "log/log.txt"
-	f, err := os.OpenFile(logFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	// 配置依次来自默认值、配置文件、环境变量和命令行参数，见 config 包
+	cfg, args, err := config.Load(os.Args[1:])
+	if err == flag.ErrHelp {
+		return
+	}
 	if err != nil {
-		fmt.Println("Failed to create logfile" + logFile)
-		panic(err)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	level, _ := logrus.ParseLevel(cfg.Log.Level)
+	logrus.SetLevel(level)
+	if cfg.Log.File != "" {
+		if err := os.MkdirAll(filepath.Dir(cfg.Log.File), 0755); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to create log directory: ", err)
+			os.Exit(1)
+		}
+		f, err := os.OpenFile(cfg.Log.File, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to create logfile "+cfg.Log.File+": ", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		logrus.SetOutput(f)
 	}
-	defer f.Close()
-	logrus.SetOutput(f)
 
-	database.Init()
-	block.Init()
-	go runWebServer()
+	// 用户物品、账号等数据保存在 MongoDB 中，区块链的存储后端由 chain.store 选择: mongo / bolt / memory
+	if cfg.Mongo.URI != "" {
+		database.Init(cfg.Mongo.URI, cfg.Mongo.Database)
+	} else {
+		logrus.Warn("MgoDB: mongo.uri is not set, account, item, gathering and market APIs return 503")
+	}
+	// MongoDB 中有旧版本的区块时，只有设置了 --reset-legacy-chain 才会移走它们并从创世区块重新开始
+	block.ResetLegacyChain = cfg.Chain.ResetLegacyChain
+	store, err := block.OpenStore(cfg.Chain.Store, cfg.Chain.StorePath)
+	if err != nil {
+		logrus.Fatal("FAILED to open chain store: ", err)
+	}
+	defer store.Close()
+	if err := wallet.Init(cfg.Chain.WalletFile); err != nil {
+		logrus.Fatal("FAILED to load wallets: ", err)
+	}
+	if cfg.Auth.Secret == "" {
+		logrus.Warn("Auth: AUTH_SECRET is not set, tokens will be invalid after restart")
+	}
+	auth.Init(cfg.Auth.Secret, seconds(cfg.Auth.TokenTTL), cfg.Auth.Admins)
+	if database.Mgo.Client != nil {
+		if err := auth.EnsureIndexes(); err != nil {
+			logrus.Error("MgoDB: create Account index error: ", err)
+		}
+		// 物品目录中还不存在的物品写入 Item 集合
+		catalog, err := commodity.LoadCatalogFile(cfg.Catalog.File)
+		if err != nil {
+			logrus.Fatal("FAILED to load item catalog: ", err)
+		}
+		if err := commodity.InitCatalog(catalog); err != nil {
+			logrus.Error("MgoDB: init item catalog error: ", err)
+		}
+		if err := market.EnsureIndexes(); err != nil {
+			logrus.Error("MgoDB: create UsersSell index error: ", err)
+		}
+		if err := market.EnsureOrderIndexes(); err != nil {
+			logrus.Error("MgoDB: create Order index error: ", err)
+		}
+		if err := commodity.EnsureGatheringIndexes(); err != nil {
+			logrus.Error("MgoDB: create Cooldown index error: ", err)
+		}
+	}
+	web.ListingTTL = seconds(cfg.Market.ListingTTL)
+	activities, err := commodity.LoadActivitiesFile(cfg.Gathering.File)
+	if err != nil {
+		logrus.Fatal("FAILED to load gathering loot tables: ", err)
+	}
+	commodity.SetActivities(activities)
+	// 共识参数: 初始难度，期望出块间隔，按最近多少个区块调整难度，区块奖励和减半间隔
+	block.Consensus.InitialBits = cfg.Chain.DifficultyBits
+	block.Consensus.TargetSpacing = seconds(cfg.Chain.BlockSpacing)
+	block.Consensus.RetargetWindow = cfg.Chain.RetargetWindow
+	block.Consensus.Subsidy = cfg.Mining.Reward
+	block.Consensus.HalvingInterval = cfg.Mining.HalvingInterval
+	// 交易池的最低手续费是本节点的策略，各节点可以不同
+	block.MinFee = cfg.Mempool.MinFee
+	// 商店和托管是系统用户，其他用户的钱包只在注册时生成
+	for _, userid := range []string{commodity.ShopID, commodity.EscrowID} {
+		if _, err := wallet.Get(userid); err != nil {
+			logrus.Fatal("FAILED to create ", userid, " wallet: ", err)
+		}
+	}
+	// 物品的发行人，默认是本节点 shop 用户的钱包；启用 P2P 时配置检查要求设置 ITEM_ISSUER
+	block.Consensus.Issuer = cfg.Chain.Issuer
+	if block.Consensus.Issuer == "" {
+		if block.Consensus.Issuer, err = wallet.Address(commodity.ShopID); err != nil {
+			logrus.Fatal("FAILED to create issuer wallet: ", err)
+		}
+	}
+	if err := block.Init(store); err != nil {
+		logrus.Fatal("FAILED to init blockchain: ", err)
+	}
+
+	if len(args) > 0 {
+		runCommand(args[0])
+		return
+	}
+
+	if cfg.P2P.Listen != "" || len(cfg.P2P.Peers) > 0 {
+		if err := p2p.Start(cfg.P2P.Listen, cfg.P2P.Peers); err != nil {
+			logrus.Fatal("FAILED to start p2p node: ", err)
+		}
+		defer p2p.Stop()
+	}
+	// 旧版本保存在 MongoDB 中的背包发行为链上的物品
+	if database.Mgo.Client != nil {
+		if err := commodity.MigrateInventories(); err != nil {
+			logrus.Error("MgoDB: migrate Commodity data error: ", err)
+		}
+		// 每分钟关闭过期的挂单，剩余物品退回卖家
+		market.StartExpiry(time.Minute)
+	}
+	// 新区块和交易发布到事件总线，由 /api/events 推送给客户端
+	events.WatchChain()
+	// 交易池每隔 mempool.interval 秒或攒够 mempool.maxSize 笔交易就打包出块
+	block.StartProducer(seconds(cfg.Mempool.Interval), cfg.Mempool.MaxSize)
+	go runWebServer(cfg.HTTP.Port)
 	time.Sleep(1e8 * time.Second)
 
 }
 
+// runCommand 执行命令行子命令后退出
+// ./main reindex 从创世区块重建 UTXO 集合
+// ./main verify  校验整条链，发现问题时以状态码 1 退出
+func runCommand(cmd string) {
+	switch cmd {
+	case "reindex":
+		if err := block.Reindex(); err != nil {
+			fmt.Println("Reindex failed: ", err)
+			os.Exit(1)
+		}
+		fmt.Println("Reindex UTXO set success")
+	case "verify":
+		result, err := block.VerifyChain()
+		if err != nil {
+			fmt.Println("Verify failed: ", err)
+			os.Exit(1)
+		}
+		if !result.Valid {
+			fmt.Printf("Chain is INVALID at block %d (%s): %s\n", result.BadIndex, result.BadHash, result.Reason)
+			os.Exit(1)
+		}
+		fmt.Printf("Chain is valid, %d blocks verified\n", result.Blocks)
+	default:
+		fmt.Println("Unknown command: ", cmd)
+		fmt.Println("Usage: main [flags] [reindex|verify]")
+		os.Exit(2)
+	}
+}
+
 // web server
-func runWebServer() {
+func runWebServer(port int) {
 	r := setupRouter()
-	httpPort := os.Getenv("PORT")
 	r.Use(cors.Default())
-	err := r.Run(":" + httpPort)
-	logrus.Info("Run client in port 8080！")
+	logrus.Info("Run client in port ", port)
+	err := r.Run(":" + strconv.Itoa(port))
 	if err != nil {
-		logrus.Fatal("ERROR in Run client in port 8080！")
+		logrus.Fatal("ERROR in Run client in port ", port, ": ", err)
 	}
 }
 
+func seconds(n int) time.Duration {
+	return time.Duration(n) * time.Second
+}
+
 func setupRouter() *gin.Engine {
-	r := gin.Default()
+	r := gin.New()
+	// 访问日志中不记录查询参数 token 的值
+	r.Use(web.AccessLogger(), gin.Recovery())
 	r.Use(cors.Default())
+	// 请求带有令牌时绑定登录用户，auth.Required 的接口需要登录，只能以自己的身份操作（管理员除外）；
+	// 只有 /api/events 可以用查询参数 token 传递令牌
+	r.Use(auth.Authenticate("/api/events"))
+	// 账号、物品目录、采集和市场的数据保存在 MongoDB 中，没有配置 MongoDB 时这些接口返回 503
+	// 匹配/api/login 登录，返回令牌
+	r.POST("/api/login", web.RequireDatabase(), web.Login)
 	// 匹配/api/profile?userid=xxx
-	r.GET("/api/profile", web.GetProfile)
-	// 匹配/api/mining?userid=xxx&amount=xxx
-	r.GET("/api/mining", web.GetMineBlock)
+	r.GET("/api/profile", auth.Required(), web.GetProfile)
+	// 匹配/api/mining?userid=xxx 需要镐子，奖励和掉落由服务器决定
+	r.GET("/api/mining", web.RequireDatabase(), auth.Required(), web.GetMineBlock)
 
 	// 匹配/api/shop/list
-	r.GET("/api/shop/list", web.GetShopList)
+	r.GET("/api/shop/list", web.RequireDatabase(), web.GetShopList)
 	// 匹配/api/restaurant/list
-	r.GET("/api/restaurant/list", web.GetRestaurantList)
+	r.GET("/api/restaurant/list", web.RequireDatabase(), web.GetRestaurantList)
+	// 匹配/api/items 完整的物品目录
+	r.GET("/api/items", web.RequireDatabase(), web.GetItems)
 
-	// 匹配/api/transaction 测试交易
-	r.POST("/api/transaction", web.Textcointx)
+	// 匹配/api/transaction 测试交易，表单参数 from、to、amount，可选手续费 fee
+	r.POST("/api/transaction", auth.Required(), web.Textcointx)
+	// 匹配/api/transaction/fee?size=xxx 按交易池估计手续费
+	r.GET("/api/transaction/fee", web.GetFeeEstimate)
 
-	// 匹配/api/blockchain/status
+	// 匹配/api/blockchain/status 全部区块，区块多时用 /api/blocks 分页查询
 	r.GET("/api/blockchain/status", web.GetBlockchainStatus)
-	// 匹配/api/blockchain/records?userid=xxx
-	r.GET("/api/blockchain/records", web.GetTransactionRecords)
+	// 匹配/api/blocks?from=xxx&limit=xxx 按高度分页查询区块
+	r.GET("/api/blocks", web.GetBlocks)
+	// 匹配/api/blocks/:height
+	r.GET("/api/blocks/:height", web.GetBlockByHeight)
+	// 匹配/api/blocks/hash/:hash
+	r.GET("/api/blocks/hash/:hash", web.GetBlockByHash)
+	// 匹配/api/tx/:txid 交易和所在区块
+	r.GET("/api/tx/:txid", web.GetTransaction)
+	// 匹配/api/address/:id/utxos?after=xxx&limit=xxx 用户或地址的 UTXO
+	r.GET("/api/address/:id/utxos", web.GetAddressUTXOs)
+	// 匹配/api/blockchain/verify 校验整条链
+	r.GET("/api/blockchain/verify", auth.Admin(), web.VerifyBlockchain)
+	// 匹配/api/blockchain/proof?txid=xxx 交易的 Merkle 认证路径
+	r.GET("/api/blockchain/proof", web.GetMerkleProof)
+	// 匹配/api/blockchain/mempool 等待打包的交易
+	r.GET("/api/blockchain/mempool", web.GetMempool)
+	// 匹配/api/blockchain/reorgs 最近的链重组
+	r.GET("/api/blockchain/reorgs", web.GetReorgs)
+	// 匹配/api/supply 币的发行、销毁和流通数量
+	r.GET("/api/supply", web.GetSupply)
+	// 匹配/api/events?userid=xxx&topics=xxx,xxx 用 Server-Sent Events 推送新区块、交易、挂单、购买和物品变化
+	r.GET("/api/events", web.GetEvents)
+	// 匹配/api/p2p/peers 已连接的节点
+	r.GET("/api/p2p/peers", auth.Admin(), web.GetPeers)
+	// 匹配/api/blockchain/records?userid=xxx&from=xxx&to=xxx
+	r.GET("/api/blockchain/records", auth.Required(), web.GetTransactionRecords)
 
 	// 匹配/api/spot/transaction
-	r.POST("/api/spot/transaction", web.PostSpotTransaction)
+	r.POST("/api/spot/transaction", web.RequireDatabase(), auth.Required(), web.PostSpotTransaction)
 
 	// 匹配/api/users/sell
-	r.POST("/api/users/sell", web.PutOnSell)
-	// 匹配/api/users/purchase
-	r.GET("/api/users/purchase", web.PurchaseRequest)
-	// 匹配/api/users/list
-	r.GET("/api/users/list", web.GetUsersSellList)
+	r.POST("/api/users/sell", web.RequireDatabase(), auth.Required(), web.PutOnSell)
+	// 匹配/api/users/purchase?id=xxx&amount=xxx 购买挂单，amount 省略时买下剩余的全部
+	r.GET("/api/users/purchase", web.RequireDatabase(), auth.Required(), web.PurchaseRequest)
+	// 匹配/api/users/cancel 表单参数 id，卖家撤单
+	r.POST("/api/users/cancel", web.RequireDatabase(), auth.Required(), web.CancelSell)
+	// 匹配/api/users/list?state=xxx&user=xxx
+	r.GET("/api/users/list", web.RequireDatabase(), web.GetUsersSellList)
+
+	// 匹配/api/market/:item/orderbook?depth=xxx 物品的订单簿
+	r.GET("/api/market/:item/orderbook", web.RequireDatabase(), web.GetOrderBook)
+	// 匹配/api/market/orders 表单参数 item、side、type、price、quantity，下单并撮合
+	r.POST("/api/market/orders", web.RequireDatabase(), auth.Required(), web.PlaceOrder)
+	// 匹配/api/market/orders?userid=xxx&state=xxx 用户的订单
+	r.GET("/api/market/orders", web.RequireDatabase(), auth.Required(), web.GetOrders)
+	// 匹配/api/market/orders/:id 撤单
+	r.DELETE("/api/market/orders/:id", web.RequireDatabase(), auth.Required(), web.CancelOrder)
+	// 匹配/api/market/trades?item=xxx&limit=xxx 最近的成交
+	r.GET("/api/market/trades", web.RequireDatabase(), web.GetTrades)
+
+	// /api/fishing/check?userid=xxx  200 可以，400 不足，提示鱼竿不足，获取鱼竿再来，429 冷却中
+	r.GET("/api/fishing/check", web.RequireDatabase(), auth.Required(), web.CheckFishing)
 
-	// /api/fishing/check?userid=xxx  200 可以，400 不足，提示鱼竿不足，获取鱼竿再来
-	r.GET("/api/fishing/check", web.CheckFishing)
+	// /api/mining/check?userid=xxx  200 可以，400 不足，提示镐子不足，获取镐子再来，429 冷却中
+	r.GET("/api/mining/check", web.RequireDatabase(), auth.Required(), web.CheckMining)
 
-	// /api/mining/check?userid=xxx  200 可以，400 不足，提示镐子不足，获取镐子再来
-	r.GET("/api/mining/check", web.CheckMining)
+	// 匹配/api/fishing?userid=xxx 捕鱼，返回按掉落表得到的物品
+	r.GET("/api/fishing", web.RequireDatabase(), auth.Required(), web.Fishing)
 
-	// 匹配/api/fishing?userid=xxx&amount=xxx 捕鱼，无返回值
-	r.GET("/api/fishing", web.Fishing)
+	// /api/logging/check?userid=xxx  200 可以，400 不足，提示斧子不足，获取斧子再来，429 冷却中
+	r.GET("/api/logging/check", web.RequireDatabase(), auth.Required(), web.CheckLogging)
 
-	// /api/logging/check?userid=xxx  200 可以，400 不足，提示斧子不足，获取斧子再来
-	r.GET("/api/logging/check", web.CheckLogging)
+	// 匹配/api/logging?userid=xxx 伐木，返回按掉落表得到的物品
+	r.GET("/api/logging", web.RequireDatabase(), auth.Required(), web.Logging)
 
-	// 匹配/api/logging?userid=xxx&amount=xxx 伐木，无返回值
-	r.GET("/api/logging", web.Logging)
+	// 匹配/api/wallet?userid=xxx 查询用户的钱包地址和公钥
+	r.GET("/api/wallet", web.GetWallet)
 
-	// 匹配/api/register?userid=xxx 200 成功，400 失败
-	r.GET("/api/register", web.Register)
+	// 匹配/api/register 表单参数 userid 和 password，200 成功，400 失败，409 用户已存在
+	r.POST("/api/register", web.RequireDatabase(), web.Register)
 
 	return r
 }
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"BlockChain/auth"
+	"BlockChain/block"
+	"BlockChain/database"
+	"BlockChain/wallet"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TestMain 用内存存储初始化区块链，不连接 MongoDB
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	dir, err := os.MkdirTemp("", "blockchain-test")
+	if err != nil {
+		panic(err)
+	}
+	if err := wallet.Init(filepath.Join(dir, "wallets.json")); err != nil {
+		panic(err)
+	}
+	auth.Init("testsecret", time.Hour, nil)
+	block.Consensus.InitialBits = 4
+	if err := block.Init(block.NewMemoryStore()); err != nil {
+		panic(err)
+	}
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func TestRoutesWithoutMongo(t *testing.T) {
+	if database.Mgo.Client != nil {
+		t.Skip("MongoDB is connected")
+	}
+	r := setupRouter()
+	tests := []struct {
+		method string
+		path   string
+		want   int
+	}{
+		// 保存在 MongoDB 中的数据返回 503，不能 panic
+		{"POST", "/api/login", http.StatusServiceUnavailable},
+		{"POST", "/api/register", http.StatusServiceUnavailable},
+		{"GET", "/api/mining", http.StatusServiceUnavailable},
+		{"GET", "/api/shop/list", http.StatusServiceUnavailable},
+		{"GET", "/api/restaurant/list", http.StatusServiceUnavailable},
+		{"GET", "/api/items", http.StatusServiceUnavailable},
+		{"POST", "/api/spot/transaction", http.StatusServiceUnavailable},
+		{"POST", "/api/users/sell", http.StatusServiceUnavailable},
+		{"GET", "/api/users/purchase", http.StatusServiceUnavailable},
+		{"POST", "/api/users/cancel", http.StatusServiceUnavailable},
+		{"GET", "/api/users/list", http.StatusServiceUnavailable},
+		{"GET", "/api/market/Wood/orderbook", http.StatusServiceUnavailable},
+		{"POST", "/api/market/orders", http.StatusServiceUnavailable},
+		{"GET", "/api/market/orders", http.StatusServiceUnavailable},
+		{"DELETE", "/api/market/orders/x", http.StatusServiceUnavailable},
+		{"GET", "/api/market/trades", http.StatusServiceUnavailable},
+		{"GET", "/api/fishing", http.StatusServiceUnavailable},
+		{"GET", "/api/fishing/check", http.StatusServiceUnavailable},
+		{"GET", "/api/mining/check", http.StatusServiceUnavailable},
+		{"GET", "/api/logging", http.StatusServiceUnavailable},
+		{"GET", "/api/logging/check", http.StatusServiceUnavailable},
+		// 区块链的接口只使用区块链存储
+		{"GET", "/api/blockchain/status", http.StatusOK},
+		{"GET", "/api/blocks", http.StatusOK},
+		{"GET", "/api/blocks/0", http.StatusOK},
+		{"GET", "/api/blockchain/mempool", http.StatusOK},
+		{"GET", "/api/supply", http.StatusOK},
+		{"GET", "/api/transaction/fee", http.StatusOK},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, nil))
+		if w.Code != tt.want {
+			t.Errorf("%s %s: status %d, want %d: %s", tt.method, tt.path, w.Code, tt.want, w.Body.String())
+		}
+	}
+}
+
+func TestTransfer(t *testing.T) {
+	for _, userid := range []string{"alice", "bob"} {
+		if _, err := wallet.Get(userid); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := block.MineBlock("alice"); err != nil {
+		t.Fatal(err)
+	}
+	token, _, err := auth.IssueToken("alice", auth.RoleUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := block.MinFee
+	block.MinFee = 1
+	defer func() { block.MinFee = saved }()
+	r := setupRouter()
+	tests := []struct {
+		name  string
+		query string
+		form  string
+		want  int
+		fee   int // 接受时响应中的手续费
+	}{
+		{"registered user", "", "from=alice&to=bob&amount=1", http.StatusAccepted, 1},
+		{"unknown user", "", "from=alice&to=nobody&amount=1", http.StatusBadRequest, 0},
+		{"unknown sender", "", "from=carol&to=bob&amount=1", http.StatusForbidden, 0},
+		{"fee in form", "", "from=alice&to=bob&amount=1&fee=2", http.StatusAccepted, 2},
+		{"fee in query", "?fee=3", "from=alice&to=bob&amount=1", http.StatusAccepted, 3},
+		{"invalid fee in query", "?fee=x", "from=alice&to=bob&amount=1", http.StatusBadRequest, 0},
+		{"fee below minimum in query", "?fee=0", "from=alice&to=bob&amount=1", http.StatusBadRequest, 0},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("POST", "/api/transaction"+tt.query, strings.NewReader(tt.form))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != tt.want {
+			t.Errorf("%s: status %d, want %d: %s", tt.name, w.Code, tt.want, w.Body.String())
+			continue
+		}
+		var body struct {
+			Fee int `json:"fee"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body.Fee != tt.fee {
+			t.Errorf("%s: fee %d, want %d: %s", tt.name, body.Fee, tt.fee, w.Body.String())
+		}
+	}
+	// 转给不存在的用户不会生成钱包
+	if _, ok := wallet.Find("nobody"); ok {
+		t.Error("transfer created a wallet for an unknown user")
+	}
+}
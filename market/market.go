@@ -0,0 +1,363 @@
+package market
+
+import (
+	"BlockChain/block"
+	"BlockChain/commodity"
+	"BlockChain/database"
+	"BlockChain/events"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"math"
+	"sync"
+	"time"
+)
+
+// 挂单的状态
+const (
+	StateOpen      = "open"      // 可以购买
+	StateFilled    = "filled"    // 全部售出
+	StateCancelled = "cancelled" // 卖家撤单，剩余物品已退回
+	StateExpired   = "expired"   // 超过有效期，剩余物品已退回
+)
+
+var (
+	ErrNotFound      = errors.New("market: listing not found")
+	ErrNotOpen       = errors.New("market: listing is not open")
+	ErrExpired       = errors.New("market: listing has expired")
+	ErrNotSeller     = errors.New("market: only the seller can cancel the listing")
+	ErrOwnListing    = errors.New("market: cannot buy your own listing")
+	ErrTooMany       = errors.New("market: quantity exceeds what is left in the listing")
+	ErrInvalidAmount = errors.New("market: amount and price must be positive and their product must fit in an int")
+)
+
+// Listing 是用户的挂单。挂单时卖家的物品转给托管用户，购买时在一笔交易中
+// 由买家付 Price × 数量 个币给卖家、托管的物品转给买家，可以分多次买完。
+// Created 和 Expires 是 Unix 秒，Expires 为 0 时不会过期，JSON 中为 RFC 3339
+type Listing struct {
+	ID        string `json:"id" bson:"id"`
+	User      string `json:"user" bson:"user"`
+	Commodity string `json:"commodity" bson:"commodity"`
+	Amount    int    `json:"amount" bson:"amount"`       // 挂单的数量
+	Remaining int    `json:"remaining" bson:"remaining"` // 还没有售出的数量
+	Price     int    `json:"price" bson:"price"`         // 单价
+	State     string `json:"state" bson:"state"`
+	Created   int64  `json:"created" bson:"created"`
+	Expires   int64  `json:"expires" bson:"expires"`
+	Fills     []Fill `json:"fills" bson:"fills"`
+}
+
+// Fill 是挂单的一次成交
+type Fill struct {
+	Buyer    string `json:"buyer" bson:"buyer"`
+	Quantity int    `json:"quantity" bson:"quantity"`
+	Txid     string `json:"txid" bson:"txid"`
+	Time     int64  `json:"time" bson:"time"`
+}
+
+// MarshalJSON 把时间输出为 RFC 3339，不过期的挂单 expires 为 null
+func (l Listing) MarshalJSON() ([]byte, error) {
+	type alias Listing
+	var expires *string
+	if l.Expires != 0 {
+		s := formatTime(l.Expires)
+		expires = &s
+	}
+	if l.Fills == nil {
+		l.Fills = []Fill{}
+	}
+	return json.Marshal(struct {
+		alias
+		Created string  `json:"created"`
+		Expires *string `json:"expires"`
+	}{alias(l), formatTime(l.Created), expires})
+}
+
+func (f Fill) MarshalJSON() ([]byte, error) {
+	type alias Fill
+	return json.Marshal(struct {
+		alias
+		Time string `json:"time"`
+	}{alias(f), formatTime(f.Time)})
+}
+
+// overflows 判断 price × quantity 是否超出 int 的范围，quantity 不是正数时返回 false
+func overflows(price, quantity int) bool {
+	return quantity > 0 && price > math.MaxInt/quantity
+}
+
+func formatTime(ts int64) string {
+	return time.Unix(ts, 0).UTC().Format(time.RFC3339)
+}
+
+// escrowMu 保证同一时间只有一个操作花费托管用户的物品，否则并发的交易会选中同一个输出
+var escrowMu sync.Mutex
+
+func listings() *mongo.Collection {
+	return database.Mgo.Db.Collection("UsersSell")
+}
+
+// EnsureIndexes 建立挂单 id 的唯一索引，并把旧版本没有状态的挂单设为 open
+func EnsureIndexes() error {
+	_, err := listings().Indexes().CreateMany(context.Background(), []mongo.IndexModel{
+		{Keys: bson.D{{"id", 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{"state", 1}, {"expires", 1}}},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = listings().UpdateMany(context.Background(), bson.D{{"state", bson.D{{"$exists", false}}}},
+		mongo.Pipeline{{{"$set", bson.D{
+			{"state", StateOpen}, {"remaining", "$amount"}, {"created", time.Now().Unix()}, {"expires", 0},
+		}}}})
+	return err
+}
+
+// Open 挂单出售 seller 的 amount 个物品 item，单价 price，ttl 为 0 时不会过期。
+// 物品先转给托管用户，不够时返回 *commodity.InsufficientError
+func Open(seller, item string, amount, price int, ttl time.Duration) (Listing, error) {
+	if amount <= 0 || price <= 0 || overflows(price, amount) {
+		return Listing{}, ErrInvalidAmount
+	}
+	if _, err := commodity.FindItem(item); err != nil {
+		return Listing{}, err
+	}
+	now := time.Now()
+	listing := Listing{
+		ID:        database.GenerateRandomString(20),
+		User:      seller,
+		Commodity: item,
+		Amount:    amount,
+		Remaining: amount,
+		Price:     price,
+		State:     StateOpen,
+		Created:   now.Unix(),
+	}
+	if ttl > 0 {
+		listing.Expires = now.Add(ttl).Unix()
+	}
+	if err := commodity.Transfer(seller, commodity.EscrowID, map[string]int{item: amount}); err != nil {
+		return Listing{}, err
+	}
+	if _, err := listings().InsertOne(context.Background(), listing); err != nil {
+		logrus.Error("MgoDB: Insert UsersSell data error: ", err)
+		escrowMu.Lock()
+		refund(listing, amount)
+		escrowMu.Unlock()
+		return Listing{}, err
+	}
+	logrus.Info("MgoDB: Insert UsersSell data success")
+	events.Publish(events.TopicListing, nil, listingEvent("new", listing))
+	publishInventory(seller)
+	return listing, nil
+}
+
+// Find 返回 id 对应的挂单
+func Find(id string) (Listing, error) {
+	result := Listing{}
+	err := listings().FindOne(context.Background(), bson.D{{"id", id}}).Decode(&result)
+	if err == mongo.ErrNoDocuments {
+		return result, ErrNotFound
+	}
+	return result, err
+}
+
+// List 返回状态为 state 的挂单，state 为空时返回全部；user 不为空时只返回这个卖家的挂单
+func List(state, user string) ([]Listing, error) {
+	filter := bson.D{}
+	if state != "" {
+		filter = append(filter, bson.E{"state", state})
+	}
+	if user != "" {
+		filter = append(filter, bson.E{"user", user})
+	}
+	cursor, err := listings().Find(context.Background(), filter, options.Find().SetSort(bson.D{{"created", 1}}))
+	if err != nil {
+		return nil, err
+	}
+	results := []Listing{}
+	err = cursor.All(context.Background(), &results)
+	return results, err
+}
+
+// Buy 从挂单 id 中购买 quantity 个物品，quantity 为 0 时买下剩余的全部。
+// 先在挂单上原子地扣减剩余数量，再提交付款和交付物品的交换交易，交易失败时恢复剩余数量
+func Buy(buyer, id string, quantity int) (Listing, block.Transaction, error) {
+	listing, err := Find(id)
+	if err != nil {
+		return listing, block.Transaction{}, err
+	}
+	if listing.User == buyer {
+		return listing, block.Transaction{}, ErrOwnListing
+	}
+	if quantity == 0 {
+		quantity = listing.Remaining
+	}
+	// 总价溢出时买家托管的币会变成很小的数
+	if quantity <= 0 || overflows(listing.Price, quantity) {
+		return listing, block.Transaction{}, ErrInvalidAmount
+	}
+
+	escrowMu.Lock()
+	defer escrowMu.Unlock()
+	now := time.Now().Unix()
+	filter := bson.D{
+		{"id", id}, {"state", StateOpen}, {"remaining", bson.D{{"$gte", quantity}}},
+		{"$or", bson.A{bson.D{{"expires", 0}}, bson.D{{"expires", bson.D{{"$gt", now}}}}}},
+	}
+	result, err := listings().UpdateOne(context.Background(), filter, bson.D{{"$inc", bson.D{{"remaining", -quantity}}}})
+	if err != nil {
+		return listing, block.Transaction{}, err
+	}
+	if result.MatchedCount == 0 {
+		return listing, block.Transaction{}, unavailable(id, now)
+	}
+
+	tx, err := commodity.Swap(buyer, listing.User, commodity.EscrowID, listing.Price*quantity,
+		map[string]int{listing.Commodity: quantity})
+	if err != nil {
+		listings().UpdateOne(context.Background(), bson.D{{"id", id}}, bson.D{{"$inc", bson.D{{"remaining", quantity}}}})
+		return listing, block.Transaction{}, err
+	}
+
+	fill := Fill{buyer, quantity, tx.ID, now}
+	listings().UpdateOne(context.Background(), bson.D{{"id", id}}, bson.D{{"$push", bson.D{{"fills", fill}}}})
+	listings().UpdateOne(context.Background(), bson.D{{"id", id}, {"remaining", 0}, {"state", StateOpen}},
+		bson.D{{"$set", bson.D{{"state", StateFilled}}}})
+	listing, _ = Find(id)
+	logrus.Info("Market: ", buyer, " bought ", quantity, " ", listing.Commodity, " from listing ", id)
+
+	action := "fill"
+	if listing.State == StateFilled {
+		action = "sold"
+	}
+	events.Publish(events.TopicListing, nil, listingEvent(action, listing))
+	events.Publish(events.TopicPurchase, []string{buyer, listing.User},
+		map[string]interface{}{"buyer": buyer, "sell": listing, "quantity": quantity, "txid": tx.ID})
+	publishInventory(buyer)
+	return listing, tx, nil
+}
+
+// unavailable 在扣减剩余数量失败后找出原因，过期的挂单顺便退回物品
+func unavailable(id string, now int64) error {
+	listing, err := Find(id)
+	if err != nil {
+		return err
+	}
+	switch {
+	case listing.State != StateOpen:
+		return ErrNotOpen
+	case listing.Expires != 0 && listing.Expires <= now:
+		expire(listing)
+		return ErrExpired
+	default:
+		return ErrTooMany
+	}
+}
+
+// Cancel 由卖家撤销挂单，剩余的物品从托管用户退回卖家
+func Cancel(seller, id string) (Listing, error) {
+	listing, err := Find(id)
+	if err != nil {
+		return listing, err
+	}
+	if listing.User != seller {
+		return listing, ErrNotSeller
+	}
+
+	escrowMu.Lock()
+	defer escrowMu.Unlock()
+	if !closeListing(listing, StateCancelled) {
+		return listing, ErrNotOpen
+	}
+	listing, _ = Find(id)
+	logrus.Info("Market: listing ", id, " cancelled by ", seller)
+	events.Publish(events.TopicListing, nil, listingEvent("cancelled", listing))
+	return listing, nil
+}
+
+// ExpireListings 关闭已经过期的挂单，并把剩余物品退回卖家
+func ExpireListings() {
+	cursor, err := listings().Find(context.Background(), bson.D{
+		{"state", StateOpen}, {"expires", bson.D{{"$gt", 0}, {"$lte", time.Now().Unix()}}},
+	})
+	if err != nil {
+		logrus.Error("MgoDB: Find UsersSell data error: ", err)
+		return
+	}
+	var expired []Listing
+	if err := cursor.All(context.Background(), &expired); err != nil {
+		logrus.Error("MgoDB: Find UsersSell data error: ", err)
+		return
+	}
+	escrowMu.Lock()
+	defer escrowMu.Unlock()
+	for _, listing := range expired {
+		expire(listing)
+	}
+}
+
+// StartExpiry 启动每隔 interval 关闭过期挂单的协程
+func StartExpiry(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			ExpireListings()
+		}
+	}()
+}
+
+// expire 把挂单设为 expired 并退回物品，调用方需要持有 escrowMu
+func expire(listing Listing) {
+	if closeListing(listing, StateExpired) {
+		listing.State = StateExpired
+		logrus.Info("Market: listing ", listing.ID, " expired")
+		events.Publish(events.TopicListing, nil, listingEvent("expired", listing))
+	}
+}
+
+// closeListing 把 open 的挂单设为 state，并把剩余物品退回卖家。
+// 挂单已经不是 open 时返回 false。调用方需要持有 escrowMu
+func closeListing(listing Listing, state string) bool {
+	after := options.After
+	err := listings().FindOneAndUpdate(context.Background(),
+		bson.D{{"id", listing.ID}, {"state", StateOpen}},
+		bson.D{{"$set", bson.D{{"state", state}}}},
+		&options.FindOneAndUpdateOptions{ReturnDocument: &after}).Decode(&listing)
+	if err != nil {
+		if err != mongo.ErrNoDocuments {
+			logrus.Error("MgoDB: Update UsersSell data error: ", err)
+		}
+		return false
+	}
+	refund(listing, listing.Remaining)
+	return true
+}
+
+// refund 把托管的 quantity 个物品退回卖家，调用方需要持有 escrowMu
+func refund(listing Listing, quantity int) {
+	if quantity <= 0 {
+		return
+	}
+	err := commodity.Transfer(commodity.EscrowID, listing.User, map[string]int{listing.Commodity: quantity})
+	if err != nil {
+		logrus.Error("Market: refund listing ", listing.ID, " error: ", err)
+		return
+	}
+	publishInventory(listing.User)
+}
+
+func listingEvent(action string, listing Listing) map[string]interface{} {
+	return map[string]interface{}{"action": action, "sell": listing}
+}
+
+func publishInventory(userid string) {
+	if C, err := commodity.GetPersonalInfo(userid); err == nil {
+		events.Publish(events.TopicInventory, []string{userid}, C)
+	}
+}
@@ -0,0 +1,43 @@
+package market
+
+import (
+	"math"
+	"testing"
+)
+
+func TestOverflows(t *testing.T) {
+	tests := []struct {
+		price, quantity int
+		want            bool
+	}{
+		{10, 3, false},
+		{math.MaxInt, 1, false},
+		{math.MaxInt, 2, true},
+		{math.MaxInt/2 + 1, 2, true},
+		{math.MaxInt / 2, 2, false},
+		{2, math.MaxInt/2 + 1, true},
+		{10, 0, false},
+	}
+	for _, tt := range tests {
+		if got := overflows(tt.price, tt.quantity); got != tt.want {
+			t.Errorf("overflows(%d, %d) = %v, want %v", tt.price, tt.quantity, got, tt.want)
+		}
+	}
+}
+
+// 数量和价格在访问数据库之前检查
+func TestOpenInvalidAmount(t *testing.T) {
+	tests := []struct {
+		name          string
+		amount, price int
+	}{
+		{"zero amount", 0, 10},
+		{"negative price", 1, -1},
+		{"total overflows", math.MaxInt / 2, 3},
+	}
+	for _, tt := range tests {
+		if _, err := Open("alice", "Wood", tt.amount, tt.price, 0); err != ErrInvalidAmount {
+			t.Errorf("%s: Open = %v, want ErrInvalidAmount", tt.name, err)
+		}
+	}
+}
@@ -0,0 +1,565 @@
+package market
+
+import (
+	"BlockChain/block"
+	"BlockChain/commodity"
+	"BlockChain/database"
+	"BlockChain/events"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"math"
+	"time"
+)
+
+// 订单方向和类型
+const (
+	SideBuy  = "buy"
+	SideSell = "sell"
+
+	TypeLimit  = "limit"  // 限价单，没有成交的部分留在订单簿上
+	TypeMarket = "market" // 市价单，按订单簿上的价格立即成交，没有成交的部分取消
+)
+
+var (
+	ErrInvalidOrder = errors.New("market: invalid order")
+	ErrNoLiquidity  = errors.New("market: no orders to match")
+	ErrNotOwner     = errors.New("market: only the owner can cancel the order")
+)
+
+// MatchError 表示订单已经下单，但撮合中途失败: Order 是订单的最新状态，Trades 是失败之前已经完成的成交
+type MatchError struct {
+	Order  Order
+	Trades []Trade
+	Err    error
+}
+
+func (e *MatchError) Error() string {
+	return "market: match order " + e.Order.ID + ": " + e.Err.Error()
+}
+
+func (e *MatchError) Unwrap() error {
+	return e.Err
+}
+
+// Order 是订单簿上的订单。卖单下单时物品转给托管用户，买单下单时 Price × Quantity 个币转给托管用户，
+// Locked 是买单还没有用掉的托管币，订单成交完或取消时退回。
+// 撮合按价格优先、时间优先（Seq）进行，成交价是订单簿上已有订单的价格
+type Order struct {
+	ID        string `json:"id" bson:"id"`
+	User      string `json:"user" bson:"user"`
+	Item      string `json:"item" bson:"item"`
+	Side      string `json:"side" bson:"side"`
+	Type      string `json:"type" bson:"type"`
+	Price     int    `json:"price" bson:"price"` // 限价，市价单为 0
+	Quantity  int    `json:"quantity" bson:"quantity"`
+	Remaining int    `json:"remaining" bson:"remaining"`
+	Locked    int    `json:"locked" bson:"locked"`
+	State     string `json:"state" bson:"state"` // open / filled / cancelled
+	Created   int64  `json:"created" bson:"created"`
+	Seq       int64  `json:"-" bson:"seq"`
+}
+
+// Trade 是一次成交，托管用户在同一笔交易 Tx 中把币付给卖家、把物品转给买家
+type Trade struct {
+	ID        string `json:"id" bson:"id"`
+	Item      string `json:"item" bson:"item"`
+	Price     int    `json:"price" bson:"price"`
+	Quantity  int    `json:"quantity" bson:"quantity"`
+	Buyer     string `json:"buyer" bson:"buyer"`
+	Seller    string `json:"seller" bson:"seller"`
+	BuyOrder  string `json:"buyOrder" bson:"buyOrder"`
+	SellOrder string `json:"sellOrder" bson:"sellOrder"`
+	Tx        string `json:"tx" bson:"tx"`
+	Time      int64  `json:"time" bson:"time"`
+}
+
+// PriceLevel 是订单簿上一个价格的汇总
+type PriceLevel struct {
+	Price    int `json:"price"`
+	Quantity int `json:"quantity"`
+	Orders   int `json:"orders"`
+}
+
+// OrderBook 是一种物品的订单簿，买单按价格从高到低，卖单按价格从低到高
+type OrderBook struct {
+	Item string       `json:"item"`
+	Bids []PriceLevel `json:"bids"`
+	Asks []PriceLevel `json:"asks"`
+}
+
+func (o Order) MarshalJSON() ([]byte, error) {
+	type alias Order
+	return json.Marshal(struct {
+		alias
+		Created string `json:"created"`
+	}{alias(o), formatTime(o.Created)})
+}
+
+func (t Trade) MarshalJSON() ([]byte, error) {
+	type alias Trade
+	return json.Marshal(struct {
+		alias
+		Time string `json:"time"`
+	}{alias(t), formatTime(t.Time)})
+}
+
+func orders() *mongo.Collection {
+	return database.Mgo.Db.Collection("Order")
+}
+
+func trades() *mongo.Collection {
+	return database.Mgo.Db.Collection("Trade")
+}
+
+// EnsureOrderIndexes 建立订单和成交记录的索引
+func EnsureOrderIndexes() error {
+	_, err := orders().Indexes().CreateMany(context.Background(), []mongo.IndexModel{
+		{Keys: bson.D{{"id", 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{"item", 1}, {"side", 1}, {"state", 1}, {"price", 1}, {"seq", 1}}},
+		{Keys: bson.D{{"user", 1}, {"seq", -1}}},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = trades().Indexes().CreateMany(context.Background(), []mongo.IndexModel{
+		{Keys: bson.D{{"item", 1}, {"time", -1}}},
+		{Keys: bson.D{{"time", -1}}},
+	})
+	return err
+}
+
+// PlaceOrder 下单并立即撮合，返回订单的最新状态和这次下单产生的成交。
+// 限价单没有成交的部分留在订单簿上；市价单按数量吃掉订单簿上的对手单，没有成交的部分取消。
+// 物品或币不够时返回 *commodity.InsufficientError 或 block.ErrInsufficientFunds，这时什么都不会修改；
+// 下单之后撮合失败时返回 *MatchError，其中有订单的状态和已经完成的成交
+func PlaceOrder(user, item, side, kind string, price, quantity int) (Order, []Trade, error) {
+	// 买单托管 price × quantity 个币，溢出时买家只托管很少的币，却能用托管用户里别人的币成交
+	if quantity <= 0 || (side != SideBuy && side != SideSell) ||
+		(kind == TypeLimit && price <= 0) || (kind == TypeMarket && price != 0) ||
+		(kind != TypeLimit && kind != TypeMarket) || overflows(price, quantity) {
+		return Order{}, nil, ErrInvalidOrder
+	}
+	if _, err := commodity.FindItem(item); err != nil {
+		return Order{}, nil, err
+	}
+
+	escrowMu.Lock()
+	defer escrowMu.Unlock()
+	now := time.Now()
+	order := Order{
+		ID:        database.GenerateRandomString(20),
+		User:      user,
+		Item:      item,
+		Side:      side,
+		Type:      kind,
+		Price:     price,
+		Quantity:  quantity,
+		Remaining: quantity,
+		State:     StateOpen,
+		Created:   now.Unix(),
+		Seq:       now.UnixNano(),
+	}
+
+	// 托管: 卖单托管物品，买单托管币。市价买单按订单簿上能成交的总价托管
+	if side == SideSell {
+		if kind == TypeMarket {
+			bids, err := restingOrders(item, SideBuy, user)
+			if err != nil {
+				return Order{}, nil, err
+			}
+			if len(bids) == 0 {
+				return Order{}, nil, ErrNoLiquidity
+			}
+		}
+		if err := commodity.Transfer(user, commodity.EscrowID, map[string]int{item: quantity}); err != nil {
+			return Order{}, nil, err
+		}
+	} else {
+		order.Locked = price * quantity
+		if kind == TypeMarket {
+			cost, err := marketCost(order)
+			if err != nil {
+				return Order{}, nil, err
+			}
+			order.Locked = cost
+		}
+		if _, err := pay(user, commodity.EscrowID, order.Locked); err != nil {
+			return Order{}, nil, err
+		}
+	}
+	if _, err := orders().InsertOne(context.Background(), order); err != nil {
+		logrus.Error("MgoDB: Insert Order data error: ", err)
+		release(order)
+		return Order{}, nil, err
+	}
+
+	made, err := match(&order)
+	// 市价单不留在订单簿上
+	if order.State == StateOpen && order.Type == TypeMarket {
+		if cerr := closeOrder(&order, StateCancelled); err == nil {
+			err = cerr
+		}
+	}
+	events.Publish(events.TopicOrder, nil, orderEvent("new", order))
+	publishInventory(user)
+	if err != nil {
+		logrus.Error("Market: match order ", order.ID, " error: ", err)
+		return order, made, &MatchError{order, made, err}
+	}
+	return order, made, nil
+}
+
+// CancelOrder 由下单用户取消订单，退回没有成交部分的物品或币
+func CancelOrder(user, id string) (Order, error) {
+	escrowMu.Lock()
+	defer escrowMu.Unlock()
+	order, err := FindOrder(id)
+	if err != nil {
+		return order, err
+	}
+	if order.User != user {
+		return order, ErrNotOwner
+	}
+	if order.State != StateOpen {
+		return order, ErrNotOpen
+	}
+	if err := closeOrder(&order, StateCancelled); err != nil {
+		return order, err
+	}
+	events.Publish(events.TopicOrder, nil, orderEvent("cancelled", order))
+	publishInventory(user)
+	return order, nil
+}
+
+// FindOrder 返回 id 对应的订单
+func FindOrder(id string) (Order, error) {
+	result := Order{}
+	err := orders().FindOne(context.Background(), bson.D{{"id", id}}).Decode(&result)
+	if err == mongo.ErrNoDocuments {
+		return result, ErrNotFound
+	}
+	return result, err
+}
+
+// UserOrders 返回用户的订单，新的在前；state 为空时返回全部状态
+func UserOrders(user, state string, limit int) ([]Order, error) {
+	filter := bson.D{{"user", user}}
+	if state != "" {
+		filter = append(filter, bson.E{"state", state})
+	}
+	cursor, err := orders().Find(context.Background(), filter,
+		options.Find().SetSort(bson.D{{"seq", -1}}).SetLimit(int64(limit)))
+	if err != nil {
+		return nil, err
+	}
+	results := []Order{}
+	err = cursor.All(context.Background(), &results)
+	return results, err
+}
+
+// Trades 返回最近的成交，新的在前；item 为空时返回全部物品
+func Trades(item string, limit int) ([]Trade, error) {
+	filter := bson.D{}
+	if item != "" {
+		filter = append(filter, bson.E{"item", item})
+	}
+	cursor, err := trades().Find(context.Background(), filter,
+		options.Find().SetSort(bson.D{{"time", -1}}).SetLimit(int64(limit)))
+	if err != nil {
+		return nil, err
+	}
+	results := []Trade{}
+	err = cursor.All(context.Background(), &results)
+	return results, err
+}
+
+// Book 返回物品 item 的订单簿，每边最多 depth 个价格
+func Book(item string, depth int) (OrderBook, error) {
+	book := OrderBook{Item: item, Bids: []PriceLevel{}, Asks: []PriceLevel{}}
+	for _, side := range []string{SideBuy, SideSell} {
+		resting, err := restingOrders(item, side, "")
+		if err != nil {
+			return book, err
+		}
+		levels := priceLevels(resting, depth)
+		if side == SideBuy {
+			book.Bids = levels
+		} else {
+			book.Asks = levels
+		}
+	}
+	return book, nil
+}
+
+// priceLevels 把按撮合顺序排列的订单按价格汇总，最多 depth 个价格
+func priceLevels(resting []Order, depth int) []PriceLevel {
+	levels := []PriceLevel{}
+	for _, o := range resting {
+		if n := len(levels); n > 0 && levels[n-1].Price == o.Price {
+			levels[n-1].Quantity += o.Remaining
+			levels[n-1].Orders++
+		} else if n < depth {
+			levels = append(levels, PriceLevel{o.Price, o.Remaining, 1})
+		} else {
+			break
+		}
+	}
+	return levels
+}
+
+// restingOrders 按撮合顺序返回订单簿上一边的订单: 买单价格从高到低，卖单价格从低到高，同价格先到先得。
+// exclude 的订单不返回，避免和自己成交
+func restingOrders(item, side, exclude string) ([]Order, error) {
+	priceOrder := 1
+	if side == SideBuy {
+		priceOrder = -1
+	}
+	filter := bson.D{{"item", item}, {"side", side}, {"state", StateOpen}, {"type", TypeLimit}}
+	if exclude != "" {
+		filter = append(filter, bson.E{"user", bson.D{{"$ne", exclude}}})
+	}
+	cursor, err := orders().Find(context.Background(), filter,
+		options.Find().SetSort(bson.D{{"price", priceOrder}, {"seq", 1}}))
+	if err != nil {
+		return nil, err
+	}
+	var results []Order
+	err = cursor.All(context.Background(), &results)
+	return results, err
+}
+
+// crosses 判断 taker 能否和订单簿上的 maker 成交
+func crosses(taker, maker Order) bool {
+	if taker.Type == TypeMarket {
+		return true
+	}
+	if taker.Side == SideBuy {
+		return maker.Price <= taker.Price
+	}
+	return maker.Price >= taker.Price
+}
+
+// marketCost 计算市价买单按订单簿能成交的总价，订单簿上没有卖单时返回 ErrNoLiquidity
+func marketCost(taker Order) (int, error) {
+	asks, err := restingOrders(taker.Item, SideSell, taker.User)
+	if err != nil {
+		return 0, err
+	}
+	cost := fillCost(asks, taker.Quantity)
+	if cost == 0 {
+		return 0, ErrNoLiquidity
+	}
+	return cost, nil
+}
+
+// fillCost 计算按撮合顺序排列的卖单 asks 中买 quantity 个物品的总价，卖单不够时只计算能买到的部分，
+// 总价超出 int 的范围时只计算到溢出之前的卖单
+func fillCost(asks []Order, quantity int) int {
+	cost, left := 0, quantity
+	for _, ask := range asks {
+		if left == 0 {
+			break
+		}
+		n := min(left, ask.Remaining)
+		if overflows(ask.Price, n) || n*ask.Price > math.MaxInt-cost {
+			break
+		}
+		cost += n * ask.Price
+		left -= n
+	}
+	return cost
+}
+
+// fillQuantity 返回 taker 和订单簿上的 maker 这一次成交的数量，返回 0 时撮合停止。
+// 市价买单的托管币可能不够，只成交买得起的数量
+func fillQuantity(taker, maker Order) int {
+	if taker.Remaining == 0 || !crosses(taker, maker) {
+		return 0
+	}
+	n := min(taker.Remaining, maker.Remaining)
+	if taker.Side == SideBuy && taker.Type == TypeMarket {
+		n = min(n, taker.Locked/maker.Price)
+	}
+	return n
+}
+
+// match 把 taker 和订单簿上的对手单撮合，直到 taker 成交完或价格不再交叉。调用方需要持有 escrowMu
+func match(taker *Order) ([]Trade, error) {
+	opposite := SideSell
+	if taker.Side == SideSell {
+		opposite = SideBuy
+	}
+	makers, err := restingOrders(taker.Item, opposite, taker.User)
+	if err != nil {
+		return nil, err
+	}
+	var made []Trade
+	for i := range makers {
+		maker := &makers[i]
+		n := fillQuantity(*taker, *maker)
+		if n == 0 {
+			break
+		}
+		buy, sell := taker, maker
+		if taker.Side == SideSell {
+			buy, sell = maker, taker
+		}
+		trade, err := settle(taker, buy, sell, maker.Price, n)
+		if trade.Tx != "" {
+			made = append(made, trade)
+		}
+		if err != nil {
+			return made, err
+		}
+	}
+	return made, nil
+}
+
+// settle 成交 quantity 个物品: 托管用户在一笔交易中把币付给卖家、把物品转给买家，
+// 买单因此成交完时剩余的托管币也在这笔交易中退回买家，交易失败时什么都不会修改。
+// 手续费由下单撮合的用户 taker 付，币不够时返回 block.ErrInsufficientFunds。
+// 然后更新两边订单的剩余数量并记录成交，交易已经提交但订单更新失败时返回成交和错误。调用方需要持有 escrowMu
+func settle(taker, buy, sell *Order, price, quantity int) (Trade, error) {
+	amount := price * quantity
+	refund := 0
+	if buy.Remaining == quantity {
+		refund = buy.Locked - amount
+	}
+	b := block.NewTxBuilder()
+	if err := b.Pay(commodity.EscrowID, sell.User, amount); err != nil {
+		return Trade{}, err
+	}
+	if err := b.Send(commodity.EscrowID, buy.User, buy.Item, quantity); err != nil {
+		if err == block.ErrInsufficientAssets {
+			return Trade{}, &commodity.InsufficientError{UserID: commodity.EscrowID, Item: buy.Item}
+		}
+		return Trade{}, err
+	}
+	if refund > 0 {
+		if err := b.Pay(commodity.EscrowID, buy.User, refund); err != nil {
+			return Trade{}, err
+		}
+	}
+	// 托管用户不付手续费，否则托管的币会少于订单锁定的币
+	if err := payFee(b, taker.User); err != nil {
+		return Trade{}, err
+	}
+	tx, err := b.Submit()
+	if err != nil {
+		return Trade{}, err
+	}
+
+	trade := Trade{
+		ID:        database.GenerateRandomString(20),
+		Item:      buy.Item,
+		Price:     price,
+		Quantity:  quantity,
+		Buyer:     buy.User,
+		Seller:    sell.User,
+		BuyOrder:  buy.ID,
+		SellOrder: sell.ID,
+		Tx:        tx.ID,
+		Time:      time.Now().Unix(),
+	}
+	buy.Remaining -= quantity
+	buy.Locked -= amount + refund
+	sell.Remaining -= quantity
+	logrus.Info("Market: trade ", quantity, " ", trade.Item, " at ", price, " from ", sell.User, " to ", buy.User)
+	events.Publish(events.TopicTrade, []string{buy.User, sell.User}, trade)
+	publishInventory(sell.User)
+
+	if _, err := trades().InsertOne(context.Background(), trade); err != nil {
+		return trade, err
+	}
+	for _, o := range []*Order{buy, sell} {
+		state := StateOpen
+		if o.Remaining == 0 {
+			state = StateFilled
+			o.State = StateFilled
+		}
+		_, err := orders().UpdateOne(context.Background(), bson.D{{"id", o.ID}},
+			bson.D{{"$set", bson.D{{"remaining", o.Remaining}, {"locked", o.Locked}, {"state", state}}}})
+		if err != nil {
+			return trade, err
+		}
+	}
+	return trade, nil
+}
+
+// closeOrder 退回订单没有成交部分的物品或剩余的托管币，然后把订单设为 state。
+// 退回失败时订单保持不变。调用方需要持有 escrowMu
+func closeOrder(o *Order, state string) error {
+	if err := release(*o); err != nil {
+		return err
+	}
+	o.State = state
+	o.Locked = 0
+	_, err := orders().UpdateOne(context.Background(), bson.D{{"id", o.ID}},
+		bson.D{{"$set", bson.D{{"state", state}, {"locked", 0}}}})
+	return err
+}
+
+// release 把订单托管的剩余物品或币退回下单用户，退回币的手续费由下单用户付
+func release(o Order) error {
+	var err error
+	if o.Side == SideSell && o.Remaining > 0 {
+		_, err = transfer(commodity.EscrowID, o.User, o.Item, o.Remaining)
+	} else if o.Side == SideBuy && o.Locked > 0 {
+		b := block.NewTxBuilder()
+		if err = b.Pay(commodity.EscrowID, o.User, o.Locked); err == nil {
+			err = payFee(b, o.User)
+		}
+		if err == nil {
+			_, err = b.Submit()
+		}
+	}
+	if err != nil {
+		logrus.Error("Market: release order ", o.ID, " error: ", err)
+	}
+	return err
+}
+
+// payFee 由 user 付交易池要求的最低手续费，先从 b 中付给 user 的币里扣除
+func payFee(b *block.TxBuilder, user string) error {
+	if block.MinFee <= 0 {
+		return nil
+	}
+	return b.Fee(user, block.MinFee)
+}
+
+// pay 从 from 付 amount 个币给 to，手续费由 from 另外支付，币不够时返回 block.ErrInsufficientFunds
+func pay(from, to string, amount int) (block.Transaction, error) {
+	b := block.NewTxBuilder()
+	if err := b.Pay(from, to, amount); err != nil {
+		return block.Transaction{}, err
+	}
+	return b.Submit()
+}
+
+// transfer 通过背包把 from 的 quantity 个物品转给 to，返回转移物品的交易
+func transfer(from, to, item string, quantity int) (block.Transaction, error) {
+	b := block.NewTxBuilder()
+	if err := b.Send(from, to, item, quantity); err != nil {
+		if err == block.ErrInsufficientAssets {
+			return block.Transaction{}, &commodity.InsufficientError{UserID: from, Item: item}
+		}
+		return block.Transaction{}, err
+	}
+	return b.Submit()
+}
+
+func orderEvent(action string, order Order) map[string]interface{} {
+	return map[string]interface{}{"action": action, "order": order}
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,186 @@
+package market
+
+import (
+	"errors"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func limit(side string, price, remaining int) Order {
+	return Order{Side: side, Type: TypeLimit, Price: price, Quantity: remaining, Remaining: remaining, Locked: price * remaining}
+}
+
+func marketOrder(side string, remaining, locked int) Order {
+	return Order{Side: side, Type: TypeMarket, Quantity: remaining, Remaining: remaining, Locked: locked}
+}
+
+func TestCrosses(t *testing.T) {
+	tests := []struct {
+		name  string
+		taker Order
+		maker Order
+		want  bool
+	}{
+		{"buy above ask", limit(SideBuy, 12, 1), limit(SideSell, 10, 1), true},
+		{"buy at ask", limit(SideBuy, 10, 1), limit(SideSell, 10, 1), true},
+		{"buy below ask", limit(SideBuy, 9, 1), limit(SideSell, 10, 1), false},
+		{"sell below bid", limit(SideSell, 8, 1), limit(SideBuy, 10, 1), true},
+		{"sell at bid", limit(SideSell, 10, 1), limit(SideBuy, 10, 1), true},
+		{"sell above bid", limit(SideSell, 11, 1), limit(SideBuy, 10, 1), false},
+		{"market buy", marketOrder(SideBuy, 1, 100), limit(SideSell, 50, 1), true},
+		{"market sell", marketOrder(SideSell, 1, 0), limit(SideBuy, 1, 1), true},
+	}
+	for _, tt := range tests {
+		if got := crosses(tt.taker, tt.maker); got != tt.want {
+			t.Errorf("%s: crosses = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFillQuantity(t *testing.T) {
+	tests := []struct {
+		name  string
+		taker Order
+		maker Order
+		want  int
+	}{
+		{"taker smaller", limit(SideBuy, 10, 2), limit(SideSell, 10, 5), 2},
+		{"maker smaller", limit(SideBuy, 10, 5), limit(SideSell, 10, 2), 2},
+		{"sell taker", limit(SideSell, 10, 3), limit(SideBuy, 11, 4), 3},
+		{"no cross", limit(SideBuy, 9, 5), limit(SideSell, 10, 5), 0},
+		{"taker filled", Order{Side: SideBuy, Type: TypeLimit, Price: 10}, limit(SideSell, 10, 5), 0},
+		{"market buy with enough coins", marketOrder(SideBuy, 3, 30), limit(SideSell, 10, 5), 3},
+		{"market buy limited by coins", marketOrder(SideBuy, 3, 25), limit(SideSell, 10, 5), 2},
+		{"market buy out of coins", marketOrder(SideBuy, 3, 9), limit(SideSell, 10, 5), 0},
+		{"market sell", marketOrder(SideSell, 4, 0), limit(SideBuy, 1, 2), 2},
+	}
+	for _, tt := range tests {
+		if got := fillQuantity(tt.taker, tt.maker); got != tt.want {
+			t.Errorf("%s: fillQuantity = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+// fill 是模拟撮合中的一次成交
+type fill struct {
+	maker    int
+	price    int
+	quantity int
+}
+
+// simulate 按 match 的方式把 taker 和按撮合顺序排列的 makers 撮合，只更新数量和托管币，不写数据库
+func simulate(taker Order, makers []Order) []fill {
+	var fills []fill
+	for i, maker := range makers {
+		n := fillQuantity(taker, maker)
+		if n == 0 {
+			break
+		}
+		taker.Remaining -= n
+		if taker.Side == SideBuy {
+			taker.Locked -= n * maker.Price
+		}
+		fills = append(fills, fill{i, maker.Price, n})
+	}
+	return fills
+}
+
+func TestMatchSequence(t *testing.T) {
+	asks := []Order{limit(SideSell, 10, 2), limit(SideSell, 10, 1), limit(SideSell, 12, 3), limit(SideSell, 15, 5)}
+	bids := []Order{limit(SideBuy, 20, 1), limit(SideBuy, 18, 2), limit(SideBuy, 18, 2)}
+	tests := []struct {
+		name   string
+		taker  Order
+		makers []Order
+		want   []fill
+	}{
+		{"limit buy stops at its price", limit(SideBuy, 12, 10), asks, []fill{{0, 10, 2}, {1, 10, 1}, {2, 12, 3}}},
+		{"limit buy filled by first maker", limit(SideBuy, 15, 1), asks, []fill{{0, 10, 1}}},
+		{"limit buy without cross", limit(SideBuy, 9, 1), asks, nil},
+		{"limit sell fills in time order", limit(SideSell, 18, 4), bids, []fill{{0, 20, 1}, {1, 18, 2}, {2, 18, 1}}},
+		{"market buy whole book", marketOrder(SideBuy, 20, 1000), asks, []fill{{0, 10, 2}, {1, 10, 1}, {2, 12, 3}, {3, 15, 5}}},
+		{"market buy runs out of coins", marketOrder(SideBuy, 6, 50), asks, []fill{{0, 10, 2}, {1, 10, 1}, {2, 12, 1}}},
+		{"market sell", marketOrder(SideSell, 2, 0), bids, []fill{{0, 20, 1}, {1, 18, 1}}},
+		{"empty book", limit(SideBuy, 10, 1), nil, nil},
+	}
+	for _, tt := range tests {
+		if got := simulate(tt.taker, tt.makers); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: fills = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFillCost(t *testing.T) {
+	asks := []Order{limit(SideSell, 10, 2), limit(SideSell, 12, 3)}
+	tests := []struct {
+		name     string
+		asks     []Order
+		quantity int
+		want     int
+	}{
+		{"first level", asks, 1, 10},
+		{"across levels", asks, 4, 2*10 + 2*12},
+		{"whole book", asks, 5, 2*10 + 3*12},
+		{"more than book", asks, 9, 2*10 + 3*12},
+		{"empty book", nil, 3, 0},
+		{"level overflows", []Order{limit(SideSell, 10, 2), {Side: SideSell, Type: TypeLimit, Price: math.MaxInt, Remaining: 2}}, 4, 2 * 10},
+		{"sum overflows", []Order{{Side: SideSell, Type: TypeLimit, Price: math.MaxInt - 5, Remaining: 1}, limit(SideSell, 10, 1)}, 2, math.MaxInt - 5},
+	}
+	for _, tt := range tests {
+		if got := fillCost(tt.asks, tt.quantity); got != tt.want {
+			t.Errorf("%s: fillCost = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPriceLevels(t *testing.T) {
+	resting := []Order{limit(SideBuy, 20, 1), limit(SideBuy, 20, 2), limit(SideBuy, 18, 4), limit(SideBuy, 15, 1)}
+	tests := []struct {
+		name  string
+		depth int
+		want  []PriceLevel
+	}{
+		{"all levels", 10, []PriceLevel{{20, 3, 2}, {18, 4, 1}, {15, 1, 1}}},
+		{"depth limit", 2, []PriceLevel{{20, 3, 2}, {18, 4, 1}}},
+		{"zero depth", 0, []PriceLevel{}},
+	}
+	for _, tt := range tests {
+		if got := priceLevels(resting, tt.depth); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: priceLevels = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMatchError(t *testing.T) {
+	err := error(&MatchError{Order{ID: "o1"}, nil, ErrNoLiquidity})
+	if !errors.Is(err, ErrNoLiquidity) {
+		t.Errorf("errors.Is(%v, ErrNoLiquidity) = false", err)
+	}
+	if want := "market: match order o1: market: no orders to match"; err.Error() != want {
+		t.Errorf("Error() = %q, want %q", err.Error(), want)
+	}
+}
+
+// 订单在访问数据库之前检查，总价溢出的买单不能下单
+func TestPlaceOrderInvalid(t *testing.T) {
+	tests := []struct {
+		name            string
+		side, kind      string
+		price, quantity int
+	}{
+		{"zero quantity", SideBuy, TypeLimit, 10, 0},
+		{"unknown side", "hold", TypeLimit, 10, 1},
+		{"limit without price", SideBuy, TypeLimit, 0, 1},
+		{"market with price", SideBuy, TypeMarket, 10, 1},
+		{"unknown type", SideBuy, "stop", 10, 1},
+		{"buy total overflows", SideBuy, TypeLimit, math.MaxInt/2 + 1, 2},
+		{"buy total overflows to negative", SideBuy, TypeLimit, math.MaxInt/3 + 1, 3},
+		{"sell total overflows", SideSell, TypeLimit, math.MaxInt, 2},
+	}
+	for _, tt := range tests {
+		if _, _, err := PlaceOrder("alice", "Wood", tt.side, tt.kind, tt.price, tt.quantity); err != ErrInvalidOrder {
+			t.Errorf("%s: PlaceOrder = %v, want ErrInvalidOrder", tt.name, err)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package p2p
+
+import (
+	"BlockChain/block"
+	"encoding/json"
+)
+
+// ProtocolVersion 是节点之间通信协议的版本，版本不同的节点不会互相连接
+const ProtocolVersion = 2
+
+// 消息类型
+const (
+	MsgVersion   = "version"   // 握手: 协议版本、创世区块和链高度
+	MsgGetBlocks = "getblocks" // 请求对方主链上分叉点之后的区块
+	MsgBlocks    = "blocks"    // 回复 getblocks 的一批区块
+	MsgBlock     = "block"     // 广播新区块
+	MsgTx        = "tx"        // 广播新交易
+)
+
+// maxBlocksPerMessage 是一条 blocks 消息最多携带的区块数
+const maxBlocksPerMessage = 500
+
+// Message 是节点之间传输的消息，每条消息是一行 JSON
+type Message struct {
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+type Version struct {
+	Version  int    `json:"version"`
+	Genesis  string `json:"genesis"`
+	Height   int    `json:"height"`
+	AddrFrom string `json:"addrFrom"` // 发送方监听的地址，没有监听时为空
+}
+
+// GetBlocks 带上请求方主链的区块哈希（见 block.Locator），
+// 对方从其中第一个也在自己主链上的区块之后开始回复
+type GetBlocks struct {
+	Locator []string `json:"locator"`
+}
+
+type Blocks struct {
+	Blocks []block.Block `json:"blocks"`
+}
+
+func newMessage(typ string, payload interface{}) (Message, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return Message{}, err
+	}
+	return Message{typ, data}, nil
+}
@@ -0,0 +1,385 @@
+package p2p
+
+import (
+	"BlockChain/block"
+	"encoding/json"
+	"errors"
+	"github.com/sirupsen/logrus"
+	"net"
+	"sync"
+	"time"
+)
+
+// redialInterval 是重新连接断开的种子节点的间隔
+const redialInterval = 5 * time.Second
+
+// PeerInfo 是 Peers 返回的节点信息
+type PeerInfo struct {
+	Addr     string `json:"addr"`
+	Remote   string `json:"remote"`
+	Outbound bool   `json:"outbound"`
+	Height   int    `json:"height"`
+}
+
+// node 是本节点的 P2P 网络状态
+type node struct {
+	addr     string   // 本节点监听的地址
+	seeds    []string // 启动时主动连接的节点
+	listener net.Listener
+
+	mu      sync.Mutex
+	peers   map[*peer]bool
+	heights map[*peer]int
+	sources map[string]*peer // 正在处理的收到的区块的来源节点，键为区块哈希
+	quit    chan struct{}
+}
+
+// n 是节点唯一的 P2P 网络，由 Start 创建
+var n *node
+
+// Start 在 addr 上监听其他节点的连接，并连接 seeds 中的节点。
+// 之后本节点写入的区块和接受的交易会广播给所有已连接的节点，
+// 握手时发现对方的链更长会从对方下载缺少的区块。
+// addr 为空时只主动连接 seeds，不接受连接。
+func Start(addr string, seeds []string) error {
+	if n != nil {
+		return errors.New("p2p: already started")
+	}
+	nd := &node{
+		addr:    addr,
+		seeds:   seeds,
+		peers:   make(map[*peer]bool),
+		heights: make(map[*peer]int),
+		sources: make(map[string]*peer),
+		quit:    make(chan struct{}),
+	}
+	if addr != "" {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			return err
+		}
+		nd.listener = ln
+		go nd.acceptLoop()
+		logrus.Info("P2P: listening on ", addr)
+	}
+	n = nd
+	block.OnBlock(nd.broadcastBlock)
+	block.OnTransaction(nd.broadcastTx)
+	go nd.dialLoop()
+	return nil
+}
+
+// Stop 关闭监听和所有连接
+func Stop() {
+	if n == nil {
+		return
+	}
+	close(n.quit)
+	if n.listener != nil {
+		n.listener.Close()
+	}
+	n.mu.Lock()
+	for p := range n.peers {
+		p.close()
+	}
+	n.mu.Unlock()
+}
+
+// Peers 返回已经完成握手的节点
+func Peers() []PeerInfo {
+	results := []PeerInfo{}
+	if n == nil {
+		return results
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for p := range n.peers {
+		height, ok := n.heights[p]
+		if !ok {
+			continue
+		}
+		results = append(results, PeerInfo{p.addr, p.conn.RemoteAddr().String(), p.outbound, height})
+	}
+	return results
+}
+
+func (nd *node) acceptLoop() {
+	for {
+		conn, err := nd.listener.Accept()
+		if err != nil {
+			select {
+			case <-nd.quit:
+				return
+			default:
+			}
+			logrus.Error("P2P: accept error: ", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		nd.addPeer(newPeer(conn, false))
+	}
+}
+
+// dialLoop 连接还没有连上的种子节点，断开后定时重连
+func (nd *node) dialLoop() {
+	ticker := time.NewTicker(redialInterval)
+	defer ticker.Stop()
+	for {
+		for _, seed := range nd.seeds {
+			if nd.connected(seed) {
+				continue
+			}
+			conn, err := net.DialTimeout("tcp", seed, redialInterval)
+			if err != nil {
+				logrus.Debug("P2P: dial ", seed, " error: ", err)
+				continue
+			}
+			p := newPeer(conn, true)
+			p.addr = seed
+			nd.addPeer(p)
+		}
+		select {
+		case <-ticker.C:
+		case <-nd.quit:
+			return
+		}
+	}
+}
+
+// connected 检查是否已经有到 addr 的连接
+func (nd *node) connected(addr string) bool {
+	nd.mu.Lock()
+	defer nd.mu.Unlock()
+	for p := range nd.peers {
+		if p.addr == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// addPeer 登记新连接，发送握手消息，并开始收发消息
+func (nd *node) addPeer(p *peer) {
+	nd.mu.Lock()
+	nd.peers[p] = true
+	nd.mu.Unlock()
+	logrus.Info("P2P: connected to ", p.conn.RemoteAddr())
+
+	go p.writeLoop()
+	nd.sendVersion(p)
+	go func() {
+		p.readLoop(nd.handle)
+		nd.mu.Lock()
+		delete(nd.peers, p)
+		delete(nd.heights, p)
+		nd.mu.Unlock()
+		logrus.Info("P2P: disconnected from ", p.conn.RemoteAddr())
+	}()
+}
+
+func (nd *node) sendVersion(p *peer) {
+	genesis, err := block.GenesisHash()
+	if err != nil {
+		logrus.Error("P2P: query genesis block error: ", err)
+		return
+	}
+	height, err := block.Height()
+	if err != nil {
+		logrus.Error("P2P: query chain height error: ", err)
+		return
+	}
+	nd.send(p, MsgVersion, Version{ProtocolVersion, genesis, height, nd.addr})
+}
+
+// requestBlocks 向 p 请求 locator 之后的区块，hashes 放在主链的 locator 之前
+func (nd *node) requestBlocks(p *peer, hashes ...string) {
+	locator, err := block.Locator()
+	if err != nil {
+		logrus.Error("P2P: build locator error: ", err)
+		return
+	}
+	nd.send(p, MsgGetBlocks, GetBlocks{append(hashes, locator...)})
+}
+
+func (nd *node) send(p *peer, typ string, payload interface{}) {
+	m, err := newMessage(typ, payload)
+	if err != nil {
+		logrus.Error("P2P: encode ", typ, " error: ", err)
+		return
+	}
+	p.queue(m)
+}
+
+// broadcast 把消息发给除 except 以外所有完成握手的节点
+func (nd *node) broadcast(typ string, payload interface{}, except *peer) {
+	m, err := newMessage(typ, payload)
+	if err != nil {
+		logrus.Error("P2P: encode ", typ, " error: ", err)
+		return
+	}
+	nd.mu.Lock()
+	defer nd.mu.Unlock()
+	for p := range nd.peers {
+		if _, ok := nd.heights[p]; ok && p != except {
+			p.queue(m)
+		}
+	}
+}
+
+// broadcastBlock 把新接到链上的区块转发给除来源节点以外的所有节点。
+// 链高度不低于区块的节点也可能在另一个分叉上，同样需要这个区块；已经有这个区块的节点不会再转发
+func (nd *node) broadcastBlock(b block.Block) {
+	nd.mu.Lock()
+	from := nd.sources[b.Hash]
+	nd.mu.Unlock()
+	nd.broadcast(MsgBlock, b, from)
+}
+
+func (nd *node) broadcastTx(tx block.Transaction) {
+	nd.broadcast(MsgTx, tx, nil)
+}
+
+// receiveBlock 把 p 发来的区块交给 block.ReceiveBlock，期间记录区块的来源，转发时跳过 p
+func (nd *node) receiveBlock(p *peer, b block.Block) error {
+	nd.mu.Lock()
+	nd.sources[b.Hash] = p
+	nd.mu.Unlock()
+	defer func() {
+		nd.mu.Lock()
+		delete(nd.sources, b.Hash)
+		nd.mu.Unlock()
+	}()
+	return block.ReceiveBlock(b)
+}
+
+// handle 处理一条收到的消息，消息格式错误时断开连接
+func (nd *node) handle(p *peer, m Message) {
+	var err error
+	switch m.Type {
+	case MsgVersion:
+		err = nd.handleVersion(p, m.Payload)
+	case MsgGetBlocks:
+		err = nd.handleGetBlocks(p, m.Payload)
+	case MsgBlocks:
+		err = nd.handleBlocks(p, m.Payload)
+	case MsgBlock:
+		err = nd.handleBlock(p, m.Payload)
+	case MsgTx:
+		err = nd.handleTx(m.Payload)
+	default:
+		logrus.Info("P2P: ignore unknown message ", m.Type, " from ", p.conn.RemoteAddr())
+	}
+	if err != nil {
+		logrus.Error("P2P: ", m.Type, " from ", p.conn.RemoteAddr(), ": ", err)
+		p.close()
+	}
+}
+
+func (nd *node) handleVersion(p *peer, payload json.RawMessage) error {
+	var v Version
+	if err := json.Unmarshal(payload, &v); err != nil {
+		return err
+	}
+	if v.Version != ProtocolVersion {
+		return errors.New("protocol version mismatch")
+	}
+	genesis, err := block.GenesisHash()
+	if err != nil {
+		logrus.Error("P2P: query genesis block error: ", err)
+		return nil
+	}
+	if v.Genesis != genesis {
+		return errors.New("genesis block mismatch")
+	}
+	nd.mu.Lock()
+	if !p.outbound && v.AddrFrom != "" {
+		p.addr = v.AddrFrom
+	}
+	nd.heights[p] = v.Height
+	nd.mu.Unlock()
+
+	height, err := block.Height()
+	if err != nil {
+		logrus.Error("P2P: query chain height error: ", err)
+		return nil
+	}
+	if v.Height > height {
+		nd.requestBlocks(p)
+	}
+	return nil
+}
+
+func (nd *node) handleGetBlocks(p *peer, payload json.RawMessage) error {
+	var req GetBlocks
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return err
+	}
+	fork, err := block.ForkPoint(req.Locator)
+	if err != nil {
+		logrus.Error("P2P: find fork point error: ", err)
+		return nil
+	}
+	blocks, err := block.BlocksFrom(fork+1, maxBlocksPerMessage)
+	if err != nil {
+		logrus.Error("P2P: query blocks error: ", err)
+		return nil
+	}
+	nd.send(p, MsgBlocks, Blocks{blocks})
+	return nil
+}
+
+// handleBlocks 依次处理下载到的区块，一批满了就继续请求下一批
+func (nd *node) handleBlocks(p *peer, payload json.RawMessage) error {
+	var resp Blocks
+	if err := json.Unmarshal(payload, &resp); err != nil {
+		return err
+	}
+	for _, b := range resp.Blocks {
+		nd.setHeight(p, b.Index)
+		if err := nd.receiveBlock(p, b); err != nil && err != block.ErrKnownBlock {
+			logrus.Info("P2P: reject block ", b.Index, " from ", p.conn.RemoteAddr(), ": ", err)
+			return nil
+		}
+	}
+	// 一批满了时从这批的最后一个区块继续，最后一个区块可能还在分叉上
+	if n := len(resp.Blocks); n == maxBlocksPerMessage {
+		nd.requestBlocks(p, resp.Blocks[n-1].Hash)
+	}
+	return nil
+}
+
+// handleBlock 处理广播的新区块，找不到它的前一个区块时向对方请求分叉点之后的区块
+func (nd *node) handleBlock(p *peer, payload json.RawMessage) error {
+	var b block.Block
+	if err := json.Unmarshal(payload, &b); err != nil {
+		return err
+	}
+	nd.setHeight(p, b.Index)
+	switch err := nd.receiveBlock(p, b); err {
+	case nil, block.ErrKnownBlock:
+	case block.ErrOrphanBlock:
+		nd.requestBlocks(p)
+	default:
+		logrus.Info("P2P: reject block ", b.Index, " from ", p.conn.RemoteAddr(), ": ", err)
+	}
+	return nil
+}
+
+func (nd *node) handleTx(payload json.RawMessage) error {
+	var tx block.Transaction
+	if err := json.Unmarshal(payload, &tx); err != nil {
+		return err
+	}
+	// 交易已经在交易池中或无效时 SubmitTransaction 返回错误，这里不需要处理
+	block.SubmitTransaction(tx)
+	return nil
+}
+
+// setHeight 记录对方的链高度
+func (nd *node) setHeight(p *peer, height int) {
+	nd.mu.Lock()
+	defer nd.mu.Unlock()
+	if height > nd.heights[p] {
+		nd.heights[p] = height
+	}
+}
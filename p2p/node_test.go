@@ -0,0 +1,217 @@
+package p2p
+
+import (
+	"BlockChain/block"
+	"BlockChain/wallet"
+	"bufio"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// remote 是另一条链上挖出的区块，创世区块和本节点相同
+var remote []block.Block
+
+// TestMain 先在一个内存存储上挖出 remote，再用新的内存存储启动本节点
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "p2p-test")
+	if err != nil {
+		panic(err)
+	}
+	if err := wallet.Init(filepath.Join(dir, "wallets.json")); err != nil {
+		panic(err)
+	}
+	for _, userid := range []string{"remote", "local"} {
+		if _, err := wallet.Get(userid); err != nil {
+			panic(err)
+		}
+	}
+	block.Consensus.InitialBits = 4
+	if err := block.Init(block.NewMemoryStore()); err != nil {
+		panic(err)
+	}
+	for i := 0; i < 4; i++ {
+		if _, err := block.MineBlock("remote"); err != nil {
+			panic(err)
+		}
+	}
+	if remote, err = block.BlocksFrom(1, 4); err != nil {
+		panic(err)
+	}
+	if err := block.Init(block.NewMemoryStore()); err != nil {
+		panic(err)
+	}
+	if err := Start("127.0.0.1:0", nil); err != nil {
+		panic(err)
+	}
+	code := m.Run()
+	Stop()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// testPeer 是测试中手动收发消息的节点，收到的消息放进 msgs
+type testPeer struct {
+	t    *testing.T
+	conn net.Conn
+	msgs chan Message
+}
+
+// dial 连接本节点并用链高度 height 完成握手
+func dial(t *testing.T, height int) *testPeer {
+	conn, err := net.Dial("tcp", n.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tp := &testPeer{t, conn, make(chan Message, sendQueueSize)}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		scanner := bufio.NewScanner(conn)
+		scanner.Buffer(make([]byte, 64*1024), maxMessageSize)
+		for scanner.Scan() {
+			var m Message
+			if json.Unmarshal(scanner.Bytes(), &m) == nil {
+				tp.msgs <- m
+			}
+		}
+		close(tp.msgs)
+	}()
+
+	m, ok := tp.next(time.Second)
+	if !ok || m.Type != MsgVersion {
+		t.Fatalf("expected version message, got %+v", m)
+	}
+	var v Version
+	json.Unmarshal(m.Payload, &v)
+	before := len(Peers())
+	tp.send(MsgVersion, Version{ProtocolVersion, v.Genesis, height, ""})
+	// 等到本节点处理完握手
+	for i := 0; i < 100 && len(Peers()) == before; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return tp
+}
+
+func (tp *testPeer) send(typ string, payload interface{}) {
+	m, err := newMessage(typ, payload)
+	if err != nil {
+		tp.t.Fatal(err)
+	}
+	if err := json.NewEncoder(tp.conn).Encode(m); err != nil {
+		tp.t.Fatal(err)
+	}
+}
+
+// next 返回下一条消息，timeout 内没有消息或连接已经断开时返回 false
+func (tp *testPeer) next(timeout time.Duration) (Message, bool) {
+	select {
+	case m, ok := <-tp.msgs:
+		return m, ok
+	case <-time.After(timeout):
+		return Message{}, false
+	}
+}
+
+// blocks 返回 timeout 内收到的 block 消息中的区块哈希
+func (tp *testPeer) blocks(timeout time.Duration) []string {
+	var hashes []string
+	for {
+		m, ok := tp.next(timeout)
+		if !ok {
+			return hashes
+		}
+		if m.Type == MsgBlock {
+			var b block.Block
+			json.Unmarshal(m.Payload, &b)
+			hashes = append(hashes, b.Hash)
+		}
+	}
+}
+
+func waitHeight(t *testing.T, want int) {
+	for i := 0; i < 200; i++ {
+		if height, _ := block.Height(); height == want {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	height, _ := block.Height()
+	t.Fatalf("height %d, want %d", height, want)
+}
+
+func hashes(blocks []block.Block) []string {
+	var results []string
+	for _, b := range blocks {
+		results = append(results, b.Hash)
+	}
+	return results
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// TestSync 依次检查: 从链更长的节点下载区块，收到的区块转发给来源以外的所有节点，本节点挖出的区块广播给所有节点
+func TestSync(t *testing.T) {
+	// other 声称链更高，只转发给链更低的节点时它收不到任何区块
+	other := dial(t, 100)
+	source := dial(t, len(remote)-1)
+	last := len(remote) - 1
+
+	tests := []struct {
+		name    string
+		deliver func() []block.Block // 发给本节点或由本节点挖出的区块
+		height  int
+		echo    bool // 来源节点是否也收到这些区块
+	}{
+		{"download", func() []block.Block {
+			for {
+				m, ok := source.next(time.Second)
+				if !ok {
+					t.Fatal("node did not request blocks")
+				}
+				if m.Type == MsgGetBlocks {
+					break
+				}
+			}
+			source.send(MsgBlocks, Blocks{remote[:last]})
+			return remote[:last]
+		}, last, false},
+		{"relay", func() []block.Block {
+			source.send(MsgBlock, remote[last])
+			return remote[last:]
+		}, last + 1, false},
+		{"mine", func() []block.Block {
+			b, err := block.MineBlock("local")
+			if err != nil {
+				t.Fatal(err)
+			}
+			return []block.Block{b}
+		}, last + 2, true},
+	}
+	for _, tt := range tests {
+		want := hashes(tt.deliver())
+		waitHeight(t, tt.height)
+		if got := other.blocks(200 * time.Millisecond); !equal(got, want) {
+			t.Errorf("%s: other peer got blocks %v, want %v", tt.name, got, want)
+		}
+		wantSource := []string(nil)
+		if tt.echo {
+			wantSource = want
+		}
+		if got := source.blocks(200 * time.Millisecond); !equal(got, wantSource) {
+			t.Errorf("%s: source peer got blocks %v, want %v", tt.name, got, wantSource)
+		}
+	}
+}
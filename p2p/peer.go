@@ -0,0 +1,87 @@
+package p2p
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"sync"
+)
+
+// sendQueueSize 是每个节点待发送消息的队列长度，队列满时断开这个节点
+const sendQueueSize = 256
+
+// maxMessageSize 是一条消息的最大字节数
+const maxMessageSize = 64 << 20
+
+// peer 是一个已经建立的 TCP 连接，写消息由单独的协程完成，
+// 这样广播不会因为某个节点很慢而阻塞
+type peer struct {
+	conn     net.Conn
+	outbound bool   // 是否由本节点主动连接
+	addr     string // 对方监听的地址，握手之后才知道
+	send     chan Message
+	done     chan struct{}
+	once     sync.Once
+}
+
+func newPeer(conn net.Conn, outbound bool) *peer {
+	return &peer{
+		conn:     conn,
+		outbound: outbound,
+		send:     make(chan Message, sendQueueSize),
+		done:     make(chan struct{}),
+	}
+}
+
+// queue 把消息放进发送队列，队列满时关闭连接并返回 false
+func (p *peer) queue(m Message) bool {
+	select {
+	case <-p.done:
+		return false
+	default:
+	}
+	select {
+	case p.send <- m:
+		return true
+	default:
+		p.close()
+		return false
+	}
+}
+
+func (p *peer) writeLoop() {
+	enc := json.NewEncoder(p.conn)
+	for {
+		select {
+		case m := <-p.send:
+			if err := enc.Encode(m); err != nil {
+				p.close()
+				return
+			}
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// readLoop 逐行读取消息并交给 handle，连接断开时返回
+func (p *peer) readLoop(handle func(*peer, Message)) {
+	scanner := bufio.NewScanner(p.conn)
+	scanner.Buffer(make([]byte, 64*1024), maxMessageSize)
+	for scanner.Scan() {
+		var m Message
+		if err := json.Unmarshal(scanner.Bytes(), &m); err != nil {
+			p.close()
+			return
+		}
+		handle(p, m)
+	}
+	p.close()
+}
+
+func (p *peer) close() {
+	p.once.Do(func() {
+		close(p.done)
+		p.conn.Close()
+	})
+}
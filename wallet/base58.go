@@ -0,0 +1,66 @@
+package wallet
+
+import (
+	"bytes"
+	"math/big"
+)
+
+var b58Alphabet = []byte("123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz")
+
+// Base58Encode 把字节数组编码为 Base58
+func Base58Encode(input []byte) []byte {
+	var result []byte
+
+	x := big.NewInt(0).SetBytes(input)
+	base := big.NewInt(int64(len(b58Alphabet)))
+	zero := big.NewInt(0)
+	mod := &big.Int{}
+
+	for x.Cmp(zero) != 0 {
+		x.DivMod(x, base, mod)
+		result = append(result, b58Alphabet[mod.Int64()])
+	}
+
+	// 前导的 0 字节编码为字母表的第一个字符
+	for _, b := range input {
+		if b != 0x00 {
+			break
+		}
+		result = append(result, b58Alphabet[0])
+	}
+
+	reverseBytes(result)
+	return result
+}
+
+// Base58Decode 解码 Base58 数据，遇到字母表以外的字符时返回 ok == false
+func Base58Decode(input []byte) ([]byte, bool) {
+	result := big.NewInt(0)
+	zeroBytes := 0
+
+	for _, b := range input {
+		if b != b58Alphabet[0] {
+			break
+		}
+		zeroBytes++
+	}
+
+	for _, b := range input[zeroBytes:] {
+		charIndex := bytes.IndexByte(b58Alphabet, b)
+		if charIndex < 0 {
+			return nil, false
+		}
+		result.Mul(result, big.NewInt(int64(len(b58Alphabet))))
+		result.Add(result, big.NewInt(int64(charIndex)))
+	}
+
+	decoded := result.Bytes()
+	decoded = append(bytes.Repeat([]byte{0x00}, zeroBytes), decoded...)
+	return decoded, true
+}
+
+func reverseBytes(data []byte) {
+	for i, j := 0, len(data)-1; i < j; i, j = i+1, j-1 {
+		data[i], data[j] = data[j], data[i]
+	}
+}
@@ -0,0 +1,93 @@
+package wallet
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"golang.org/x/crypto/ripemd160"
+	"math/big"
+)
+
+const (
+	version            = byte(0x00)
+	addressChecksumLen = 4
+)
+
+// Wallet 保存一对 ECDSA 密钥，公钥是 X 和 Y 坐标拼接起来的字节
+type Wallet struct {
+	PrivateKey ecdsa.PrivateKey
+	PublicKey  []byte
+}
+
+// NewWallet 在 P-256 曲线上生成一对新密钥
+func NewWallet() (*Wallet, error) {
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return walletFromKey(private), nil
+}
+
+func walletFromKey(private *ecdsa.PrivateKey) *Wallet {
+	pubKey := append(private.PublicKey.X.FillBytes(make([]byte, 32)), private.PublicKey.Y.FillBytes(make([]byte, 32))...)
+	return &Wallet{*private, pubKey}
+}
+
+// walletFromD 用私钥的 D 值恢复钱包
+func walletFromD(d []byte) *Wallet {
+	curve := elliptic.P256()
+	private := new(ecdsa.PrivateKey)
+	private.PublicKey.Curve = curve
+	private.D = new(big.Int).SetBytes(d)
+	private.PublicKey.X, private.PublicKey.Y = curve.ScalarBaseMult(d)
+	return walletFromKey(private)
+}
+
+// GetAddress 返回钱包地址: Base58(version + 公钥哈希 + 校验和)
+func (w Wallet) GetAddress() string {
+	pubKeyHash := HashPubKey(w.PublicKey)
+
+	versionedPayload := append([]byte{version}, pubKeyHash...)
+	fullPayload := append(versionedPayload, checksum(versionedPayload)...)
+
+	return string(Base58Encode(fullPayload))
+}
+
+// HashPubKey 计算公钥哈希 RIPEMD160(SHA256(PubKey))
+func HashPubKey(pubKey []byte) []byte {
+	publicSHA256 := sha256.Sum256(pubKey)
+
+	RIPEMD160Hasher := ripemd160.New()
+	RIPEMD160Hasher.Write(publicSHA256[:])
+	return RIPEMD160Hasher.Sum(nil)
+}
+
+// PubKeyHash 从地址中取出公钥哈希，地址无效时返回 nil
+func PubKeyHash(address string) []byte {
+	if !ValidateAddress(address) {
+		return nil
+	}
+	fullPayload, _ := Base58Decode([]byte(address))
+	return fullPayload[1 : len(fullPayload)-addressChecksumLen]
+}
+
+// ValidateAddress 检查地址的版本和校验和
+func ValidateAddress(address string) bool {
+	fullPayload, ok := Base58Decode([]byte(address))
+	if !ok || len(fullPayload) <= 1+addressChecksumLen {
+		return false
+	}
+	actualChecksum := fullPayload[len(fullPayload)-addressChecksumLen:]
+	versionedPayload := fullPayload[:len(fullPayload)-addressChecksumLen]
+	return versionedPayload[0] == version && bytes.Equal(actualChecksum, checksum(versionedPayload))
+}
+
+// checksum 取两次 SHA256 结果的前 4 个字节
+func checksum(payload []byte) []byte {
+	firstSHA := sha256.Sum256(payload)
+	secondSHA := sha256.Sum256(firstSHA[:])
+
+	return secondSHA[:addressChecksumLen]
+}
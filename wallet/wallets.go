@@ -0,0 +1,129 @@
+package wallet
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Wallets 保存每个用户的钱包，以 userid 为键。
+// 私钥保存在本地文件里，文件内容是 userid -> 私钥 D 值的十六进制。
+type Wallets struct {
+	mu      sync.Mutex
+	path    string
+	wallets map[string]*Wallet
+	owners  map[string]string // 钱包地址 -> userid
+}
+
+// ErrNoWallet 表示用户还没有钱包，钱包只在注册账号时生成
+var ErrNoWallet = errors.New("wallet: user has no wallet")
+
+var wallets = &Wallets{wallets: make(map[string]*Wallet), owners: make(map[string]string)}
+
+// Init 从 path 加载钱包文件，文件不存在时从空的钱包集合开始
+func Init(path string) error {
+	if path == "" {
+		path = "data/wallets.json"
+	}
+	wallets.mu.Lock()
+	defer wallets.mu.Unlock()
+
+	wallets.path = path
+	wallets.wallets = make(map[string]*Wallet)
+	wallets.owners = make(map[string]string)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	keys := make(map[string]string)
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return err
+	}
+	for userid, key := range keys {
+		d, err := hex.DecodeString(key)
+		if err != nil {
+			return err
+		}
+		wallets.wallets[userid] = walletFromD(d)
+		wallets.owners[wallets.wallets[userid].GetAddress()] = userid
+	}
+	return nil
+}
+
+// Get 返回 userid 的钱包，用户还没有钱包时生成一个并保存
+func Get(userid string) (*Wallet, error) {
+	wallets.mu.Lock()
+	defer wallets.mu.Unlock()
+
+	if w, ok := wallets.wallets[userid]; ok {
+		return w, nil
+	}
+	w, err := NewWallet()
+	if err != nil {
+		return nil, err
+	}
+	wallets.wallets[userid] = w
+	if err := wallets.save(); err != nil {
+		delete(wallets.wallets, userid)
+		return nil, err
+	}
+	wallets.owners[w.GetAddress()] = userid
+	return w, nil
+}
+
+// Find 返回 userid 已有的钱包，不会生成新钱包
+func Find(userid string) (*Wallet, bool) {
+	wallets.mu.Lock()
+	defer wallets.mu.Unlock()
+
+	w, ok := wallets.wallets[userid]
+	return w, ok
+}
+
+// Owner 返回钱包地址 address 所属的用户，地址不属于本节点的钱包时返回 false
+func Owner(address string) (string, bool) {
+	wallets.mu.Lock()
+	defer wallets.mu.Unlock()
+
+	userid, ok := wallets.owners[address]
+	return userid, ok
+}
+
+// Address 返回 userid 的钱包地址，不会生成新钱包，用户没有钱包时返回 ErrNoWallet
+func Address(userid string) (string, error) {
+	w, ok := Find(userid)
+	if !ok {
+		return "", ErrNoWallet
+	}
+	return w.GetAddress(), nil
+}
+
+// save 把全部钱包写回文件，调用方需要持有 mu。
+// 没有调用过 Init 时钱包只保存在内存中。
+func (ws *Wallets) save() error {
+	if ws.path == "" {
+		return nil
+	}
+	keys := make(map[string]string, len(ws.wallets))
+	for userid, w := range ws.wallets {
+		keys[userid] = hex.EncodeToString(w.PrivateKey.D.FillBytes(make([]byte, 32)))
+	}
+	data, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(ws.path), 0700); err != nil {
+		return err
+	}
+	tmp := ws.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, ws.path)
+}
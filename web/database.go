@@ -0,0 +1,19 @@
+package web
+
+import (
+	"BlockChain/database"
+	"github.com/gin-gonic/gin"
+	"net/http"
+)
+
+// RequireDatabase 用于账号、物品目录、采集和市场等保存在 MongoDB 中的接口，
+// 没有配置 MongoDB（区块链使用 bolt 或 memory 存储）时返回 503
+func RequireDatabase() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if database.Mgo.Client == nil {
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "database is not available"})
+			return
+		}
+		c.Next()
+	}
+}
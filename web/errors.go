@@ -0,0 +1,77 @@
+package web
+
+import (
+	"BlockChain/block"
+	"BlockChain/commodity"
+	"BlockChain/market"
+	"BlockChain/wallet"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+// respondError 把 block、commodity 和 market 包返回的错误转换成响应，响应体都是 {"error": 说明}:
+// 币或参数不对时返回 400，找不到时返回 404，物品不够或和其他写入冲突时返回 409，
+// 冷却中返回 429，其他错误是存储错误，记录日志后返回 500
+func respondError(c *gin.Context, err error) {
+	if e, ok := err.(*commodity.InsufficientError); ok {
+		c.JSON(http.StatusConflict, gin.H{"error": e.Error(), "item": e.Item})
+		return
+	}
+	if e, ok := err.(*commodity.CooldownError); ok {
+		wait := int(math.Ceil(e.Wait.Seconds()))
+		c.Header("Retry-After", strconv.Itoa(wait))
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": e.Error(), "retryAfter": wait})
+		return
+	}
+	switch err {
+	case commodity.ErrInvalidQuantity:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+	case block.ErrInsufficientFunds:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Balance is not enough"})
+	case commodity.ErrUnknownUser, wallet.ErrNoWallet:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid User"})
+	case block.ErrInvalidTransaction, block.ErrDoubleSpend, block.ErrInvalidSignature,
+		block.ErrDuplicateTransaction, block.ErrNoIssuer, block.ErrFeeTooLow,
+		commodity.ErrUnknownActivity, commodity.ErrNoTool:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case block.ErrNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+	case commodity.ErrUnknownItem:
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case block.ErrInsufficientAssets:
+		c.JSON(http.StatusConflict, gin.H{"error": "Items are not enough"})
+	case block.ErrConflict, block.ErrKnownBlock, block.ErrOrphanBlock:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		logrus.Error("Web: ", c.Request.Method, " ", c.Request.URL.Path, " error: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
+	}
+}
+
+// respondMarketError 把挂单和订单的错误转换成响应
+func respondMarketError(c *gin.Context, err error) {
+	switch err {
+	case market.ErrNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Invalid ID"})
+	case market.ErrNotOpen, market.ErrExpired, market.ErrTooMany, market.ErrNoLiquidity:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case market.ErrNotSeller, market.ErrNotOwner:
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case market.ErrOwnListing, market.ErrInvalidAmount, market.ErrInvalidOrder:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		respondError(c, err)
+	}
+}
+
+// respondGatherError 把采集的错误转换成响应，没有工具时提示工具的名字 tool
+func respondGatherError(c *gin.Context, err error, tool string) {
+	if err == commodity.ErrNoTool {
+		c.JSON(http.StatusBadRequest, gin.H{"error": tool + " is not enough"})
+		return
+	}
+	respondError(c, err)
+}
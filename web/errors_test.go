@@ -0,0 +1,45 @@
+package web
+
+import (
+	"BlockChain/block"
+	"BlockChain/commodity"
+	"BlockChain/market"
+	"BlockChain/wallet"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRespondError(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{commodity.ErrUnknownItem, http.StatusNotFound},
+		{block.ErrNotFound, http.StatusNotFound},
+		{market.ErrNotFound, http.StatusNotFound},
+		{commodity.ErrUnknownUser, http.StatusBadRequest},
+		{wallet.ErrNoWallet, http.StatusBadRequest},
+		{commodity.ErrInvalidQuantity, http.StatusBadRequest},
+		{market.ErrInvalidOrder, http.StatusBadRequest},
+		{block.ErrInsufficientFunds, http.StatusBadRequest},
+		{block.ErrFeeTooLow, http.StatusBadRequest},
+		{&commodity.InsufficientError{UserID: "alice", Item: "Wood"}, http.StatusConflict},
+		{block.ErrConflict, http.StatusConflict},
+		{market.ErrNotOwner, http.StatusForbidden},
+		{errors.New("storage failed"), http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest("GET", "/", nil)
+		respondMarketError(c, tt.err)
+		if w.Code != tt.want {
+			t.Errorf("%v: status %d, want %d", tt.err, w.Code, tt.want)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package web
+
+import (
+	"BlockChain/auth"
+	"BlockChain/commodity"
+	"BlockChain/events"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// eventHeartbeat 是没有事件时发送 ping 的间隔，避免连接被代理断开
+const eventHeartbeat = 30 * time.Second
+
+var eventTopics = map[string]bool{
+	events.TopicBlock:     true,
+	events.TopicTx:        true,
+	events.TopicListing:   true,
+	events.TopicPurchase:  true,
+	events.TopicInventory: true,
+	events.TopicOrder:     true,
+	events.TopicTrade:     true,
+}
+
+// GetEvents 匹配/api/events?userid=xxx&topics=xxx,xxx
+// 用 Server-Sent Events 推送事件，事件名是主题。topics 省略时订阅全部主题；
+// 指定 userid 时还推送和这个用户相关的事件，需要以这个用户登录；不指定时只推送公共事件（新区块、挂单），
+// 管理员不指定 userid 时收到全部事件
+func GetEvents(c *gin.Context) {
+	var topics []string
+	if t := c.Query("topics"); t != "" {
+		topics = strings.Split(t, ",")
+		for _, topic := range topics {
+			if !eventTopics[topic] {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid topic " + topic})
+				return
+			}
+		}
+	}
+
+	var sub *events.Subscription
+	if userid := c.Query("userid"); userid != "" {
+		if !authorize(c, userid) {
+			return
+		}
+		sub = events.Subscribe(userid, topics)
+	} else if auth.IsAdmin(c) {
+		sub = events.SubscribeAll(topics)
+	} else {
+		sub = events.Subscribe("", topics)
+	}
+	defer sub.Close()
+	heartbeat := time.NewTicker(eventHeartbeat)
+	defer heartbeat.Stop()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case e, ok := <-sub.C:
+			if !ok {
+				// 客户端读得太慢，订阅已经被关闭，客户端需要重新连接
+				return false
+			}
+			c.SSEvent(e.Topic, e)
+			return true
+		case <-heartbeat.C:
+			c.SSEvent("ping", time.Now().UTC().Format(time.RFC3339))
+			return true
+		case <-c.Request.Context().Done():
+			return false
+		}
+	})
+}
+
+// publishInventory 发布用户当前的物品
+func publishInventory(userid string) {
+	C, err := commodity.GetPersonalInfo(userid)
+	if err != nil {
+		return
+	}
+	events.Publish(events.TopicInventory, []string{userid}, C)
+}
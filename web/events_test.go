@@ -0,0 +1,68 @@
+package web
+
+import (
+	"BlockChain/events"
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestEventTopics(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/api/events", GetEvents)
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	tests := []struct {
+		topics  string
+		want    int
+		publish string // 连接后发布这个主题的公共事件，应该收到
+	}{
+		{"", http.StatusOK, events.TopicBlock},
+		{"block", http.StatusOK, events.TopicBlock},
+		{"listing,purchase,inventory,tx", http.StatusOK, events.TopicListing},
+		{"order", http.StatusOK, events.TopicOrder},
+		{"trade", http.StatusOK, events.TopicTrade},
+		{"order,trade", http.StatusOK, events.TopicTrade},
+		{"orders", http.StatusBadRequest, ""},
+		{"block,unknown", http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		req, _ := http.NewRequestWithContext(ctx, "GET", server.URL+"/api/events?topics="+tt.topics, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("topics=%s: %v", tt.topics, err)
+		}
+		if resp.StatusCode != tt.want {
+			t.Errorf("topics=%s: status %d, want %d", tt.topics, resp.StatusCode, tt.want)
+		}
+		if tt.publish != "" {
+			// 响应头发出时已经订阅，这时发布的事件一定能收到
+			events.Publish(tt.publish, nil, "test")
+			if got := readEvent(resp); got != tt.publish {
+				t.Errorf("topics=%s: event %q, want %q", tt.topics, got, tt.publish)
+			}
+		}
+		cancel()
+		resp.Body.Close()
+	}
+}
+
+// readEvent 返回 Server-Sent Events 流中第一个不是 ping 的事件名
+func readEvent(resp *http.Response) string {
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		if name := strings.TrimPrefix(scanner.Text(), "event:"); name != scanner.Text() && name != "ping" {
+			return name
+		}
+	}
+	return ""
+}
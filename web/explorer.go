@@ -0,0 +1,136 @@
+package web
+
+import (
+	"BlockChain/block"
+	"BlockChain/wallet"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strconv"
+)
+
+// 分页查询每页默认和最多返回的条数
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+// pageLimit 解析查询参数 limit，省略时为 defaultPageSize，超过 maxPageSize 时取 maxPageSize
+func pageLimit(c *gin.Context) (int, bool) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultPageSize)))
+	if err != nil || limit <= 0 {
+		return 0, false
+	}
+	if limit > maxPageSize {
+		limit = maxPageSize
+	}
+	return limit, true
+}
+
+// GetBlocks 匹配/api/blocks?from=xxx&limit=xxx
+// 按高度升序返回从 from 开始的区块，next 是下一页的 from，已经到链尾时为 null
+func GetBlocks(c *gin.Context) {
+	from, err := strconv.Atoi(c.DefaultQuery("from", "0"))
+	if err != nil || from < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid from value"})
+		return
+	}
+	limit, ok := pageLimit(c)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit value"})
+		return
+	}
+
+	blocks, err := block.BlocksFrom(from, limit)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	if blocks == nil {
+		blocks = []block.Block{}
+	}
+	height, err := block.Height()
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	var next interface{}
+	if len(blocks) > 0 && blocks[len(blocks)-1].Index < height {
+		next = blocks[len(blocks)-1].Index + 1
+	}
+	c.JSON(http.StatusOK, gin.H{"blocks": blocks, "next": next, "height": height})
+}
+
+// GetBlockByHeight 匹配/api/blocks/:height
+func GetBlockByHeight(c *gin.Context) {
+	height, err := strconv.Atoi(c.Param("height"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid height value"})
+		return
+	}
+	b, err := block.BlockByHeight(height)
+	respondBlock(c, b, err)
+}
+
+// GetBlockByHash 匹配/api/blocks/hash/:hash
+func GetBlockByHash(c *gin.Context) {
+	b, err := block.BlockByHash(c.Param("hash"))
+	respondBlock(c, b, err)
+}
+
+func respondBlock(c *gin.Context, b block.Block, err error) {
+	if err == block.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Block not found"})
+		return
+	}
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, b)
+}
+
+// GetTransaction 匹配/api/tx/:txid
+func GetTransaction(c *gin.Context) {
+	info, err := block.FindTransaction(c.Param("txid"))
+	if err == block.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Transaction not found"})
+		return
+	}
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, info)
+}
+
+// GetAddressUTXOs 匹配/api/address/:id/utxos?after=xxx&limit=xxx
+// id 可以是用户 ID 或钱包地址；after 是上一页返回的 next（txid:vout），省略时从头开始
+func GetAddressUTXOs(c *gin.Context) {
+	id := c.Param("id")
+	address := id
+	if w, ok := wallet.Find(id); ok {
+		address = w.GetAddress()
+	} else if !wallet.ValidateAddress(id) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Unknown user or address"})
+		return
+	}
+	limit, ok := pageLimit(c)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit value"})
+		return
+	}
+
+	utxos, next, err := block.UTXOPage(address, c.Query("after"), limit)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	if utxos == nil {
+		utxos = []block.UTXO{}
+	}
+	var cursor interface{}
+	if next != "" {
+		cursor = next
+	}
+	c.JSON(http.StatusOK, gin.H{"address": address, "utxos": utxos, "next": cursor})
+}
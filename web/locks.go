@@ -0,0 +1,60 @@
+package web
+
+import (
+	"sort"
+	"sync"
+)
+
+// userLock 是一个用户的锁，refs 为正在使用或等待这个锁的请求数
+type userLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+// 按用户加锁: 同一个用户的余额和物品的读取-修改-写入串行执行，不同用户的请求互不阻塞。
+// 没有请求使用的锁会被删除，locks 不会随用户数增长。
+var (
+	locksMu sync.Mutex
+	locks   = make(map[string]*userLock)
+)
+
+// lockUsers 锁住 ids 中的全部用户，返回解锁函数。
+// ids 排序去重后按顺序加锁，同时锁多个用户的请求之间不会死锁。
+func lockUsers(ids ...string) (unlock func()) {
+	sorted := make([]string, 0, len(ids))
+	seen := make(map[string]bool)
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			sorted = append(sorted, id)
+		}
+	}
+	sort.Strings(sorted)
+
+	held := make([]*userLock, 0, len(sorted))
+	for _, id := range sorted {
+		locksMu.Lock()
+		l, ok := locks[id]
+		if !ok {
+			l = &userLock{}
+			locks[id] = l
+		}
+		l.refs++
+		locksMu.Unlock()
+
+		l.mu.Lock()
+		held = append(held, l)
+	}
+
+	return func() {
+		for i := len(held) - 1; i >= 0; i-- {
+			held[i].mu.Unlock()
+			locksMu.Lock()
+			held[i].refs--
+			if held[i].refs == 0 {
+				delete(locks, sorted[i])
+			}
+			locksMu.Unlock()
+		}
+	}
+}
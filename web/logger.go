@@ -0,0 +1,34 @@
+package web
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"regexp"
+	"time"
+)
+
+// tokenParam 匹配查询参数 token 的值
+var tokenParam = regexp.MustCompile(`([?&]token=)[^&]*`)
+
+// redactToken 把路径中查询参数 token 的值替换成 ***，令牌不能写进访问日志
+func redactToken(path string) string {
+	return tokenParam.ReplaceAllString(path, "${1}***")
+}
+
+// AccessLogger 和 gin.Logger 的格式相同，但是查询参数 token 的值不写进日志
+func AccessLogger() gin.HandlerFunc {
+	return gin.LoggerWithFormatter(func(p gin.LogFormatterParams) string {
+		if p.Latency > time.Minute {
+			p.Latency = p.Latency.Truncate(time.Second)
+		}
+		return fmt.Sprintf("[GIN] %v | %3d | %13v | %15s | %-7s %#v\n%s",
+			p.TimeStamp.Format("2006/01/02 - 15:04:05"),
+			p.StatusCode,
+			p.Latency,
+			p.ClientIP,
+			p.Method,
+			redactToken(p.Path),
+			p.ErrorMessage,
+		)
+	})
+}
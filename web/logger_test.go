@@ -0,0 +1,21 @@
+package web
+
+import "testing"
+
+func TestRedactToken(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/api/events?token=abc.def.ghi", "/api/events?token=***"},
+		{"/api/events?topics=block&token=abc&userid=alice", "/api/events?topics=block&token=***&userid=alice"},
+		{"/api/events?mytoken=abc", "/api/events?mytoken=abc"},
+		{"/api/blocks?from=1", "/api/blocks?from=1"},
+		{"/api/token", "/api/token"},
+	}
+	for _, tt := range tests {
+		if got := redactToken(tt.path); got != tt.want {
+			t.Errorf("redactToken(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package web
+
+import (
+	"BlockChain/auth"
+	"BlockChain/market"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strconv"
+)
+
+// Order 是下单的表单参数，Type 省略时为限价单，市价单不需要 Price
+type Order struct {
+	User     string `json:"user" form:"user"`
+	Item     string `json:"item" form:"item" binding:"required"`
+	Side     string `json:"side" form:"side" binding:"required"`
+	Type     string `json:"type" form:"type"`
+	Price    int    `json:"price" form:"price"`
+	Quantity int    `json:"quantity" form:"quantity" binding:"required"`
+}
+
+// GetOrderBook 匹配/api/market/:item/orderbook?depth=xxx，每边最多返回 depth 个价格，默认 20
+func GetOrderBook(c *gin.Context) {
+	depth, err := strconv.Atoi(c.DefaultQuery("depth", "20"))
+	if err != nil || depth <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid depth value"})
+		return
+	}
+	book, err := market.Book(c.Param("item"), depth)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, book)
+}
+
+// PlaceOrder 匹配/api/market/orders，下单并立即撮合，user 省略时为登录用户
+func PlaceOrder(c *gin.Context) {
+	var order Order
+	if err := c.ShouldBind(&order); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+		return
+	}
+	if order.User == "" {
+		order.User = auth.UserID(c)
+	}
+	if order.Type == "" {
+		order.Type = market.TypeLimit
+	}
+	if !authorize(c, order.User) {
+		return
+	}
+	defer lockUsers(order.User)()
+	result, trades, err := market.PlaceOrder(order.User, order.Item, order.Side, order.Type, order.Price, order.Quantity)
+	if e, ok := err.(*market.MatchError); ok {
+		// 订单已经下单，返回订单状态和已经完成的成交
+		c.JSON(http.StatusConflict, gin.H{"error": e.Error(), "order": e.Order, "trades": e.Trades})
+		return
+	}
+	if err != nil {
+		respondMarketError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"order": result, "trades": trades})
+}
+
+// CancelOrder 匹配/api/market/orders/:id，下单用户撤单，没有成交的物品或币退回
+func CancelOrder(c *gin.Context) {
+	order, err := market.FindOrder(c.Param("id"))
+	if err != nil {
+		respondMarketError(c, err)
+		return
+	}
+	if !authorize(c, order.User) {
+		return
+	}
+	defer lockUsers(order.User)()
+	order, err = market.CancelOrder(order.User, order.ID)
+	if err != nil {
+		respondMarketError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, order)
+}
+
+// GetOrders 匹配/api/market/orders?userid=xxx&state=xxx&limit=xxx，用户的订单，新的在前，state 省略时返回全部
+func GetOrders(c *gin.Context) {
+	userid := c.DefaultQuery("userid", auth.UserID(c))
+	if !authorize(c, userid) {
+		return
+	}
+	state := c.Query("state")
+	switch state {
+	case "", market.StateOpen, market.StateFilled, market.StateCancelled:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid state"})
+		return
+	}
+	limit, ok := pageLimit(c)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit value"})
+		return
+	}
+	results, err := market.UserOrders(userid, state, limit)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, results)
+}
+
+// GetTrades 匹配/api/market/trades?item=xxx&limit=xxx，最近的成交，新的在前，item 省略时返回全部物品
+func GetTrades(c *gin.Context) {
+	limit, ok := pageLimit(c)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit value"})
+		return
+	}
+	results, err := market.Trades(c.Query("item"), limit)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, results)
+}
@@ -1,109 +1,114 @@
 package web
 
 import (
+	"BlockChain/auth"
 	"BlockChain/block"
 	"BlockChain/commodity"
-	"BlockChain/database"
-	"context"
+	"BlockChain/market"
+	"BlockChain/p2p"
+	"BlockChain/wallet"
+	"encoding/hex"
 	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo"
 	"net/http"
 	"strconv"
-	"sync"
 	"time"
 )
 
-var mutex = &sync.Mutex{}
-
-// GetMineBlock 匹配/api/mining?userid=xxx&amount=xxx
+// GetMineBlock 匹配/api/mining?userid=xxx，userid 省略时为登录用户。
+// 需要镐子，冷却结束后才能再次挖矿；奖励是共识的区块奖励加上手续费，挖矿的掉落物品加进背包
 func GetMineBlock(c *gin.Context) {
-	mutex.Lock()
-	defer mutex.Unlock()
-
-	from := c.Query("userid")
-	amount, err := strconv.Atoi(c.DefaultQuery("amount", "0"))
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid amount value"})
+	from := c.DefaultQuery("userid", auth.UserID(c))
+	if from == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing Userid value"})
 		return
-	} else if from != "" {
-		newBlock := block.MineBlock(from, amount)
-		c.JSON(http.StatusCreated, newBlock)
+	}
+	if !authorize(c, from) {
 		return
-	} else {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing Userid value"})
+	}
+	defer lockUsers(from)()
+	// 先挖出区块再发行掉落物品和磨损工具，挖矿失败时冷却被撤销，什么都不会修改
+	var newBlock block.Block
+	mined := false
+	result, err := commodity.GatherWith(from, commodity.ActivityMining, func() (err error) {
+		newBlock, err = block.MineBlock(from)
+		mined = err == nil
+		return err
+	})
+	if err != nil && !mined {
+		respondGatherError(c, err, "Pickaxe")
 		return
 	}
+	reward := 0
+	if len(newBlock.Transactions) > 0 && newBlock.Transactions[0].IsCoinbase() {
+		reward = newBlock.Transactions[0].Vout[0].Value
+	}
+	response := gin.H{"block": newBlock, "reward": reward, "gathering": result}
+	if err != nil {
+		// 区块已经写入，只是掉落物品没有发行
+		logrus.Error("Commodity: issue mining drops to ", from, " error: ", err)
+		response["error"] = "Block was mined but the drops were not issued"
+	}
+	publishInventory(from)
+	c.JSON(http.StatusCreated, response)
 }
 
-// GetProfile 匹配/api/profile?userid=xxx
+// GetProfile 匹配/api/profile?userid=xxx，userid 省略时为登录用户
 func GetProfile(c *gin.Context) {
-	mutex.Lock()
-	defer mutex.Unlock()
-
-	userid := c.Query("userid")
-	C, _ := commodity.GetPersonalInfo(userid)
-	balance := block.GetBalance(userid)
+	userid := c.DefaultQuery("userid", auth.UserID(c))
+	if !authorize(c, userid) {
+		return
+	}
+	C, err := commodity.GetPersonalInfo(userid)
+	if err != nil && err != commodity.ErrUnknownUser {
+		respondError(c, err)
+		return
+	}
+	balance, err := block.GetBalance(userid)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
 	profile := commodity.Profile{Commodity: C, Balance: balance}
 	c.JSON(http.StatusOK, profile)
 }
 
-// GetShopList 匹配/api/shop/list
+// GetShopList 匹配/api/shop/list，返回物品目录中商店出售的物品
 func GetShopList(c *gin.Context) {
-	mutex.Lock()
-	defer mutex.Unlock()
-
 	C, err := commodity.GetShopList()
 	if err != nil {
-		if err == mongo.ErrNoDocuments {
-			// This error means your query did not match any documents.
-			response := gin.H{
-				"message": "BadRequest: Shop list is not exist",
-			}
-			c.JSON(http.StatusNotFound, response)
-		} else {
-			logrus.Error("MgoDB Database error: ", err)
-			response := gin.H{
-				"message": "Internal Server Error",
-			}
-			c.JSON(http.StatusInternalServerError, response)
-		}
+		respondError(c, err)
+	} else if len(C) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Shop list is not exist"})
 	} else {
 		c.JSON(http.StatusOK, C)
 	}
 }
 
-// GetRestaurantList 匹配/api/restaurant/list
+// GetRestaurantList 匹配/api/restaurant/list，返回物品目录中餐厅出售的物品
 func GetRestaurantList(c *gin.Context) {
-	mutex.Lock()
-	defer mutex.Unlock()
-
 	C, err := commodity.GetRestaurantList()
 	if err != nil {
-		if err == mongo.ErrNoDocuments {
-			// This error means your query did not match any documents.
-			response := gin.H{
-				"message": "BadRequest: Restaurant list is not exist",
-			}
-			c.JSON(http.StatusNotFound, response)
-		} else {
-			logrus.Error("MgoDB Database error: ", err)
-			response := gin.H{
-				"message": "Internal Server Error",
-			}
-			c.JSON(http.StatusInternalServerError, response)
-		}
+		respondError(c, err)
+	} else if len(C) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Restaurant list is not exist"})
 	} else {
 		c.JSON(http.StatusOK, C)
 	}
 }
 
+// GetItems 匹配/api/items，返回完整的物品目录
+func GetItems(c *gin.Context) {
+	items, err := commodity.Catalog()
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, items)
+}
+
 // Textcointx 匹配/api/transaction
 func Textcointx(c *gin.Context) {
-	mutex.Lock()
-	defer mutex.Unlock()
-
 	if err := c.Request.ParseForm(); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
 		return
@@ -113,40 +118,184 @@ func Textcointx(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "missing from value"})
 		return
 	}
+	if !authorize(c, from[0]) {
+		return
+	}
 	to, ok := c.Request.Form["to"]
 	if !ok || len(to) == 0 {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "missing to value"})
 		return
 	}
 	amount, ok := c.Request.Form["amount"]
-	amountInt, err := strconv.Atoi(amount[0])
-	if !ok || len(amount) == 0 || err != nil {
+	if !ok || len(amount) == 0 {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "missing amount value"})
 		return
 	}
-	timeNow := time.Now().String()
-	t := block.NewTransaction(timeNow, from[0], to[0], amountInt)
-	b := block.TXBlock(timeNow, t)
-	c.JSON(http.StatusCreated, b)
+	amountInt, err := strconv.Atoi(amount[0])
+	if err != nil || amountInt <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid amount value"})
+		return
+	}
+	// fee 省略时付最低手续费，和其他参数一样可以放在表单或查询参数中
+	fee := block.MinFee
+	if v, ok := c.Request.Form["fee"]; ok && len(v) > 0 {
+		fee, err = strconv.Atoi(v[0])
+	}
+	if err != nil || fee < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid fee value"})
+		return
+	}
+	if fee < block.MinFee {
+		c.JSON(http.StatusBadRequest, gin.H{"error": block.ErrFeeTooLow.Error(), "estimate": block.EstimateFee(typicalTxSize)})
+		return
+	}
+	// 同一个用户的两笔转账不能选中同样的输出
+	defer lockUsers(from[0])()
+	// 只能转给已经注册的用户，不为不存在的用户生成钱包
+	for _, userid := range []string{from[0], to[0]} {
+		if _, ok := wallet.Find(userid); !ok {
+			respondError(c, commodity.ErrUnknownUser)
+			return
+		}
+	}
+	// 交易先进入交易池，转账记录在交易被打包时才写入
+	b := block.NewTxBuilder()
+	err = b.Pay(from[0], to[0], amountInt)
+	if err == nil && fee > 0 {
+		err = b.Fee(from[0], fee)
+	}
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	t, err := b.Submit()
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{"transaction": t, "fee": fee, "estimate": block.EstimateFee(t.Size())})
+}
+
+// typicalTxSize 是一个输入、两个输出的转账交易的大约字节数，估计手续费时的默认大小
+const typicalTxSize = 400
+
+// GetFeeEstimate 匹配/api/transaction/fee?size=xxx，估计 size 字节的交易需要的手续费，size 省略时为一笔普通转账的大小
+func GetFeeEstimate(c *gin.Context) {
+	size, err := strconv.Atoi(c.DefaultQuery("size", strconv.Itoa(typicalTxSize)))
+	if err != nil || size <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid size value"})
+		return
+	}
+	c.JSON(http.StatusOK, block.EstimateFee(size))
 }
 
 // GetBlockchainStatus 匹配/api/blockchain/status
 func GetBlockchainStatus(c *gin.Context) {
-	mutex.Lock()
-	defer mutex.Unlock()
-
-	blocks := block.FindAllBlocks()
+	blocks, err := block.FindAllBlocks()
+	if err != nil {
+		respondError(c, err)
+		return
+	}
 	c.JSON(http.StatusOK, blocks)
 }
 
-// GetTransactionRecords 匹配/api/blockchain/records?userid=xxx
-func GetTransactionRecords(c *gin.Context) {
-	mutex.Lock()
-	defer mutex.Unlock()
+// VerifyBlockchain 匹配/api/blockchain/verify
+func VerifyBlockchain(c *gin.Context) {
+	result, err := block.VerifyChain()
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
 
+// GetMerkleProof 匹配/api/blockchain/proof?txid=xxx
+func GetMerkleProof(c *gin.Context) {
+	txid := c.Query("txid")
+	if txid == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing txid value"})
+		return
+	}
+	proof, err := block.FindMerkleProof(txid)
+	if err != nil {
+		if err == block.ErrNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Transaction is not in any block"})
+		} else {
+			respondError(c, err)
+		}
+		return
+	}
+	c.JSON(http.StatusOK, proof)
+}
+
+// GetWallet 匹配/api/wallet?userid=xxx
+func GetWallet(c *gin.Context) {
 	userid := c.Query("userid")
+	if userid == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing Userid value"})
+		return
+	}
+	w, ok := wallet.Find(userid)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Userid has no wallet"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"userid":    userid,
+		"address":   w.GetAddress(),
+		"publicKey": hex.EncodeToString(w.PublicKey),
+	})
+}
+
+// GetMempool 匹配/api/blockchain/mempool
+func GetMempool(c *gin.Context) {
+	c.JSON(http.StatusOK, block.PendingTransactions())
+}
+
+// GetReorgs 匹配/api/blockchain/reorgs
+func GetReorgs(c *gin.Context) {
+	c.JSON(http.StatusOK, block.Reorgs())
+}
+
+// GetSupply 匹配/api/supply，币的发行、销毁和流通数量
+func GetSupply(c *gin.Context) {
+	info, err := block.Supply()
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, info)
+}
+
+// GetPeers 匹配/api/p2p/peers
+func GetPeers(c *gin.Context) {
+	c.JSON(http.StatusOK, p2p.Peers())
+}
+
+// GetTransactionRecords 匹配/api/blockchain/records?userid=xxx&from=xxx&to=xxx
+// from 和 to 是 RFC 3339 时间，可以省略
+func GetTransactionRecords(c *gin.Context) {
+	since, err := queryTime(c, "from")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid from value"})
+		return
+	}
+	until, err := queryTime(c, "to")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid to value"})
+		return
+	}
+
+	userid := c.DefaultQuery("userid", auth.UserID(c))
 	if userid != "" {
-		records := block.FindAllTransactionRecords(userid)
+		if !authorize(c, userid) {
+			return
+		}
+		records, err := block.FindTransactionRecords(userid, since, until)
+		if err != nil {
+			respondError(c, err)
+			return
+		}
 		if records == nil {
 			c.JSON(http.StatusNotFound, gin.H{"error": "Userid has no transaction records"})
 			return
@@ -158,429 +307,337 @@ func GetTransactionRecords(c *gin.Context) {
 	}
 }
 
-// PostSpotTransaction 匹配/api/spot/transaction
-func PostSpotTransaction(c *gin.Context) {
-	mutex.Lock()
-	defer mutex.Unlock()
+// queryTime 把 RFC 3339 格式的查询参数解析为 Unix 秒，参数为空时返回 0
+func queryTime(c *gin.Context, key string) (int64, error) {
+	value := c.Query(key)
+	if value == "" {
+		return 0, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return 0, err
+	}
+	return t.Unix(), nil
+}
 
+// PostSpotTransaction 匹配/api/spot/transaction，表单参数是物品 id 和购买数量，价格来自物品目录
+func PostSpotTransaction(c *gin.Context) {
 	if err := c.Request.ParseForm(); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
 		return
 	}
-	var err1, err2, err3, err4 error
-	C := commodity.Commodity{}
-	C.UserID = c.DefaultPostForm("userid", "user001")
-	C.Diamond, err1 = strconv.Atoi(c.DefaultPostForm("diamond", "0"))
-	C.Axe, err2 = strconv.Atoi(c.DefaultPostForm("axe", "0"))
-	C.Pickaxe, err3 = strconv.Atoi(c.DefaultPostForm("pickaxe", "0"))
-	C.Fishingrod, err4 = strconv.Atoi(c.DefaultPostForm("fishingrod", "0"))
-	if err1 != nil || err2 != nil || err3 != nil || err4 != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+	userid := c.DefaultPostForm("userid", auth.UserID(c))
+	forSale, err := commodity.ForSale()
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	items := make(map[string]int)
+	for _, item := range forSale {
+		n, err := strconv.Atoi(c.DefaultPostForm(item.ID, "0"))
+		if err != nil || n < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+			return
+		}
+		if n > 0 {
+			items[item.ID] = n
+		}
+	}
+
+	if !authorize(c, userid) {
+		return
+	}
+	defer lockUsers(userid)()
+	amount, ok, err := commodity.Cost(items)
+	if err != nil {
+		respondError(c, err)
 		return
 	}
-	C.Beer, err1 = strconv.Atoi(c.DefaultPostForm("beer", "0"))
-	C.Soda, err2 = strconv.Atoi(c.DefaultPostForm("soda", "0"))
-	C.Hamburger, err3 = strconv.Atoi(c.DefaultPostForm("hamburger", "0"))
-	C.Cola, err4 = strconv.Atoi(c.DefaultPostForm("cola", "0"))
-	if err1 != nil || err2 != nil || err3 != nil || err4 != nil {
+	if !ok {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
 		return
 	}
 
-	amount := C.Diamond*500 + C.Axe*30 + C.Pickaxe*50 + C.Fishingrod*70
-	amount += C.Beer*7 + C.Soda*3 + C.Hamburger*10 + C.Cola*3
-
-	if amount > block.GetBalance(C.UserID) {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Balance is not enough"})
+	balance, err := block.GetBalance(userid)
+	if err != nil {
+		respondError(c, err)
 		return
-	} else {
-		commodity.PostTransaction(C)
-		timeNow := time.Now().String()
-		t := block.NewTransaction(timeNow, C.UserID, "shop", amount)
-		block.TXBlock(timeNow, t)
-		balance := block.GetBalance(C.UserID)
-		Como, _ := commodity.GetPersonalInfo(C.UserID)
-		profile := commodity.Profile{Commodity: Como, Balance: balance}
-		c.JSON(http.StatusOK, profile)
 	}
-
+	if amount > balance {
+		respondError(c, block.ErrInsufficientFunds)
+		return
+	}
+	// 先扣库存，付款和发行物品在同一笔交易中，交易失败时库存会退回
+	if err := commodity.PostTransaction(userid, items, amount); err != nil {
+		respondError(c, err)
+		return
+	}
+	publishInventory(userid)
+	if balance, err = block.GetBalance(userid); err != nil {
+		respondError(c, err)
+		return
+	}
+	Como, err := commodity.GetPersonalInfo(userid)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	profile := commodity.Profile{Commodity: Como, Balance: balance}
+	c.JSON(http.StatusOK, profile)
 }
 
 var cnt int
 
+// ListingTTL 是挂单默认的有效期，为 0 时不会过期，由 main 按配置设置
+var ListingTTL = 7 * 24 * time.Hour
+
+// Sell 是挂单的表单参数，Price 是单价，TTL 是有效期（秒），省略时为 ListingTTL
 type Sell struct {
-	ID        string `json:"id" bson:"id"`
-	User      string `json:"user" form:"user" binding:"required" bson:"user" `
-	Commodity string `json:"commodity" form:"commodity" binding:"required" bson:"commodity"`
-	Amount    int    `json:"amount" form:"amount" binding:"required" bson:"amount"`
-	Price     int    `json:"price" form:"price" binding:"required" bson:"price"`
+	User      string `json:"user" form:"user"`
+	Commodity string `json:"commodity" form:"commodity" binding:"required"`
+	Amount    int    `json:"amount" form:"amount" binding:"required"`
+	Price     int    `json:"price" form:"price" binding:"required"`
+	TTL       *int   `json:"ttl" form:"ttl"`
 }
 
+// PutOnSell 匹配/api/users/sell，物品转给托管用户后上架，user 省略时为登录用户
 func PutOnSell(c *gin.Context) {
-	mutex.Lock()
-	defer mutex.Unlock()
 	var sell Sell
-	if err := c.ShouldBind(&sell); err == nil {
-		//spew.Dump(sell)
-	}
-	client := database.Mgo.Client
-	collection1 := client.Database("BlockChain").Collection("Commodity")
-	result := commodity.Commodity{}
-	filter := bson.D{{"userid", sell.User}}
-	err := collection1.FindOne(context.TODO(), filter).Decode(&result)
-
-	switch sell.Commodity {
-	case "diamond":
-		if result.Diamond < sell.Amount {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Diamond is not enough"})
-			return
-		} else {
-			result.Diamond -= sell.Amount
-		}
-	case "axe":
-		if result.Axe < sell.Amount {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Axe is not enough"})
-			return
-		} else {
-			result.Axe -= sell.Amount
-		}
-	case "pickaxe":
-		if result.Pickaxe < sell.Amount {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Pickaxe is not enough"})
-			return
-		} else {
-			result.Pickaxe -= sell.Amount
-		}
-	case "fishingrod":
-		if result.Fishingrod < sell.Amount {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Fishingrod is not enough"})
-			return
-		} else {
-			result.Fishingrod -= sell.Amount
-		}
-	case "beer":
-		if result.Beer < sell.Amount {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Beer is not enough"})
-			return
-		} else {
-			result.Beer -= sell.Amount
-		}
-	case "soda":
-		if result.Soda < sell.Amount {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Soda is not enough"})
-			return
-		} else {
-			result.Soda -= sell.Amount
-		}
-	case "hamburger":
-		if result.Hamburger < sell.Amount {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Hamburger is not enough"})
-			return
-		} else {
-			result.Hamburger -= sell.Amount
-		}
-	case "cola":
-		if result.Cola < sell.Amount {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Cola is not enough"})
-			return
-		} else {
-			result.Cola -= sell.Amount
-		}
-	case "fish":
-		if result.Fish < sell.Amount {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Fish is not enough"})
-			return
-		} else {
-			result.Fish -= sell.Amount
-		}
-	case "log":
-		if result.Log < sell.Amount {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Log is not enough"})
+	if err := c.ShouldBind(&sell); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+		return
+	}
+	if sell.User == "" {
+		sell.User = auth.UserID(c)
+	}
+	if !authorize(c, sell.User) {
+		return
+	}
+	ttl := ListingTTL
+	if sell.TTL != nil {
+		if *sell.TTL < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
 			return
-		} else {
-			result.Log -= sell.Amount
 		}
-
+		ttl = time.Duration(*sell.TTL) * time.Second
 	}
-
-	filter = bson.D{{"userid", sell.User}}
-	update := bson.D{{"$set", bson.D{{"diamond", result.Diamond}, {"axe", result.Axe},
-		{"pickaxe", result.Pickaxe}, {"fishingrod", result.Fishingrod}, {"beer", result.Beer},
-		{"soda", result.Soda}, {"hamburger", result.Hamburger}, {"cola", result.Cola}, {"fish", result.Fish}, {"log", result.Log}}}}
-	_, err = collection1.UpdateOne(context.Background(), filter, update)
+	defer lockUsers(sell.User)()
+	listing, err := market.Open(sell.User, sell.Commodity, sell.Amount, sell.Price, ttl)
 	if err != nil {
-		logrus.Error("MgoDB: Update Commodity data error: ", err)
-	} else {
-		logrus.Info("MgoDB: Update Commodity data success")
+		respondMarketError(c, err)
+		return
 	}
+	c.JSON(http.StatusOK, gin.H{"id": listing.ID, "listing": listing})
+}
 
-	sell.ID = database.GenerateRandomString(20)
-	collection := client.Database("BlockChain").Collection("UsersSell")
-	_, err = collection.InsertOne(context.TODO(), sell)
+// PurchaseRequest 匹配/api/users/purchase?id=xxx&amount=xxx，amount 省略时买下挂单剩余的全部物品
+func PurchaseRequest(c *gin.Context) {
+	userid := c.DefaultQuery("userid", auth.UserID(c))
+	if !authorize(c, userid) {
+		return
+	}
+	amount, err := strconv.Atoi(c.DefaultQuery("amount", "0"))
+	if err != nil || amount < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid amount value"})
+		return
+	}
+	if _, err := commodity.GetPersonalInfo(userid); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid User"})
+		return
+	}
+	defer lockUsers(userid)()
+	listing, tx, err := market.Buy(userid, c.Query("id"), amount)
 	if err != nil {
-		logrus.Error("MgoDB: Insert BlockChain data error: ", err)
-	} else {
-		logrus.Info("MgoDB: Insert BlockChain data success")
+		respondMarketError(c, err)
+		return
 	}
-	c.JSON(http.StatusOK, gin.H{"id": sell.ID})
+	c.JSON(http.StatusOK, gin.H{"message": "Purchase success", "txid": tx.ID, "listing": listing})
 }
 
-func PurchaseRequest(c *gin.Context) {
-	mutex.Lock()
-	defer mutex.Unlock()
-	userid := c.Query("userid")
-	ID := c.Query("id")
-	client := database.Mgo.Client
-	collection := client.Database("BlockChain").Collection("UsersSell")
-	result := Sell{}
-	filter := bson.D{{"id", ID}}
-	err := collection.FindOne(context.Background(), filter).Decode(&result)
+// CancelSell 匹配/api/users/cancel，表单参数 id，卖家撤单，剩余物品退回卖家
+func CancelSell(c *gin.Context) {
+	listing, err := market.Find(c.PostForm("id"))
 	if err != nil {
-		logrus.Error("MgoDB: FindOne BlockChain data error: ", err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		respondMarketError(c, err)
 		return
 	}
-	balance := block.GetBalance(userid)
-	if balance < result.Price*result.Amount {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Balance is not enough"})
+	if !authorize(c, listing.User) {
 		return
-	} else {
-		collection1 := client.Database("BlockChain").Collection("Commodity")
-		result2 := commodity.Commodity{}
-		filter := bson.D{{"userid", userid}}
-		err := collection1.FindOne(context.TODO(), filter).Decode(&result2)
-		if err != nil {
-			logrus.Error("MgoDB: FindOne Commodity data error: ", err)
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid User"})
-			return
-		}
-		switch result.Commodity {
-		case "diamond":
-			result2.Diamond += result.Amount
-		case "axe":
-			result2.Axe += result.Amount
-		case "pickaxe":
-			result2.Pickaxe += result.Amount
-		case "fishingrod":
-			result2.Fishingrod += result.Amount
-		case "beer":
-			result2.Beer += result.Amount
-		case "soda":
-			result2.Soda += result.Amount
-		case "hamburger":
-			result2.Hamburger += result.Amount
-		case "cola":
-			result2.Cola += result.Amount
-		case "fish":
-			result2.Fish += result.Amount
-		case "log":
-			result2.Log += result.Amount
-		}
-		filter = bson.D{{"userid", userid}}
-		update := bson.D{{"$set", bson.D{{"diamond", result2.Diamond},
-			{"axe", result2.Axe}, {"pickaxe", result2.Pickaxe},
-			{"fishingrod", result2.Fishingrod}, {"beer", result2.Beer},
-			{"soda", result2.Soda}, {"hamburger", result2.Hamburger}, {"cola", result2.Cola}, {"fish", result2.Fish}, {"log", result2.Log}}}}
-		_, err = collection1.UpdateOne(context.Background(), filter, update)
-		if err != nil {
-			logrus.Error("MgoDB: Update Commodity data error: ", err)
-		} else {
-			logrus.Info("MgoDB: Update Commodity data success")
-		}
-		timeNow := time.Now().String()
-		t := block.NewTransaction(timeNow, userid, result.User, result.Price)
-		_ = block.TXBlock(timeNow, t)
-
-		collection := client.Database("BlockChain").Collection("UsersSell")
-		filter3 := bson.D{{"id", ID}}
-		collection.DeleteOne(context.Background(), filter3)
-		c.JSON(http.StatusOK, "Purchase success")
 	}
-
+	defer lockUsers(listing.User)()
+	listing, err = market.Cancel(listing.User, listing.ID)
+	if err != nil {
+		respondMarketError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, listing)
 }
 
+// GetUsersSellList 匹配/api/users/list?state=xxx&user=xxx，state 省略时返回 open 的挂单，state=all 返回全部
 func GetUsersSellList(c *gin.Context) {
-	client := database.Mgo.Client
-	collection := client.Database("BlockChain").Collection("UsersSell")
-	cursor, err := collection.Find(context.Background(), bson.D{})
-	if err != nil {
-		logrus.Error("MgoDB: Find BlockChain data error: ", err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+	state := c.DefaultQuery("state", market.StateOpen)
+	switch state {
+	case market.StateOpen, market.StateFilled, market.StateCancelled, market.StateExpired:
+	case "all":
+		state = ""
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid state"})
 		return
 	}
-	var results []Sell
-	if err = cursor.All(context.Background(), &results); err != nil {
-		logrus.Error("MgoDB: All BlockChain data error: ", err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+	results, err := market.List(state, c.Query("user"))
+	if err != nil {
+		respondError(c, err)
 		return
 	}
 	c.JSON(http.StatusOK, results)
 }
 
 func Fishing(c *gin.Context) {
-	mutex.Lock()
-	defer mutex.Unlock()
-	userid := c.Query("userid")
-	amount, _ := strconv.Atoi(c.Query("amount"))
-	client := database.Mgo.Client
-	collection := client.Database("BlockChain").Collection("Commodity")
-	result := commodity.Commodity{}
-	filter := bson.D{{"userid", userid}}
-	err := collection.FindOne(context.Background(), filter).Decode(&result)
-	if err != nil {
-		logrus.Error("MgoDB: FindOne Commodity data error: ", err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid User"})
-		return
-	}
-
-	result.Fish += amount
-	filter = bson.D{{"userid", userid}}
-	update := bson.D{{"$set", bson.D{{"fish", result.Fish}}}}
-	_, err = collection.UpdateOne(context.Background(), filter, update)
-	if err != nil {
-		logrus.Error("MgoDB: Update Commodity data error: ", err)
-	} else {
-		logrus.Info("MgoDB: Update Commodity data success")
-	}
-	c.JSON(http.StatusOK, "Fishing success")
+	gather(c, commodity.ActivityFishing, "Fishingrod", "Fishing success")
 }
 
 func Logging(c *gin.Context) {
-	mutex.Lock()
-	defer mutex.Unlock()
-	userid := c.Query("userid")
-	amount, _ := strconv.Atoi(c.Query("amount"))
-	client := database.Mgo.Client
-	collection := client.Database("BlockChain").Collection("Commodity")
-	result := commodity.Commodity{}
-	filter := bson.D{{"userid", userid}}
-	err := collection.FindOne(context.Background(), filter).Decode(&result)
-	if err != nil {
-		logrus.Error("MgoDB: FindOne Commodity data error: ", err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid User"})
+	gather(c, commodity.ActivityLogging, "Axe", "Logging success")
+}
+
+// gather 进行一次采集 activity，掉落的物品由服务器按掉落表决定，tool 是工具的名字，用于提示信息
+func gather(c *gin.Context, activity, tool, message string) {
+	userid := c.DefaultQuery("userid", auth.UserID(c))
+	if !authorize(c, userid) {
 		return
 	}
-
-	result.Log += amount
-	filter = bson.D{{"userid", userid}}
-	update := bson.D{{"$set", bson.D{{"log", result.Log}}}}
-	_, err = collection.UpdateOne(context.Background(), filter, update)
+	defer lockUsers(userid)()
+	result, err := commodity.Gather(userid, activity)
 	if err != nil {
-		logrus.Error("MgoDB: Update Commodity data error: ", err)
-	} else {
-		logrus.Info("MgoDB: Update Commodity data success")
+		respondGatherError(c, err, tool)
+		return
 	}
-	c.JSON(http.StatusOK, "Logging success")
+	publishInventory(userid)
+	c.JSON(http.StatusOK, gin.H{"message": message, "gathering": result})
 }
 
 func CheckFishing(c *gin.Context) {
-	mutex.Lock()
-	defer mutex.Unlock()
-	userid := c.Query("userid")
-	client := database.Mgo.Client
-	collection := client.Database("BlockChain").Collection("Commodity")
-	result := commodity.Commodity{}
-	filter := bson.D{{"userid", userid}}
-	err := collection.FindOne(context.Background(), filter).Decode(&result)
-	if err != nil {
-		logrus.Error("MgoDB: FindOne Commodity data error: ", err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid User"})
+	checkTool(c, commodity.ActivityFishing, "Fishingrod")
+}
+
+func CheckMining(c *gin.Context) {
+	checkTool(c, commodity.ActivityMining, "Pickaxe")
+}
+
+func CheckLogging(c *gin.Context) {
+	checkTool(c, commodity.ActivityLogging, "Axe")
+}
+
+// checkTool 检查用户现在能否进行采集 activity: 有没有工具、是否还在冷却，name 是工具的名字，用于提示信息
+func checkTool(c *gin.Context, activity, name string) {
+	userid := c.DefaultQuery("userid", auth.UserID(c))
+	if !authorize(c, userid) {
 		return
 	}
-	if result.Fishingrod <= 0 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Fishingrod is not enough"})
+	result, err := commodity.CheckGather(userid, activity)
+	if err != nil {
+		respondGatherError(c, err, name)
 		return
-	} else {
-		c.JSON(http.StatusOK, "Fishingrod is enough")
 	}
+	c.JSON(http.StatusOK, gin.H{"message": name + " is enough", "tool": result.Tool,
+		"uses": result.Uses, "durability": result.Durability})
 }
 
-func CheckMining(c *gin.Context) {
-	mutex.Lock()
-	defer mutex.Unlock()
-	userid := c.Query("userid")
-	client := database.Mgo.Client
-	collection := client.Database("BlockChain").Collection("Commodity")
-	result := commodity.Commodity{}
-	filter := bson.D{{"userid", userid}}
-	err := collection.FindOne(context.Background(), filter).Decode(&result)
-	if err != nil {
-		logrus.Error("MgoDB: FindOne Commodity data error: ", err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid User"})
+// Register 匹配/api/register，表单参数 userid 和 password。
+// 新用户创建账号、钱包和初始物品；已有账号时密码必须正确，没有任何物品的用户重新领取一把镐子
+func Register(c *gin.Context) {
+	userid := c.PostForm("userid")
+	password := c.PostForm("password")
+	if userid == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing Userid value"})
 		return
 	}
-	if result.Pickaxe <= 0 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Pickaxe is not enough"})
+	if userid == commodity.ShopID || userid == commodity.EscrowID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Userid is reserved"})
 		return
-	} else {
-		c.JSON(http.StatusOK, "Pickaxe is enough")
 	}
-}
-
-func CheckLogging(c *gin.Context) {
-	mutex.Lock()
-	defer mutex.Unlock()
-	userid := c.Query("userid")
-	client := database.Mgo.Client
-	collection := client.Database("BlockChain").Collection("Commodity")
-	result := commodity.Commodity{}
-	filter := bson.D{{"userid", userid}}
-	err := collection.FindOne(context.Background(), filter).Decode(&result)
-	if err != nil {
-		logrus.Error("MgoDB: FindOne Commodity data error: ", err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid User"})
+	defer lockUsers(userid)()
+	_, err := auth.CreateAccount(userid, password)
+	created := err == nil
+	if err == auth.ErrAccountExists {
+		if _, err := auth.Login(userid, password); err != nil {
+			c.JSON(http.StatusConflict, gin.H{"error": "User already exists"})
+			return
+		}
+	} else if err == auth.ErrWeakPassword {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Password is too short"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Create account failed"})
 		return
 	}
-	if result.Axe <= 0 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Axe is not enough"})
+	// 注册时为用户生成钱包，之后的币都锁定到钱包地址
+	if _, err := wallet.Get(userid); err != nil {
+		logrus.Error("Wallet: create wallet error: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Create wallet failed"})
 		return
+	}
+	result, err := commodity.GetPersonalInfo(userid)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	if created {
+		if err := commodity.AddItems(userid, map[string]int{starterItem: 1}); err != nil {
+			respondError(c, err)
+			return
+		}
+		publishInventory(userid)
+		c.JSON(http.StatusOK, "Register success")
+	} else if isEmpty(result.Items) {
+		if err := commodity.AddItems(userid, map[string]int{starterItem: 1}); err == nil {
+			publishInventory(userid)
+		}
+		c.JSON(http.StatusOK, "Register success: Axe")
 	} else {
-		c.JSON(http.StatusOK, "Axe is enough")
+		c.JSON(http.StatusOK, "Register success")
 	}
 }
 
-func Register(c *gin.Context) {
-	mutex.Lock()
-	defer mutex.Unlock()
-	userid := c.Query("userid")
-	client := database.Mgo.Client
-	collection := client.Database("BlockChain").Collection("Commodity")
-	result := commodity.Commodity{}
-	filter := bson.D{{"userid", userid}}
-	err := collection.FindOne(context.Background(), filter).Decode(&result)
+// 新用户和没有任何物品的用户领取的初始物品
+const starterItem = "pickaxe"
 
-	if err != nil {
-		if err == mongo.ErrNoDocuments {
-			// This error means your query did not match any documents.
-			result.Pickaxe = 1
-			result.UserID = userid
-			_, err := collection.InsertOne(context.Background(), result)
-			if err != nil {
-				logrus.Error("MgoDB: Insert Commodity data error: ", err)
-				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid User"})
-			} else {
-				logrus.Info("MgoDB: Insert Commodity data success")
-			}
-			c.JSON(http.StatusOK, "Register success")
-		} else {
-			logrus.Error("MgoDB: Query BlockChain data error: ", err)
+func isEmpty(items map[string]int) bool {
+	for _, n := range items {
+		if n > 0 {
+			return false
 		}
-	} else if result.Axe <= 0 && result.Fishingrod <= 0 && result.Pickaxe <= 0 && result.Log <= 0 &&
-		result.Fish <= 0 && result.Hamburger <= 0 && result.Diamond <= 0 && result.Beer <= 0 &&
-		result.Soda <= 0 && result.Cola <= 0 {
+	}
+	return true
+}
 
-		result.Pickaxe = 1
-		filter = bson.D{{"userid", userid}}
+// Login 匹配/api/login，表单参数 userid 和 password，返回之后请求使用的令牌
+func Login(c *gin.Context) {
+	account, err := auth.Login(c.PostForm("userid"), c.PostForm("password"))
+	if err == auth.ErrInvalidCredentials {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid userid or password"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
+		return
+	}
+	role := auth.RoleOf(account)
+	token, expires, err := auth.IssueToken(account.UserID, role)
+	if err != nil {
+		logrus.Error("Auth: issue token error: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"token": token, "userid": account.UserID, "role": role, "expires": expires.UTC().Format(time.RFC3339)})
+}
 
-		update := bson.D{{"$set", bson.D{{"pickaxe", result.Pickaxe}}}}
-		_, err = collection.UpdateOne(context.Background(), filter, update)
-		if err != nil {
-			logrus.Error("MgoDB: Update Commodity data error: ", err)
-		} else {
-			logrus.Info("MgoDB: Update Commodity data success")
-		}
-		c.JSON(http.StatusOK, "Register success: Axe")
-	} else {
-		c.JSON(http.StatusOK, "Register success")
+// authorize 检查登录用户能否以 userid 的身份操作，不能时返回 403
+func authorize(c *gin.Context, userid string) bool {
+	if !auth.Allowed(c, userid) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Not allowed to act for user " + userid})
+		return false
 	}
+	return true
 }